@@ -23,6 +23,7 @@ import (
 	clientapi "github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -328,6 +329,285 @@ func AdminPurgeRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI)
 	}
 }
 
+func AdminAbortBackfill(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	aborted, err := rsAPI.PerformAdminAbortBackfill(req.Context(), vars["roomID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"aborted": aborted,
+		},
+	}
+}
+
+func AdminExportBackfill(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	limit := 100
+	if limitQuery := req.URL.Query().Get("limit"); limitQuery != "" {
+		limit, err = strconv.Atoi(limitQuery)
+		if err != nil || limit < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("invalid 'limit' query parameter"),
+			}
+		}
+	}
+
+	path, exported, err := rsAPI.PerformAdminExportBackfill(req.Context(), vars["roomID"], limit)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"path":     path,
+			"exported": exported,
+		},
+	}
+}
+
+func AdminRepairState(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	request := struct {
+		EventIDs []string `json:"event_ids"`
+	}{}
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("Failed to decode request body: " + err.Error()),
+		}
+	}
+	if len(request.EventIDs) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Expecting non-empty event_ids."),
+		}
+	}
+
+	repaired, err := rsAPI.PerformStateRepair(req.Context(), vars["roomID"], request.EventIDs)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"repaired": repaired,
+		},
+	}
+}
+
+func AdminBackfillServers(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	servers, err := rsAPI.QueryBackfillServers(req.Context(), vars["roomID"], vars["eventID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"servers": servers,
+		},
+	}
+}
+
+func AdminBackwardExtremities(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	bwExtrems, err := rsAPI.QueryBackwardExtremities(req.Context(), vars["roomID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"backward_extremities": bwExtrems,
+		},
+	}
+}
+
+func AdminEstimateBackfill(req *http.Request, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	from := req.URL.Query()["from"]
+	if len(from) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Expecting at least one 'from' query parameter."),
+		}
+	}
+	limit := 100
+	if limitQuery := req.URL.Query().Get("limit"); limitQuery != "" {
+		limit, err = strconv.Atoi(limitQuery)
+		if err != nil || limit < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("invalid 'limit' query parameter"),
+			}
+		}
+	}
+
+	estimate, err := rsAPI.EstimateBackfill(req.Context(), device.UserDomain(), vars["roomID"], from, limit)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: estimate,
+	}
+}
+
+func AdminWarmBackfillState(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	request := struct {
+		EventIDs []string `json:"event_ids"`
+	}{}
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("Failed to decode request body: " + err.Error()),
+		}
+	}
+	if len(request.EventIDs) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Expecting non-empty event_ids."),
+		}
+	}
+
+	warmed, err := rsAPI.WarmBackfillState(req.Context(), vars["roomID"], request.EventIDs)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"warmed": warmed,
+		},
+	}
+}
+
+func AdminUnredactedBackfill(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	from := req.URL.Query()["from"]
+	if len(from) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Expecting at least one 'from' query parameter."),
+		}
+	}
+	limit := 100
+	if limitQuery := req.URL.Query().Get("limit"); limitQuery != "" {
+		limit, err = strconv.Atoi(limitQuery)
+		if err != nil || limit < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.BadJSON("invalid 'limit' query parameter"),
+			}
+		}
+	}
+	serverName := spec.ServerName(req.URL.Query().Get("server_name"))
+
+	events, redactedEventIDs, err := rsAPI.QueryAdminUnredactedBackfill(req.Context(), vars["roomID"], serverName, from, limit)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	eventJSON := make([]json.RawMessage, 0, len(events))
+	for _, ev := range events {
+		eventJSON = append(eventJSON, ev.JSON())
+	}
+	if redactedEventIDs == nil {
+		redactedEventIDs = []string{}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"events":             eventJSON,
+			"redacted_event_ids": redactedEventIDs,
+		},
+	}
+}
+
+func AdminQuarantinedEvents(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	events, err := rsAPI.QueryAdminQuarantinedEvents(req.Context(), vars["roomID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if events == nil {
+		events = []types.QuarantinedEvent{}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]interface{}{
+			"events": events,
+		},
+	}
+}
+
+func AdminQuarantinedEvent(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	event, err := rsAPI.QueryAdminQuarantinedEvent(req.Context(), vars["eventID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if event == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Event is not quarantined"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: event,
+	}
+}
+
 func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.Device, userAPI api.ClientUserAPI) util.JSONResponse {
 	if req.Body == nil {
 		return util.JSONResponse{
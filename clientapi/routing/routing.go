@@ -226,6 +226,66 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/abortBackfill/{roomID}",
+		httputil.MakeAdminAPI("admin_abort_backfill", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminAbortBackfill(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/exportBackfill/{roomID}",
+		httputil.MakeAdminAPI("admin_export_backfill", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminExportBackfill(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/repairState/{roomID}",
+		httputil.MakeAdminAPI("admin_repair_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRepairState(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/backfillServers/{roomID}/{eventID}",
+		httputil.MakeAdminAPI("admin_backfill_servers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminBackfillServers(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/backwardExtremities/{roomID}",
+		httputil.MakeAdminAPI("admin_backward_extremities", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminBackwardExtremities(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/estimateBackfill/{roomID}",
+		httputil.MakeAdminAPI("admin_estimate_backfill", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminEstimateBackfill(req, device, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/warmBackfillState/{roomID}",
+		httputil.MakeAdminAPI("admin_warm_backfill_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminWarmBackfillState(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/unredactedBackfill/{roomID}",
+		httputil.MakeAdminAPI("admin_unredacted_backfill", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminUnredactedBackfill(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/quarantinedEvents/{roomID}",
+		httputil.MakeAdminAPI("admin_quarantined_events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantinedEvents(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/quarantinedEvent/{eventID}",
+		httputil.MakeAdminAPI("admin_quarantined_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantinedEvent(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/resetPassword/{userID}",
 		httputil.MakeAdminAPI("admin_reset_password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminResetPassword(req, cfg, device, userAPI)
@@ -210,6 +210,16 @@ func main() {
 		}()
 	}
 
+	// Apply the parts of the config which can change while running when it is reloaded.
+	basepkg.ReloadOnSIGHUP(processCtx, func() {
+		reloaded, err := setup.LoadConfig()
+		if err != nil {
+			logrus.WithError(err).Error("Failed to reload config, carrying on with the current one")
+			return
+		}
+		rsAPI.ReloadConfig(reloaded)
+	})
+
 	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
 	basepkg.WaitForShutdown(processCtx)
 }
@@ -3,6 +3,8 @@ package api
 import (
 	"context"
 	"crypto/ed25519"
+	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -12,6 +14,7 @@ import (
 	asAPI "github.com/matrix-org/dendrite/appservice/api"
 	fsAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
@@ -45,6 +48,53 @@ func (e ErrRoomUnknownOrNotAllowed) Error() string {
 	return e.Err.Error()
 }
 
+// ErrBackfillAborted is returned by PerformBackfill if the backfill
+// was aborted by PerformAdminAbortBackfill, e.g. because the room is
+// being purged.
+type ErrBackfillAborted struct {
+	RoomID string
+}
+
+func (e ErrBackfillAborted) Error() string {
+	return fmt.Sprintf("backfill of room %s was aborted", e.RoomID)
+}
+
+// ErrUnsupportedRoomVersion is returned by PerformBackfill if the room
+// has a version which this server doesn't support, so none of its events
+// can be backfilled. Retrying won't help until the server is upgraded.
+type ErrUnsupportedRoomVersion struct {
+	RoomID      string
+	RoomVersion gomatrixserverlib.RoomVersion
+}
+
+func (e ErrUnsupportedRoomVersion) Error() string {
+	return fmt.Sprintf("can't backfill room %s as room version %q is not supported", e.RoomID, e.RoomVersion)
+}
+
+// ErrUnknownRoom is returned by PerformBackfill if we have no info on
+// the room to backfill, which is often a sign of a bug in the caller or
+// of a race with the room being created.
+type ErrUnknownRoom struct {
+	RoomID string
+}
+
+func (e ErrUnknownRoom) Error() string {
+	return fmt.Sprintf("can't backfill unknown room %s", e.RoomID)
+}
+
+// ErrBackfillTooSoon is returned by PerformBackfill if the room was
+// backfilled from federation too recently to do so again, to protect
+// federation from clients paginating rapidly. It can be retried after
+// RetryAfter.
+type ErrBackfillTooSoon struct {
+	RoomID     string
+	RetryAfter time.Duration
+}
+
+func (e ErrBackfillTooSoon) Error() string {
+	return fmt.Sprintf("room %s was backfilled too recently, retry after %s", e.RoomID, e.RetryAfter)
+}
+
 type RestrictedJoinAPI interface {
 	CurrentStateEvent(ctx context.Context, roomID spec.RoomID, eventType string, stateKey string) (gomatrixserverlib.PDU, error)
 	InvitePending(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (bool, error)
@@ -77,6 +127,9 @@ type RoomserverInternalAPI interface {
 	SetAppserviceAPI(asAPI asAPI.AppServiceInternalAPI)
 	SetUserAPI(userAPI userapi.RoomserverUserAPI)
 
+	// ReloadConfig applies the parts of a reloaded configuration which can change while Dendrite is running.
+	ReloadConfig(cfg *config.Dendrite)
+
 	// QueryAuthChain returns the entire auth chain for the event IDs given.
 	// The response includes the events in the request.
 	// Omits without error for any missing auth events. There will be no duplicates.
@@ -247,6 +300,39 @@ type ClientRoomserverAPI interface {
 	PerformAdminEvacuateRoom(ctx context.Context, roomID string) (affected []string, err error)
 	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
 	PerformAdminPurgeRoom(ctx context.Context, roomID string) error
+	// PerformAdminAbortBackfill aborts all backfills of the room which are in flight, returning how many were aborted.
+	PerformAdminAbortBackfill(ctx context.Context, roomID string) (aborted int, err error)
+	// PerformAdminExportBackfill backfills up to limit events of the room as a dry run and writes them to a new
+	// file in the backfill export directory instead of persisting them, returning the path of the file and how
+	// many events were exported. See ExportedBackfillEvent for the format of the file.
+	PerformAdminExportBackfill(ctx context.Context, roomID string, limit int) (path string, exported int, err error)
+	// PerformStateRepair asks the servers in the room for the state before each of the events again and replaces
+	// the state we stored before them, returning the IDs of the events whose state was replaced.
+	PerformStateRepair(ctx context.Context, roomID string, eventIDs []string) (repaired []string, err error)
+	// QueryBackfillServers returns the servers which a backfill of the room from the event would ask for history,
+	// in the order they would be asked, without backfilling anything. The event is either a backward extremity of
+	// the room or one of the events missing before one.
+	QueryBackfillServers(ctx context.Context, roomID, eventID string) ([]spec.ServerName, error)
+	// QueryBackwardExtremities returns the backward extremities of the room, as a map of
+	// event ID to the prev_event IDs we don't have.
+	QueryBackwardExtremities(ctx context.Context, roomID string) (map[string][]string, error)
+	// EstimateBackfill estimates how many of the limit events before prevEventIDs we have locally,
+	// how many would need to be fetched over federation and how many servers could provide them,
+	// without fetching or persisting anything.
+	EstimateBackfill(ctx context.Context, virtualHost spec.ServerName, roomID string, prevEventIDs []string, limit int) (*BackfillEstimate, error)
+	// WarmBackfillState loads the given events and the state before them from the database ahead of the
+	// next backfill of the room, so that it needs fewer /state_ids requests for history next to them.
+	// Returns how many of the events were warmed, ignoring those which we don't have.
+	WarmBackfillState(ctx context.Context, roomID string, fromEventIDs []string) (int, error)
+	// QueryAdminUnredactedBackfill returns up to limit events of the room before fromEventIDs as a backfill would
+	// serve them to serverName, or to us if it is empty, but without redacting the events which it isn't allowed to
+	// see, along with the IDs of those events. It only serves events from the database. Federation must never be able
+	// to reach this, so it is only part of this API.
+	QueryAdminUnredactedBackfill(ctx context.Context, roomID string, serverName spec.ServerName, fromEventIDs []string, limit int) (events []*types.HeaderedEvent, redactedEventIDs []string, err error)
+	// QueryAdminQuarantinedEvents returns the events of the room which were quarantined during backfill.
+	QueryAdminQuarantinedEvents(ctx context.Context, roomID string) ([]types.QuarantinedEvent, error)
+	// QueryAdminQuarantinedEvent returns the quarantined event, or nil if it isn't quarantined.
+	QueryAdminQuarantinedEvent(ctx context.Context, eventID string) (*types.QuarantinedEvent, error)
 	PerformAdminDownloadState(ctx context.Context, roomID, userID string, serverName spec.ServerName) error
 	PerformPeek(ctx context.Context, req *PerformPeekRequest) (roomID string, err error)
 	PerformUnpeek(ctx context.Context, roomID, userID, deviceID string) error
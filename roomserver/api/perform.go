@@ -86,6 +86,56 @@ type PerformBackfillRequest struct {
 	ServerName spec.ServerName `json:"server_name"`
 	// Which virtual host are we doing this for?
 	VirtualHost spec.ServerName `json:"virtual_host"`
+	// If true, don't backfill the timeline but only fetch the state events in
+	// MissingStateEventIDs which we don't already have. BackwardsExtremities and
+	// Limit are ignored.
+	StateOnly bool `json:"state_only,omitempty"`
+	// The state event IDs to fetch when StateOnly is set.
+	MissingStateEventIDs []string `json:"missing_state_event_ids,omitempty"`
+	// Servers which are known to be good candidates to backfill from, e.g. the via
+	// servers of a permalink. These are tried after the preferred servers but before
+	// any other servers in the room.
+	ServerHints []spec.ServerName `json:"server_hints,omitempty"`
+	// If set, backfill from the prev_events of this event instead of from
+	// BackwardsExtremities. This is the Checkpoint of an earlier backfill, which
+	// lets a large backfill which was interrupted carry on where it left off.
+	ResumeFrom string `json:"resume_from,omitempty"`
+	// If true, the response lists the events which were redacted because the
+	// requesting server isn't allowed to see them.
+	IncludeRedactedEventIDs bool `json:"include_redacted_event_ids,omitempty"`
+	// If set, only fetch the events bridging this gap with /get_missing_events,
+	// instead of walking backwards from BackwardsExtremities with /backfill.
+	// Up to Limit events are fetched.
+	TargetGap *BackfillGap `json:"target_gap,omitempty"`
+	// If true, fetch the events from federation as usual but don't persist
+	// them or their state. The response then holds the state before each event
+	// in BeforeStateIDs. Only backfills from federation can be dry runs.
+	DryRun bool `json:"dry_run,omitempty"`
+	// If true, the response says where each of the events came from in
+	// EventSources.
+	IncludeEventSources bool `json:"include_event_sources,omitempty"`
+}
+
+// BackfillEventSource is where an event returned by PerformBackfill came from.
+type BackfillEventSource string
+
+const (
+	// The event was loaded from the database.
+	BackfillEventSourceDatabase BackfillEventSource = "database"
+	// The event was fetched from federation by this backfill.
+	BackfillEventSourceFederation BackfillEventSource = "federation"
+	// The event was fetched from federation by an earlier backfill, whose
+	// result was cached.
+	BackfillEventSourceCache BackfillEventSource = "cache"
+)
+
+// BackfillGap is a gap in the history of a room, before an event whose
+// prev_events we don't have.
+type BackfillGap struct {
+	// The event after the gap, which we have.
+	SuccessorEventID string `json:"successor_event_id"`
+	// The prev_events of the successor which we don't have.
+	MissingEventIDs []string `json:"missing_event_ids"`
 }
 
 // limitPrevEventIDs is the maximum of eventIDs we
@@ -133,6 +183,53 @@ type PerformBackfillResponse struct {
 	// Missing events, arbritrary order.
 	Events            []*types.HeaderedEvent              `json:"events"`
 	HistoryVisibility gomatrixserverlib.HistoryVisibility `json:"history_visibility"`
+	// For StateOnly requests, the IDs of the missing state events which were fetched
+	// and stored.
+	RecoveredEventIDs []string `json:"recovered_event_ids,omitempty"`
+	// The oldest backfilled event which was persisted along with its state, if
+	// checkpointing is enabled. Pass this as ResumeFrom to carry on backfilling.
+	Checkpoint string `json:"checkpoint,omitempty"`
+	// The IDs of the events which were redacted because the requesting server
+	// isn't allowed to see them, if IncludeRedactedEventIDs was set.
+	RedactedEventIDs []string `json:"redacted_event_ids,omitempty"`
+	// For DryRun requests, the IDs of the state events before each of the
+	// events, keyed by event ID, as they would have been persisted.
+	BeforeStateIDs map[string][]string `json:"before_state_ids,omitempty"`
+	// True if the backfill ran out of time, so Events only holds the events
+	// which were gathered before then. They were persisted as usual.
+	Partial bool `json:"partial,omitempty"`
+	// If IncludeEventSources was set, where each of Events came from, in the
+	// same order as Events.
+	EventSources []BackfillEventSource `json:"event_sources,omitempty"`
+	// True if the create event of the room was backfilled, so there is no
+	// more history before it to backfill.
+	ReachedRoomStart bool `json:"reached_room_start,omitempty"`
+}
+
+// ExportedBackfillEvent is a line of a backfill export written by
+// PerformAdminExportBackfill. An export is newline-delimited JSON, with one
+// ExportedBackfillEvent per line, oldest event first. The format is stable:
+// fields may be added in future, but existing fields won't be renamed, removed
+// or change meaning.
+type ExportedBackfillEvent struct {
+	// The ID of the event.
+	EventID string `json:"event_id"`
+	// The version of the room, which determines how Event is interpreted.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// The event as it was received over federation.
+	Event json.RawMessage `json:"event"`
+	// The IDs of the state events before the event, in no particular order.
+	StateBeforeIDs []string `json:"state_before_ids"`
+}
+
+// BackfillEstimate is an estimate of the cost of a backfill, as returned by EstimateBackfill.
+type BackfillEstimate struct {
+	// The number of the requested events which we already have.
+	LocalEvents int `json:"local_events"`
+	// The number of the requested events which would have to be fetched over federation.
+	FederationEvents int `json:"federation_events"`
+	// The number of servers the missing events could be fetched from.
+	CandidateServers int `json:"candidate_servers"`
 }
 
 type PerformPublishRequest struct {
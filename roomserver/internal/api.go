@@ -47,6 +47,8 @@ type RoomserverInternalAPI struct {
 	*perform.Creator
 	ProcessContext         *process.ProcessContext
 	DB                     storage.Database
+	BackfillReadDB         storage.Database  // a read replica of DB for backfill to read history from, if any
+	BackfillEventSink      perform.EventSink // where backfilled events are mirrored to once stored, if anywhere
 	Cfg                    *config.Dendrite
 	Cache                  caching.RoomServerCaches
 	ServerName             spec.ServerName
@@ -68,11 +70,6 @@ func NewRoomserverAPI(
 	processContext *process.ProcessContext, dendriteCfg *config.Dendrite, roomserverDB storage.Database,
 	js nats.JetStreamContext, nc *nats.Conn, caches caching.RoomServerCaches, enableMetrics bool,
 ) *RoomserverInternalAPI {
-	var perspectiveServerNames []spec.ServerName
-	for _, kp := range dendriteCfg.FederationAPI.KeyPerspectives {
-		perspectiveServerNames = append(perspectiveServerNames, kp.ServerName)
-	}
-
 	serverACLs := acls.NewServerACLs(roomserverDB)
 	producer := &producers.RoomEventProducer{
 		Topic:     string(dendriteCfg.Global.JetStream.Prefixed(jetstream.OutputRoomEvent)),
@@ -85,7 +82,7 @@ func NewRoomserverAPI(
 		Cfg:                    dendriteCfg,
 		Cache:                  caches,
 		ServerName:             dendriteCfg.Global.ServerName,
-		PerspectiveServerNames: perspectiveServerNames,
+		PerspectiveServerNames: dendriteCfg.FederationAPI.KeyPerspectives.ServerNames(),
 		InputRoomEventTopic:    dendriteCfg.Global.JetStream.Prefixed(jetstream.InputRoomEvent),
 		OutputProducer:         producer,
 		JetStream:              js,
@@ -178,13 +175,38 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 	r.Backfiller = &perform.Backfiller{
 		IsLocalServerName: r.Cfg.Global.IsLocalServerName,
 		DB:                r.DB,
+		ReadDB:            r.BackfillReadDB,
 		FSAPI:             r.fsAPI,
 		Querier:           r.Queryer,
 		KeyRing:           r.KeyRing,
 		// Perspective servers are trusted to not lie about server keys, so we will also
 		// prefer these servers when backfilling (assuming they are in the room) rather
 		// than trying random servers
-		PreferServers: r.PerspectiveServerNames,
+		PreferServers:                  r.PerspectiveServerNames,
+		MaxFederationRequests:          r.Cfg.RoomServer.Backfill.MaxFederationRequests,
+		PersistConcurrency:             r.Cfg.RoomServer.Backfill.PersistConcurrency,
+		PreferFastServers:              r.Cfg.RoomServer.Backfill.PreferFastServers,
+		ResultCacheTTL:                 r.Cfg.RoomServer.Backfill.ResultCacheTTL,
+		ResultCacheSize:                r.Cfg.RoomServer.Backfill.ResultCacheSize,
+		RecordVirtualHost:              r.Cfg.RoomServer.Backfill.RecordVirtualHost,
+		CheckpointInterval:             r.Cfg.RoomServer.Backfill.CheckpointInterval,
+		QuarantineRejectedEvents:       r.Cfg.RoomServer.Backfill.QuarantineRejectedEvents,
+		RememberAuthEvents:             r.Cfg.RoomServer.Backfill.RememberAuthEvents,
+		MaxConcurrentRequestsPerServer: r.Cfg.RoomServer.Backfill.MaxConcurrentRequestsPerServer,
+		PreferServerWeights:            r.Cfg.RoomServer.Backfill.PreferServerWeights,
+		RejectStateResets:              r.Cfg.RoomServer.Backfill.RejectStateResets,
+		FailureLogInterval:             r.Cfg.RoomServer.Backfill.FailureLogInterval,
+		PreferRecentServers:            r.Cfg.RoomServer.Backfill.PreferRecentServers,
+		Timeout:                        r.Cfg.RoomServer.Backfill.Timeout,
+		RelayServer:                    r.Cfg.RoomServer.Backfill.RelayServer,
+		IncludeLeftServers:             r.Cfg.RoomServer.Backfill.IncludeLeftServers,
+		FallbackToMemberServers:        r.Cfg.RoomServer.Backfill.FallbackToMemberServers,
+		MaxRounds:                      r.Cfg.RoomServer.Backfill.MaxRounds,
+		ServersCacheTTL:                r.Cfg.RoomServer.Backfill.ServersCacheTTL,
+		RefreshServersConcurrently:     r.Cfg.RoomServer.Backfill.RefreshServersConcurrently,
+		MaxRememberedEvents:            r.Cfg.RoomServer.Backfill.MaxRememberedEvents,
+		MinInterval:                    r.Cfg.RoomServer.Backfill.MinInterval,
+		EventSink:                      r.BackfillEventSink,
 	}
 	r.Forgetter = &perform.Forgetter{
 		DB: r.DB,
@@ -194,11 +216,12 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		URSAPI: r,
 	}
 	r.Admin = &perform.Admin{
-		DB:      r.DB,
-		Cfg:     &r.Cfg.RoomServer,
-		Inputer: r.Inputer,
-		Queryer: r.Queryer,
-		Leaver:  r.Leaver,
+		DB:         r.DB,
+		Cfg:        &r.Cfg.RoomServer,
+		Inputer:    r.Inputer,
+		Queryer:    r.Queryer,
+		Leaver:     r.Leaver,
+		Backfiller: r.Backfiller,
 	}
 	r.Creator = &perform.Creator{
 		DB:    r.DB,
@@ -220,6 +243,14 @@ func (r *RoomserverInternalAPI) SetAppserviceAPI(asAPI asAPI.AppServiceInternalA
 	r.asAPI = asAPI
 }
 
+// ReloadConfig applies the parts of a reloaded configuration which can change while Dendrite is running, which are
+// the servers that backfills prefer.
+func (r *RoomserverInternalAPI) ReloadConfig(cfg *config.Dendrite) {
+	if r.Backfiller != nil {
+		r.Backfiller.ReloadConfig(cfg)
+	}
+}
+
 func (r *RoomserverInternalAPI) DefaultRoomVersion() gomatrixserverlib.RoomVersion {
 	return r.defaultRoomVersion
 }
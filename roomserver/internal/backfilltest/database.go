@@ -0,0 +1,262 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backfilltest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+// Querier is a fake api.QuerySenderIDAPI for rooms which don't use pseudo IDs.
+type Querier struct {
+	api.QuerySenderIDAPI
+}
+
+func (q *Querier) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return spec.NewUserID(string(senderID), true)
+}
+
+func (q *Querier) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	senderID := spec.SenderID(userID.String())
+	return &senderID, nil
+}
+
+// Database wraps a storage.Database, allowing tests to observe and inject failures into
+// the calls made by backfill. Methods which aren't overridden go straight to the
+// wrapped database.
+type Database struct {
+	storage.Database
+
+	mu    sync.Mutex
+	calls map[string]int
+	// If set, returned from the corresponding method instead of calling the wrapped database.
+	StoreEventErr error
+	AddStateErr   error
+	SetStateErr   error
+}
+
+// NewDatabase wraps the given database.
+func NewDatabase(db storage.Database) *Database {
+	return &Database{
+		Database: db,
+		calls:    make(map[string]int),
+	}
+}
+
+// Calls returns how many times the named method has been called.
+func (d *Database) Calls(method string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls[method]
+}
+
+func (d *Database) called(method string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls[method]++
+}
+
+func (d *Database) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventMetadata, error) {
+	d.called("EventNIDs")
+	return d.Database.EventNIDs(ctx, eventIDs)
+}
+
+func (d *Database) ExistingEventIDs(ctx context.Context, eventIDs []string) (map[string]bool, error) {
+	d.called("ExistingEventIDs")
+	return d.Database.ExistingEventIDs(ctx, eventIDs)
+}
+
+func (d *Database) StoreEvent(
+	ctx context.Context, event gomatrixserverlib.PDU, roomInfo *types.RoomInfo, eventTypeNID types.EventTypeNID,
+	eventStateKeyNID types.EventStateKeyNID, authEventNIDs []types.EventNID, isRejected bool,
+) (types.EventNID, types.StateAtEvent, error) {
+	d.called("StoreEvent")
+	if d.StoreEventErr != nil {
+		return 0, types.StateAtEvent{}, d.StoreEventErr
+	}
+	return d.Database.StoreEvent(ctx, event, roomInfo, eventTypeNID, eventStateKeyNID, authEventNIDs, isRejected)
+}
+
+func (d *Database) AddState(
+	ctx context.Context, roomNID types.RoomNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	d.called("AddState")
+	if d.AddStateErr != nil {
+		return 0, d.AddStateErr
+	}
+	return d.Database.AddState(ctx, roomNID, stateBlockNIDs, state)
+}
+
+func (d *Database) SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
+	d.called("SetState")
+	if d.SetStateErr != nil {
+		return d.SetStateErr
+	}
+	return d.Database.SetState(ctx, eventNID, stateNID)
+}
+
+func (d *Database) AddAndSetState(
+	ctx context.Context, roomNID types.RoomNID, eventNID types.EventNID, stateBlockNIDs []types.StateBlockNID, state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	d.called("AddAndSetState")
+	if d.AddStateErr != nil {
+		return 0, d.AddStateErr
+	}
+	if d.SetStateErr != nil {
+		return 0, d.SetStateErr
+	}
+	return d.Database.AddAndSetState(ctx, roomNID, eventNID, stateBlockNIDs, state)
+}
+
+// MustCreateDatabase opens a new roomserver database of the given type.
+func MustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
+	t.Helper()
+	conStr, close := test.PrepareDBConnectionString(t, dbType)
+	caches := caching.NewRistrettoCache(8*1024*1024, time.Hour, caching.DisableMetrics)
+	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+	db, err := storage.Open(context.Background(), cm, &config.DatabaseOptions{ConnectionString: config.DataSource(conStr)}, caches)
+	if err != nil {
+		t.Fatalf("failed to create Database: %v", err)
+	}
+	return db, close
+}
+
+// MustStoreEvents stores the given events from the room as if we had received them, along with
+// the state before each of them. The state events before each event must either be in events
+// or already be stored. Memberships are updated and the last of the events becomes the latest
+// event in the room. Returns the room info.
+func MustStoreEvents(t *testing.T, db storage.Database, room *test.Room, localServer spec.ServerName, events []*types.HeaderedEvent) *types.RoomInfo {
+	t.Helper()
+	ctx := context.Background()
+	stateIDsBefore := StateIDsBefore(room)
+
+	var roomInfo *types.RoomInfo
+	var eventNID types.EventNID
+	var stateAtEvent types.StateAtEvent
+	for _, ev := range events {
+		var err error
+		roomInfo, err = db.GetOrCreateRoomInfo(ctx, ev.PDU)
+		if err != nil {
+			t.Fatalf("failed to get or create room info: %v", err)
+		}
+		eventTypeNID, err := db.GetOrCreateEventTypeNID(ctx, ev.Type())
+		if err != nil {
+			t.Fatalf("failed to get or create event type NID: %v", err)
+		}
+		eventStateKeyNID, err := db.GetOrCreateEventStateKeyNID(ctx, ev.StateKey())
+		if err != nil {
+			t.Fatalf("failed to get or create event state key NID: %v", err)
+		}
+		eventNID, stateAtEvent, err = db.StoreEvent(ctx, ev.PDU, roomInfo, eventTypeNID, eventStateKeyNID, nil, false)
+		if err != nil {
+			t.Fatalf("failed to store event: %v", err)
+		}
+		entries, err := db.StateEntriesForEventIDs(ctx, stateIDsBefore[ev.EventID()], true)
+		if err != nil {
+			t.Fatalf("failed to get state entries before event %s: %v", ev.EventID(), err)
+		}
+		stateAtEvent.BeforeStateSnapshotNID, err = db.AddState(ctx, roomInfo.RoomNID, nil, entries)
+		if err != nil {
+			t.Fatalf("failed to add state: %v", err)
+		}
+		if err = db.SetState(ctx, eventNID, stateAtEvent.BeforeStateSnapshotNID); err != nil {
+			t.Fatalf("failed to set state: %v", err)
+		}
+		if ev.Type() == spec.MRoomMember {
+			mustUpdateMembership(t, db, room, localServer, &types.Event{EventNID: eventNID, PDU: ev.PDU})
+		}
+	}
+	if len(events) == 0 {
+		return roomInfo
+	}
+
+	// Mark the last event as the latest event in the room, with the state after it as the current state.
+	last := events[len(events)-1]
+	currentStateIDs := stateIDsBefore[last.EventID()]
+	if last.StateKey() != nil {
+		currentStateIDs = append(currentStateIDs, last.EventID())
+	}
+	entries, err := db.StateEntriesForEventIDs(ctx, currentStateIDs, true)
+	if err != nil {
+		t.Fatalf("failed to get current state entries: %v", err)
+	}
+	currentStateNID, err := db.AddState(ctx, roomInfo.RoomNID, nil, entries)
+	if err != nil {
+		t.Fatalf("failed to add current state: %v", err)
+	}
+	updater, err := db.GetRoomUpdater(ctx, roomInfo)
+	if err != nil {
+		t.Fatalf("failed to get room updater: %v", err)
+	}
+	latest := []types.StateAtEventAndReference{{StateAtEvent: stateAtEvent, EventID: last.EventID()}}
+	if err = updater.SetLatestEvents(roomInfo.RoomNID, latest, eventNID, currentStateNID); err != nil {
+		t.Fatalf("failed to set latest events: %v", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("failed to commit room updater: %v", err)
+	}
+	roomInfo, err = db.RoomInfo(ctx, room.ID)
+	if err != nil {
+		t.Fatalf("failed to get room info: %v", err)
+	}
+	return roomInfo
+}
+
+func mustUpdateMembership(t *testing.T, db storage.Database, room *test.Room, localServer spec.ServerName, ev *types.Event) {
+	t.Helper()
+	membership, err := ev.Membership()
+	if err != nil {
+		t.Fatalf("failed to get membership: %v", err)
+	}
+	var state tables.MembershipState
+	switch membership {
+	case spec.Join:
+		state = tables.MembershipStateJoin
+	case spec.Invite:
+		state = tables.MembershipStateInvite
+	case spec.Knock:
+		state = tables.MembershipStateKnock
+	default:
+		state = tables.MembershipStateLeaveOrBan
+	}
+	userID, err := spec.NewUserID(*ev.StateKey(), true)
+	if err != nil {
+		t.Fatalf("failed to parse user ID: %v", err)
+	}
+	updater, err := db.MembershipUpdater(context.Background(), room.ID, userID.String(), userID.Domain() == localServer, room.Version)
+	if err != nil {
+		t.Fatalf("failed to create membership updater: %v", err)
+	}
+	if _, _, err = updater.Update(state, ev); err != nil {
+		t.Fatalf("failed to update membership: %v", err)
+	}
+	if err = updater.Commit(); err != nil {
+		t.Fatalf("failed to commit membership: %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backfilltest contains fakes and fixtures for deterministically testing
+// roomserver backfill without a real federation client.
+package backfilltest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/test"
+)
+
+// Federation endpoints, as recorded in a Request.
+const (
+	EndpointBackfill      = "backfill"
+	EndpointEvent         = "event"
+	EndpointStateIDs      = "state_ids"
+	EndpointState         = "state"
+	EndpointMissingEvents = "get_missing_events"
+)
+
+// Request is a federation request made against the fake federation API.
+type Request struct {
+	Endpoint string
+	Server   spec.ServerName
+	// The event ID the request was made for. For /backfill this is the first of the
+	// event IDs to backfill from, and for /get_missing_events the first of the latest events.
+	EventID string
+}
+
+// Server holds the fixtures a single remote server responds with.
+type Server struct {
+	// The events this server knows about, keyed by event ID.
+	Events map[string]gomatrixserverlib.PDU
+	// The state event IDs before each event, keyed by event ID.
+	StateIDs map[string][]string
+	// If true, all requests to this server fail.
+	Unreachable bool
+	// If true, /state_ids requests to this server fail, as if it only implemented /state.
+	NoStateIDs bool
+	// Events included in every /backfill response from this server, whichever room they are in.
+	BackfillExtra []gomatrixserverlib.PDU
+	// How long this server takes to respond to each request. Requests fail if
+	// their context is done first.
+	Delay time.Duration
+	// How long this server takes to respond to /event requests, on top of Delay.
+	EventDelay time.Duration
+	// If set, the most events this server returns from each /backfill request,
+	// whatever limit was asked for.
+	BackfillLimit int
+}
+
+// NewServer returns a server which knows about every event in the given room.
+func NewServer(room *test.Room) *Server {
+	srv := &Server{
+		Events:   make(map[string]gomatrixserverlib.PDU),
+		StateIDs: StateIDsBefore(room),
+	}
+	for _, ev := range room.Events() {
+		srv.Events[ev.EventID()] = ev.PDU
+	}
+	return srv
+}
+
+// Forget removes the given events from the server, as if it never had them.
+func (s *Server) Forget(eventIDs ...string) {
+	for _, id := range eventIDs {
+		delete(s.Events, id)
+		delete(s.StateIDs, id)
+	}
+}
+
+// FederationAPI is a fake federationAPI.RoomserverFederationAPI which serves /backfill,
+// /event, /get_missing_events, /state_ids and /state requests from in-memory fixtures. Calling any other
+// method of the interface panics.
+type FederationAPI struct {
+	federationAPI.RoomserverFederationAPI
+
+	mu       sync.Mutex
+	servers  map[spec.ServerName]*Server
+	requests []Request
+}
+
+// NewFederationAPI returns a fake federation API with no known servers.
+func NewFederationAPI() *FederationAPI {
+	return &FederationAPI{
+		servers: make(map[spec.ServerName]*Server),
+	}
+}
+
+// AddServer makes the given server reachable through the fake federation API.
+func (f *FederationAPI) AddServer(name spec.ServerName, srv *Server) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.servers[name] = srv
+}
+
+// Requests returns all requests made so far, in the order they were made.
+func (f *FederationAPI) Requests() []Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Request(nil), f.requests...)
+}
+
+// CountRequests returns how many requests were made to the given endpoint.
+func (f *FederationAPI) CountRequests(endpoint string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, req := range f.requests {
+		if req.Endpoint == endpoint {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *FederationAPI) request(ctx context.Context, endpoint string, s spec.ServerName, eventID string) (*Server, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, Request{Endpoint: endpoint, Server: s, EventID: eventID})
+	srv, ok := f.servers[s]
+	f.mu.Unlock()
+	if !ok || srv.Unreachable {
+		return nil, fmt.Errorf("backfilltest: server %s is unreachable", s)
+	}
+	if srv.Delay > 0 {
+		select {
+		case <-time.After(srv.Delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return srv, nil
+}
+
+// Backfill walks backwards through the prev_events of fromEventIDs, returning at most limit events.
+func (f *FederationAPI) Backfill(ctx context.Context, origin, s spec.ServerName, roomID string, limit int, fromEventIDs []string) (gomatrixserverlib.Transaction, error) {
+	var first string
+	if len(fromEventIDs) > 0 {
+		first = fromEventIDs[0]
+	}
+	srv, err := f.request(ctx, EndpointBackfill, s, first)
+	if err != nil {
+		return gomatrixserverlib.Transaction{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if srv.BackfillLimit > 0 && srv.BackfillLimit < limit {
+		limit = srv.BackfillLimit
+	}
+	var pdus []json.RawMessage
+	visited := make(map[string]bool)
+	front := append([]string(nil), fromEventIDs...)
+	for len(front) > 0 && len(pdus) < limit {
+		id := front[0]
+		front = front[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		ev, ok := srv.Events[id]
+		if !ok || ev.RoomID().String() != roomID {
+			continue
+		}
+		pdus = append(pdus, ev.JSON())
+		front = append(front, ev.PrevEventIDs()...)
+	}
+	for _, ev := range srv.BackfillExtra {
+		pdus = append(pdus, ev.JSON())
+	}
+	return gomatrixserverlib.Transaction{
+		Origin:         s,
+		OriginServerTS: spec.AsTimestamp(time.Now()),
+		PDUs:           pdus,
+	}, nil
+}
+
+// LookupMissingEvents walks backwards through the prev_events of the latest events, stopping at the earliest
+// events, returning at most limit events, oldest first.
+func (f *FederationAPI) LookupMissingEvents(ctx context.Context, origin, s spec.ServerName, roomID string, missing fclient.MissingEvents, roomVersion gomatrixserverlib.RoomVersion) (fclient.RespMissingEvents, error) {
+	var first string
+	if len(missing.LatestEvents) > 0 {
+		first = missing.LatestEvents[0]
+	}
+	srv, err := f.request(ctx, EndpointMissingEvents, s, first)
+	if err != nil {
+		return fclient.RespMissingEvents{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	visited := make(map[string]bool)
+	for _, id := range append(missing.EarliestEvents, missing.LatestEvents...) {
+		visited[id] = true
+	}
+	var front []string
+	for _, id := range missing.LatestEvents {
+		if ev, ok := srv.Events[id]; ok {
+			front = append(front, ev.PrevEventIDs()...)
+		}
+	}
+	var events gomatrixserverlib.EventJSONs
+	for len(front) > 0 && len(events) < missing.Limit {
+		id := front[0]
+		front = front[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		ev, ok := srv.Events[id]
+		if !ok || ev.RoomID().String() != roomID {
+			continue
+		}
+		events = append(events, ev.JSON())
+		front = append(front, ev.PrevEventIDs()...)
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return fclient.RespMissingEvents{Events: events}, nil
+}
+
+// GetEvent returns a transaction containing the requested event, if the server knows it.
+func (f *FederationAPI) GetEvent(ctx context.Context, origin, s spec.ServerName, eventID string) (gomatrixserverlib.Transaction, error) {
+	srv, err := f.request(ctx, EndpointEvent, s, eventID)
+	if err != nil {
+		return gomatrixserverlib.Transaction{}, err
+	}
+	if srv.EventDelay > 0 {
+		select {
+		case <-time.After(srv.EventDelay):
+		case <-ctx.Done():
+			return gomatrixserverlib.Transaction{}, ctx.Err()
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ev, ok := srv.Events[eventID]
+	if !ok {
+		return gomatrixserverlib.Transaction{}, fmt.Errorf("backfilltest: server %s does not have event %s", s, eventID)
+	}
+	return gomatrixserverlib.Transaction{
+		Origin:         s,
+		OriginServerTS: spec.AsTimestamp(time.Now()),
+		PDUs:           []json.RawMessage{ev.JSON()},
+	}, nil
+}
+
+// LookupStateIDs returns the state event IDs before the given event, if the server knows them.
+func (f *FederationAPI) LookupStateIDs(ctx context.Context, origin, s spec.ServerName, roomID, eventID string) (gomatrixserverlib.StateIDResponse, error) {
+	srv, err := f.request(ctx, EndpointStateIDs, s, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if srv.NoStateIDs {
+		return nil, fmt.Errorf("backfilltest: server %s does not implement /state_ids", s)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stateIDs, ok := srv.StateIDs[eventID]
+	if !ok {
+		return nil, fmt.Errorf("backfilltest: server %s does not know the state at %s", s, eventID)
+	}
+	return fclient.RespStateIDs{
+		StateEventIDs: stateIDs,
+		AuthEventIDs:  stateIDs,
+	}, nil
+}
+
+// LookupState returns the state events before the given event, if the server knows them.
+func (f *FederationAPI) LookupState(ctx context.Context, origin, s spec.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion) (gomatrixserverlib.StateResponse, error) {
+	srv, err := f.request(ctx, EndpointState, s, eventID)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stateIDs, ok := srv.StateIDs[eventID]
+	if !ok {
+		return nil, fmt.Errorf("backfilltest: server %s does not know the state at %s", s, eventID)
+	}
+	var stateEvents, authEvents gomatrixserverlib.EventJSONs
+	var front []string
+	for _, id := range stateIDs {
+		if ev, ok := srv.Events[id]; ok {
+			stateEvents = append(stateEvents, ev.JSON())
+			front = append(front, ev.AuthEventIDs()...)
+		}
+	}
+	// The auth chain is every event reachable through the auth events of the state.
+	visited := make(map[string]bool)
+	for len(front) > 0 {
+		id := front[0]
+		front = front[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		if ev, ok := srv.Events[id]; ok {
+			authEvents = append(authEvents, ev.JSON())
+			front = append(front, ev.AuthEventIDs()...)
+		}
+	}
+	return &fclient.RespState{
+		StateEvents: stateEvents,
+		AuthEvents:  authEvents,
+	}, nil
+}
+
+// StateIDsBefore returns the state event IDs before every event in the given room,
+// keyed by event ID. Test rooms are linear, so this is just the state after the
+// previous event.
+func StateIDsBefore(room *test.Room) map[string][]string {
+	result := make(map[string][]string)
+	current := make(map[string]string) // (type, state_key) -> event ID
+	var order []string
+	for _, ev := range room.Events() {
+		stateIDs := make([]string, 0, len(order))
+		for _, key := range order {
+			stateIDs = append(stateIDs, current[key])
+		}
+		result[ev.EventID()] = stateIDs
+		if ev.StateKey() == nil {
+			continue
+		}
+		key := ev.Type() + "\x00" + *ev.StateKey()
+		if _, ok := current[key]; !ok {
+			order = append(order, key)
+		}
+		current[key] = ev.EventID()
+	}
+	return result
+}
@@ -378,8 +378,15 @@ func (r *Inputer) processRoomEvent(
 		return fmt.Errorf("r.DB.GetOrCreateEventStateKeyNID: %w", err)
 	}
 
-	// Store the event.
-	eventNID, stateAtEvent, err := r.DB.StoreEvent(ctx, event, roomInfo, eventTypeNID, eventStateKeyNID, authEventNIDs, isRejected)
+	// Store the event. Unless it's an outlier, also keep track of where the gaps in the room history
+	// are, so that we know where to backfill from.
+	var eventNID types.EventNID
+	var stateAtEvent types.StateAtEvent
+	if input.Kind == api.KindOutlier {
+		eventNID, stateAtEvent, err = r.DB.StoreEvent(ctx, event, roomInfo, eventTypeNID, eventStateKeyNID, authEventNIDs, isRejected)
+	} else {
+		eventNID, stateAtEvent, err = r.DB.StoreEventAndUpdateBackwardExtremities(ctx, event, roomInfo, eventTypeNID, eventStateKeyNID, authEventNIDs, isRejected)
+	}
 	if err != nil {
 		return fmt.Errorf("updater.StoreEvent: %w", err)
 	}
@@ -19,6 +19,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
@@ -35,11 +38,12 @@ import (
 )
 
 type Admin struct {
-	DB      storage.Database
-	Cfg     *config.RoomServer
-	Queryer *query.Queryer
-	Inputer *input.Inputer
-	Leaver  *Leaver
+	DB         storage.Database
+	Cfg        *config.RoomServer
+	Queryer    *query.Queryer
+	Inputer    *input.Inputer
+	Leaver     *Leaver
+	Backfiller *Backfiller
 }
 
 // PerformAdminEvacuateRoom will remove all local users from the given room.
@@ -204,6 +208,11 @@ func (r *Admin) PerformAdminPurgeRoom(
 		return err
 	}
 
+	// Stop any backfills of the room, so that they don't race with the purge.
+	if aborted := r.abortBackfills(roomID); aborted > 0 {
+		logrus.WithField("room_id", roomID).Warnf("Aborted %d backfills before purging room", aborted)
+	}
+
 	logrus.WithField("room_id", roomID).Warn("Purging room from roomserver")
 	if err := r.DB.PurgeRoom(ctx, roomID); err != nil {
 		logrus.WithField("room_id", roomID).WithError(err).Warn("Failed to purge room from roomserver")
@@ -222,6 +231,166 @@ func (r *Admin) PerformAdminPurgeRoom(
 	})
 }
 
+// PerformAdminAbortBackfill aborts all backfills of the given room which are in flight.
+func (r *Admin) PerformAdminAbortBackfill(
+	ctx context.Context,
+	roomID string,
+) (int, error) {
+	// Validate we actually got a room ID and nothing else
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return 0, err
+	}
+
+	aborted := r.abortBackfills(roomID)
+	logrus.WithField("room_id", roomID).Warnf("Aborted %d backfills", aborted)
+	return aborted, nil
+}
+
+// PerformAdminExportBackfill backfills up to limit events of the given room as a dry run and writes them to a new
+// file in the backfill export directory, without persisting anything.
+func (r *Admin) PerformAdminExportBackfill(
+	ctx context.Context,
+	roomID string,
+	limit int,
+) (string, int, error) {
+	// Validate we actually got a room ID and nothing else
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return "", 0, err
+	}
+	if r.Cfg.Backfill.ExportPath == "" {
+		return "", 0, fmt.Errorf("backfill exports are disabled, as room_server.backfill.export_path is not set")
+	}
+	if r.Backfiller == nil {
+		return "", 0, fmt.Errorf("backfill exports are not available")
+	}
+
+	name := fmt.Sprintf("backfill-%s-%d.ndjson", exportFileNameReplacer.Replace(roomID), time.Now().UnixMilli())
+	path := filepath.Join(string(r.Cfg.Backfill.ExportPath), name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create backfill export: %w", err)
+	}
+	exported, err := r.Backfiller.ExportBackfill(ctx, roomID, r.Cfg.Matrix.ServerName, limit, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return "", 0, err
+	}
+	logrus.WithField("room_id", roomID).Infof("Exported %d backfilled events to %s", exported, path)
+	return path, exported, nil
+}
+
+// PerformStateRepair asks the servers in the given room for the state before each of the given events again and
+// replaces the state we stored before them.
+func (r *Admin) PerformStateRepair(
+	ctx context.Context,
+	roomID string,
+	eventIDs []string,
+) ([]string, error) {
+	// Validate we actually got a room ID and nothing else
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return nil, err
+	}
+	if r.Backfiller == nil {
+		return nil, fmt.Errorf("state repair is not available")
+	}
+
+	repaired, err := r.Backfiller.RepairState(ctx, roomID, r.Cfg.Matrix.ServerName, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithField("room_id", roomID).Warnf("Repaired the state before %d events", len(repaired))
+	return repaired, nil
+}
+
+// QueryBackfillServers returns the servers which a backfill of the given room from the given event would ask for
+// history, in the order they would be asked.
+func (r *Admin) QueryBackfillServers(
+	ctx context.Context,
+	roomID, eventID string,
+) ([]spec.ServerName, error) {
+	// Validate we actually got a room ID and nothing else
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return nil, err
+	}
+	if r.Backfiller == nil {
+		return nil, fmt.Errorf("backfill servers are not available")
+	}
+	return r.Backfiller.BackfillServers(ctx, roomID, r.Cfg.Matrix.ServerName, eventID)
+}
+
+// QueryAdminUnredactedBackfill returns up to limit events of the given room before the given events as a backfill
+// would serve them to serverName, or to us if it is empty, but without redacting the events which it isn't allowed
+// to see. Returns the IDs of the events which would have been redacted along with the events.
+func (r *Admin) QueryAdminUnredactedBackfill(
+	ctx context.Context,
+	roomID string,
+	serverName spec.ServerName,
+	fromEventIDs []string,
+	limit int,
+) ([]*types.HeaderedEvent, []string, error) {
+	// Validate we actually got a room ID and nothing else
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return nil, nil, err
+	}
+	if r.Backfiller == nil {
+		return nil, nil, fmt.Errorf("unredacted backfills are not available")
+	}
+	if serverName == "" {
+		serverName = r.Cfg.Matrix.ServerName
+	}
+
+	req := api.PerformBackfillRequest{
+		RoomID:                  roomID,
+		BackwardsExtremities:    map[string][]string{"": fromEventIDs},
+		Limit:                   limit,
+		ServerName:              serverName,
+		VirtualHost:             r.Cfg.Matrix.ServerName,
+		IncludeRedactedEventIDs: true,
+	}
+	var res api.PerformBackfillResponse
+	if err := r.Backfiller.BackfillUnredacted(ctx, &req, &res); err != nil {
+		return nil, nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":     roomID,
+		"server_name": serverName,
+	}).Infof("Returned %d backfilled events without redacting %d of them", len(res.Events), len(res.RedactedEventIDs))
+	return res.Events, res.RedactedEventIDs, nil
+}
+
+// exportFileNameReplacer makes room IDs safe to use in file names.
+var exportFileNameReplacer = strings.NewReplacer("!", "", ":", "_", "/", "_", "\\", "_")
+
+// QueryAdminQuarantinedEvents returns the events of the given room which were quarantined during backfill.
+func (r *Admin) QueryAdminQuarantinedEvents(
+	ctx context.Context,
+	roomID string,
+) ([]types.QuarantinedEvent, error) {
+	// Validate we actually got a room ID and nothing else
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return nil, err
+	}
+	return r.DB.QuarantinedEvents(ctx, roomID)
+}
+
+// QueryAdminQuarantinedEvent returns the given quarantined event, or nil if it isn't quarantined.
+func (r *Admin) QueryAdminQuarantinedEvent(
+	ctx context.Context,
+	eventID string,
+) (*types.QuarantinedEvent, error) {
+	return r.DB.QuarantinedEvent(ctx, eventID)
+}
+
+func (r *Admin) abortBackfills(roomID string) int {
+	if r.Backfiller == nil {
+		return 0
+	}
+	return r.Backfiller.AbortBackfills(roomID)
+}
+
 func (r *Admin) PerformAdminDownloadState(
 	ctx context.Context,
 	roomID, userID string, serverName spec.ServerName,
@@ -16,20 +16,34 @@ package perform
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
 )
 
 // the max number of servers to backfill from per request. If this is too low we may fail to backfill when
@@ -37,6 +51,96 @@ import (
 // as we try dead servers.
 const maxBackfillServers = 5
 
+// the max depth of missing auth events we will fetch when persisting backfilled events, i.e. how many times
+// we will fetch the missing auth events of missing auth events. This stops us from walking an arbitrarily
+// long auth chain over federation.
+const maxAuthEventFetchDepth = 3
+
+// a backfill which returns fewer than this fraction of the requested events while the room still has backward
+// extremities is considered underfilled.
+const underfilledBackfillRatio = 0.5
+
+// errFederationRequestLimit is returned by the backfill requester once it has made as many
+// federation requests as it is allowed to for a single backfill.
+var errFederationRequestLimit = errors.New("backfill federation request limit reached")
+
+var backfillUnderfilled = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_underfilled",
+		Help:      "Number of backfills which returned substantially fewer events than requested while history was still missing",
+	},
+	[]string{"room_id"},
+)
+
+var backfillCrossRoomEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_cross_room_events",
+		Help:      "Number of events dropped during backfill because they were not in the room being backfilled",
+	},
+	[]string{"room_id"},
+)
+
+// Why the state before a backfilled event couldn't be rolled forwards from the state before its prev event, so
+// had to be requested over federation.
+const (
+	stateFallbackNoPrevEvent        = "no_prev_event"
+	stateFallbackMultiplePrevEvents = "multiple_prev_events"
+	stateFallbackMissingState       = "missing_state"
+	stateFallbackCalculationFailed  = "calc_failed"
+)
+
+var backfillStateCalculations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_state_calculations",
+		Help:      "Number of times the state before a backfilled event was rolled forwards locally (fast_path) or requested over federation, by why it was requested",
+	},
+	[]string{"path", "reason"},
+)
+
+var backfillUnknownRooms = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_unknown_rooms",
+		Help:      "Number of backfills requested for rooms we have no info on, by whether a local or remote server requested them",
+	},
+	[]string{"requester"},
+)
+
+func init() {
+	prometheus.MustRegister(backfillUnderfilled, backfillCrossRoomEvents, backfillStateResets, backfillStateCalculations, backfillUnknownRooms)
+}
+
+// VerificationPolicy returns the verifier to use when checking the signatures of events in roomID which were
+// fetched from server. server is empty when events may have come from more than one server. A policy which
+// returns keyRing unchanged keeps the default signature checks.
+type VerificationPolicy func(roomID string, server spec.ServerName, keyRing gomatrixserverlib.JSONVerifier) gomatrixserverlib.JSONVerifier
+
+// ValidityCheckVerifier is a JSONVerifier which replaces the key validity check of every request with
+// ValidityCheck before passing it on to the wrapped verifier. Use gomatrixserverlib.StrictValiditySignatureCheck
+// to only accept keys which were valid when the event was sent, or gomatrixserverlib.NoStrictValidityCheck to
+// accept expired keys, e.g. for old history in rooms where key rotation is expected.
+type ValidityCheckVerifier struct {
+	gomatrixserverlib.JSONVerifier
+	ValidityCheck gomatrixserverlib.SignatureValidityCheckFunc
+}
+
+// VerifyJSONs implements gomatrixserverlib.JSONVerifier
+func (v *ValidityCheckVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	checked := make([]gomatrixserverlib.VerifyJSONRequest, len(requests))
+	for i := range requests {
+		checked[i] = requests[i]
+		checked[i].ValidityCheckingFunc = v.ValidityCheck
+	}
+	return v.JSONVerifier.VerifyJSONs(ctx, checked)
+}
+
 type Backfiller struct {
 	IsLocalServerName func(spec.ServerName) bool
 	DB                storage.Database
@@ -44,8 +148,126 @@ type Backfiller struct {
 	KeyRing           gomatrixserverlib.JSONVerifier
 	Querier           api.QuerySenderIDAPI
 
-	// The servers which should be preferred above other servers when backfilling
+	// The servers which should be preferred above other servers when backfilling, until a reloaded configuration
+	// replaces them with ReloadConfig
 	PreferServers []spec.ServerName
+	// The weights of servers to prefer when backfilling. Servers with a higher weight are tried first, before
+	// any PreferServers without a weight. Servers without a positive weight aren't preferred because of it.
+	PreferServerWeights map[spec.ServerName]int
+	// The maximum number of federation requests a single backfill may make, 0 for no limit
+	MaxFederationRequests int
+	// The maximum number of backfilled events to store at the same time, 0 or 1 to store them one by one
+	PersistConcurrency int
+	// If true, missing events are fetched from the servers which have responded fastest so far during the backfill
+	PreferFastServers bool
+	// If set, decides how the signatures of backfilled events are verified, otherwise KeyRing is used as-is
+	VerificationPolicy VerificationPolicy
+	// How long to return the same response for identical backfills for, so that rapid client retries don't
+	// backfill again, and how many responses to remember. A TTL or size of 0 disables this.
+	ResultCacheTTL  time.Duration
+	ResultCacheSize int
+	// If true, record which of our virtual hosts each backfilled event was persisted for
+	RecordVirtualHost bool
+	// If set, persist backfilled events this many at a time, newest first, recording a checkpoint after each batch
+	CheckpointInterval int
+	// If true, keep missing events which fail auth checks for inspection instead of dropping them
+	QuarantineRejectedEvents bool
+	// If true, remember the auth events sent along with the state before events, trading memory for fewer federation requests
+	RememberAuthEvents bool
+	// The maximum number of federation requests all backfills together may have in flight to any one server, 0 for no limit
+	MaxConcurrentRequestsPerServer int
+	// If true, don't store backfilled events whose state before them would reset critical room state, otherwise only warn
+	RejectStateResets bool
+	// How often the same class of failure involving the same server is logged at most, 0 to log every failure
+	FailureLogInterval time.Duration
+	// If true, backfills of a room try the server which most recently provided history of the room first
+	PreferRecentServers bool
+	// How long a backfill may spend gathering events before returning a partial result, 0 for no limit. It doesn't
+	// cover persisting the gathered events, including fetching the state and auth events they need
+	Timeout time.Duration
+	// If set, the federation requests of backfills which fail are sent again to this server, which fetches on our
+	// behalf
+	RelayServer spec.ServerName
+	// If true, servers whose users have left the room are backfilled from too, if history visibility permits
+	IncludeLeftServers bool
+	// If true, the servers which have been in the room are backfilled from even if history visibility denies us
+	FallbackToMemberServers bool
+	// How many rounds of backfilling from federation a backfill may take to get as many events as were asked for,
+	// each carrying on from where the last one left off. 0 or 1 for a single round
+	MaxRounds int
+	// How long the servers in a room at the point a backfill starts from are reused for by later backfills from
+	// the same point, 0 to work them out every time
+	ServersCacheTTL time.Duration
+	// If true, backfills start from servers which expired from the cache in the last ServersCacheTTL, while
+	// they are worked out again in the background
+	RefreshServersConcurrently bool
+	// The most events, and the most sets of state before events, a backfill keeps in memory to work out the state
+	// before the events next to them, forgetting the least recently used. 0 for no limit
+	MaxRememberedEvents int
+	// If set, the history of rooms is read from here where it can be, such as a read replica of DB, falling back
+	// to DB for anything missing from it. Nothing is ever written to it
+	ReadDB storage.Database
+	// The shortest time between backfills of the same room from federation, 0 for no minimum
+	MinInterval time.Duration
+	// If set, receives every backfilled event once it has been stored, e.g. to mirror it to an external store
+	EventSink EventSink
+
+	// If set, orders the servers to backfill from which would otherwise be in map order, so that tests get the
+	// same servers in the same order given the same inputs. Always nil outside of tests.
+	serverOrder func(servers []spec.ServerName)
+
+	resultCacheOnce sync.Once
+	resultCache     *backfillResultCache
+	aborts          backfillAborts
+	limiterOnce     sync.Once
+	limiter         *serverLimiter
+	warm            backfillWarmState
+	failureLogOnce  sync.Once
+	failureLog      *failureLog
+	recent          recentServers
+	serversOnce     sync.Once
+	serversCache    *roomServersCache
+	intervals       backfillIntervals
+	// replaces PreferServers once the configuration has been reloaded
+	preferServersOverride atomic.Pointer[[]spec.ServerName]
+}
+
+// cachedResults returns the backfill result cache, or nil if result caching is disabled.
+func (r *Backfiller) cachedResults() *backfillResultCache {
+	r.resultCacheOnce.Do(func() {
+		if r.ResultCacheTTL > 0 && r.ResultCacheSize > 0 {
+			r.resultCache = newBackfillResultCache(r.ResultCacheTTL, r.ResultCacheSize)
+		}
+	})
+	return r.resultCache
+}
+
+// serverLimiter returns the limiter shared by all backfills, or nil if requests to each server aren't limited.
+func (r *Backfiller) serverLimiter() *serverLimiter {
+	r.limiterOnce.Do(func() {
+		if r.MaxConcurrentRequestsPerServer > 0 {
+			r.limiter = newServerLimiter(r.MaxConcurrentRequestsPerServer)
+		}
+	})
+	return r.limiter
+}
+
+// failures returns the failure log shared by all backfills, or nil if every failure is logged.
+func (r *Backfiller) failures() *failureLog {
+	r.failureLogOnce.Do(func() {
+		if r.FailureLogInterval > 0 {
+			r.failureLog = newFailureLog(r.FailureLogInterval)
+		}
+	})
+	return r.failureLog
+}
+
+// verifierFor returns the verifier to use for events in the given room fetched from the given server.
+func (r *Backfiller) verifierFor(roomID string, server spec.ServerName) gomatrixserverlib.JSONVerifier {
+	if r.VerificationPolicy == nil {
+		return r.KeyRing
+	}
+	return r.VerificationPolicy(roomID, server, r.KeyRing)
 }
 
 // PerformBackfill implements api.RoomServerQueryAPI
@@ -54,14 +276,65 @@ func (r *Backfiller) PerformBackfill(
 	request *api.PerformBackfillRequest,
 	response *api.PerformBackfillResponse,
 ) error {
+	return r.performBackfill(ctx, request, response, false)
+}
+
+// BackfillUnredacted serves the backfill from the database in the same way that PerformBackfill serves it to
+// request.ServerName, except that the events which that server isn't allowed to see aren't redacted, so that admin
+// tooling can inspect their original content. RedactedEventIDs still lists the events which would have been redacted.
+// It never backfills from federation. This must never be reachable by other servers, so it is only part of the API
+// for the admin endpoints and not of the one which the federation API uses.
+func (r *Backfiller) BackfillUnredacted(
+	ctx context.Context,
+	request *api.PerformBackfillRequest,
+	response *api.PerformBackfillResponse,
+) error {
+	if request.DryRun || request.StateOnly {
+		return fmt.Errorf("BackfillUnredacted: only serves events from the database")
+	}
+	return r.performBackfill(ctx, request, response, true)
+}
+
+func (r *Backfiller) performBackfill(
+	ctx context.Context,
+	request *api.PerformBackfillRequest,
+	response *api.PerformBackfillResponse,
+	skipRedaction bool,
+) (err error) {
+	trace, ctx := internal.StartRegion(ctx, "Backfiller.PerformBackfill")
+	defer trace.EndRegion()
+	trace.SetTag("room_id", request.RoomID)
+	trace.SetTag("server_name", string(request.ServerName))
+	trace.SetTag("limit", request.Limit)
+
+	ctx, done := r.aborts.track(ctx, request.RoomID)
+	defer func() { err = done(err) }()
+
+	// The timeout only bounds gathering events, which is every /backfill request and the requests to work out the
+	// state before the events. Whatever was gathered is persisted in full with persistCtx, so that the deadline
+	// firing never leaves events stored without the state before them. That includes fetching the state and auth
+	// events they need which weren't gathered, which only the caller's context, AbortBackfills and
+	// MaxFederationRequests bound.
+	persistCtx := ctx
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	if request.DryRun && (request.StateOnly || !r.IsLocalServerName(request.ServerName)) {
+		return fmt.Errorf("PerformBackfill: only backfills from federation can be dry runs")
+	}
+	if request.StateOnly {
+		return r.backfillMissingState(ctx, request, response)
+	}
 	// if we are requesting the backfill then we need to do a federation hit
 	// TODO: we could be more sensible and fetch as many events we already have then request the rest
 	//       which is what the syncapi does already.
-	if r.IsLocalServerName(request.ServerName) {
-		return r.backfillViaFederation(ctx, request, response)
+	if r.IsLocalServerName(request.ServerName) && !skipRedaction {
+		return r.backfillViaFederation(ctx, persistCtx, request, response)
 	}
 	// someone else is requesting the backfill, try to service their request.
-	var err error
 	var front []string
 
 	// The limit defines the maximum number of events to retrieve, so it also
@@ -76,7 +349,19 @@ func (r *Backfiller) PerformBackfill(
 		return err
 	}
 	if info == nil || info.IsStub() {
-		return fmt.Errorf("PerformBackfill: missing room info for room %s", request.RoomID)
+		return r.unknownRoom(request)
+	}
+
+	// If we have no history to serve then scanning the event tree is wasted work, and we mustn't
+	// go on to backfill from federation on behalf of the requesting server either.
+	if reason, err := r.noHistoryToServe(ctx, info, front); err != nil {
+		return err
+	} else if reason != "" {
+		logrus.WithFields(logrus.Fields{
+			"room_id":     request.RoomID,
+			"server_name": request.ServerName,
+		}).Infof("PerformBackfill: not serving backfill, %s", reason)
+		return nil
 	}
 
 	// Scan the event tree for events to send back.
@@ -90,134 +375,973 @@ func (r *Backfiller) PerformBackfill(
 	var loadedEvents []gomatrixserverlib.PDU
 	loadedEvents, err = helpers.LoadEvents(ctx, r.DB, info, resultNIDs)
 	if err != nil {
-		if _, ok := err.(types.MissingEventError); ok {
-			return r.backfillViaFederation(ctx, request, response)
+		if _, ok := err.(types.MissingEventError); ok && !skipRedaction {
+			return r.backfillViaFederation(ctx, persistCtx, request, response)
 		}
 		return err
 	}
 
+	if skipRedaction && len(redactEventIDs) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"room_id":     request.RoomID,
+			"server_name": request.ServerName,
+		}).Infof("PerformBackfill: returning %d events without redacting them", len(redactEventIDs))
+	}
 	for _, event := range loadedEvents {
 		if _, ok := redactEventIDs[event.EventID()]; ok {
-			event.Redact()
+			if !skipRedaction {
+				// The loaded events may be the ones in the event cache, so redact a copy rather than
+				// hiding the content from everything else which loads the event, including BackfillUnredacted.
+				if event, err = redactedCopy(event); err != nil {
+					return err
+				}
+			}
+			if request.IncludeRedactedEventIDs {
+				response.RedactedEventIDs = append(response.RedactedEventIDs, event.EventID())
+			}
 		}
 		response.Events = append(response.Events, &types.HeaderedEvent{PDU: event})
 	}
+	if request.IncludeEventSources {
+		response.EventSources = eventSources(api.BackfillEventSourceDatabase, len(response.Events))
+	}
 
 	return err
 }
 
-func (r *Backfiller) backfillViaFederation(ctx context.Context, req *api.PerformBackfillRequest, res *api.PerformBackfillResponse) error {
+// redactedCopy returns a redacted copy of the event, leaving the event itself as it is.
+func redactedCopy(event gomatrixserverlib.PDU) (gomatrixserverlib.PDU, error) {
+	verImpl, err := gomatrixserverlib.GetRoomVersion(event.Version())
+	if err != nil {
+		return nil, err
+	}
+	redacted, err := verImpl.NewEventFromTrustedJSONWithEventID(event.EventID(), event.JSON(), false)
+	if err != nil {
+		return nil, fmt.Errorf("redactedCopy: failed to copy event %s: %w", event.EventID(), err)
+	}
+	redacted.Redact()
+	return redacted, nil
+}
+
+// eventSources returns the sources of n events which all came from the same place.
+func eventSources(source api.BackfillEventSource, n int) []api.BackfillEventSource {
+	sources := make([]api.BackfillEventSource, n)
+	for i := range sources {
+		sources[i] = source
+	}
+	return sources
+}
+
+// noHistoryToServe returns why we have no history of the room to serve from the given events, or an empty
+// string if we may have some. We have none if no local user ever had a membership in the room, or if we
+// don't have any of the events to backfill from.
+func (r *Backfiller) noHistoryToServe(ctx context.Context, info *types.RoomInfo, eventIDs []string) (string, error) {
+	memberships, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, false, true)
+	if err != nil {
+		return "", fmt.Errorf("noHistoryToServe: failed to get local memberships: %w", err)
+	}
+	if len(memberships) == 0 {
+		return "we were never in the room", nil
+	}
+	existing, err := r.DB.ExistingEventIDs(ctx, eventIDs)
+	if err != nil {
+		return "", fmt.Errorf("noHistoryToServe: failed to check which events we have: %w", err)
+	}
+	if len(existing) == 0 {
+		return "we don't have any of the events to backfill from", nil
+	}
+	return "", nil
+}
+
+func (r *Backfiller) backfillViaFederation(ctx, persistCtx context.Context, req *api.PerformBackfillRequest, res *api.PerformBackfillResponse) (err error) {
+	trace, ctx := internal.StartRegion(ctx, "Backfiller.backfillViaFederation")
+	defer trace.EndRegion()
+	trace.SetTag("room_id", req.RoomID)
+	trace.SetTag("virtual_host", string(req.VirtualHost))
+
+	if req.ResumeFrom != "" {
+		var err error
+		if req, err = r.resumeRequest(ctx, req); err != nil {
+			return err
+		}
+	}
+	if req.TargetGap != nil {
+		var err error
+		if req, err = gapRequest(req); err != nil {
+			return err
+		}
+	}
+
+	// A client retrying straight away gets the events we already backfilled for it, which have been persisted already.
+	// Dry runs don't persist anything, so they can't be answered from or added to the cache.
+	cache := r.cachedResults()
+	if req.DryRun {
+		cache = nil
+	}
+	var cacheKey string
+	if cache != nil {
+		cacheKey = backfillResultCacheKey(req)
+		if cached, ok := cache.get(cacheKey); ok {
+			*res = *cached
+			res.EventSources = nil
+			if req.IncludeEventSources {
+				res.EventSources = eventSources(api.BackfillEventSourceCache, len(res.Events))
+			}
+			return nil
+		}
+	}
 	info, err := r.DB.RoomInfo(ctx, req.RoomID)
 	if err != nil {
 		return err
 	}
 	if info == nil || info.IsStub() {
-		return fmt.Errorf("backfillViaFederation: missing room info for room %s", req.RoomID)
+		return r.unknownRoom(req)
+	}
+	// History visibility is evaluated from the point of view of the virtual host, so it must be one of ours.
+	if !r.IsLocalServerName(req.VirtualHost) {
+		return fmt.Errorf("backfillViaFederation: virtual host %q is not a local server name", req.VirtualHost)
+	}
+	// None of the events could be loaded, so don't ask every server in the room for them.
+	if _, err = gomatrixserverlib.GetRoomVersion(info.RoomVersion); err != nil {
+		return api.ErrUnsupportedRoomVersion{RoomID: req.RoomID, RoomVersion: info.RoomVersion}
+	}
+	// Only backfills which could go over federation count towards the interval, and failed ones don't count at all.
+	// Dry runs, such as exports, don't persist anything, so they never hold up a backfill which does.
+	if !req.DryRun {
+		release, retryAfter, ok := r.intervals.claim(req.RoomID, r.MinInterval)
+		if !ok {
+			return api.ErrBackfillTooSoon{RoomID: req.RoomID, RetryAfter: retryAfter}
+		}
+		defer func() {
+			if err != nil {
+				release()
+			}
+		}()
+	}
+	requester := r.newRequester(req.RoomID, req.VirtualHost, req.BackwardsExtremities, info.RoomVersion)
+	requester.serverHints = req.ServerHints
+	if !req.DryRun {
+		// Warmed state is consumed when used, so leave it for the backfill which persists events.
+		r.warm.seed(requester)
 	}
-	requester := newBackfillRequester(r.DB, r.FSAPI, r.Querier, req.VirtualHost, r.IsLocalServerName, req.BackwardsExtremities, r.PreferServers, info.RoomVersion)
 	// Request 100 items regardless of what the query asks for.
 	// We don't want to go much higher than this.
 	// We can't honour exactly the limit as some sytests rely on requesting more for tests to pass
 	// (so we don't need to hit /state_ids which the test has no listener for)
 	// Specifically the test "Outbound federation can backfill events"
-	events, err := gomatrixserverlib.RequestBackfill(
-		ctx, req.VirtualHost, requester,
-		r.KeyRing, req.RoomID, info.RoomVersion, req.PrevEventIDs(), 100, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
-			return r.Querier.QueryUserIDForSender(ctx, roomID, senderID)
-		},
-	)
-	// Only return an error if we really couldn't get any events.
-	if err != nil && len(events) == 0 {
-		logrus.WithError(err).Errorf("gomatrixserverlib.RequestBackfill failed")
-		return err
+	limit := 100
+	if req.TargetGap != nil {
+		// Filling a gap is precise, so only fetch as many events as were asked for.
+		if req.Limit > 0 {
+			limit = req.Limit
+		}
+		requester.gap = req.TargetGap
+		if requester.haveEventIDs, _, _, err = r.DB.LatestEventIDs(ctx, info.RoomNID); err != nil {
+			return fmt.Errorf("backfillViaFederation: failed to get latest events: %w", err)
+		}
+	}
+	// Each round backfills from where the previous one left off, until we have as many events as were asked for.
+	var events []gomatrixserverlib.PDU
+	seen := make(map[string]bool)
+	roundReq := req
+	rounds := 0
+	for rounds < r.maxRounds(req) {
+		rounds++
+		var roundEvents []gomatrixserverlib.PDU
+		roundEvents, err = gomatrixserverlib.RequestBackfill(
+			ctx, req.VirtualHost, requester,
+			r.verifierFor(req.RoomID, ""), req.RoomID, info.RoomVersion, roundReq.PrevEventIDs(), limit, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+				return r.Querier.QueryUserIDForSender(ctx, roomID, senderID)
+			},
+		)
+		// If we ran out of time, return whatever we have gathered so far, even if that is nothing.
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			res.Partial = true
+			cache = nil
+			logrus.WithFields(logrus.Fields{
+				"room_id": req.RoomID,
+				"timeout": r.Timeout,
+			}).Warnf("Backfill timed out, returning %d events", len(events)+len(roundEvents))
+			if len(events)+len(roundEvents) == 0 {
+				return nil
+			}
+		}
+		if unsupported := (gomatrixserverlib.UnsupportedRoomVersionError{}); errors.As(err, &unsupported) {
+			// Don't persist anything, as we can't tell whether any of the events are valid.
+			return api.ErrUnsupportedRoomVersion{RoomID: req.RoomID, RoomVersion: unsupported.Version}
+		}
+		// Only return an error if we really couldn't get any events.
+		if err != nil && len(roundEvents) == 0 && !res.Partial {
+			if len(events) > 0 {
+				break
+			}
+			logger := logrus.WithField("room_id", req.RoomID).WithField("server", requester.lastBackfillServer)
+			if logger, ok := r.failures().entry(logger, requester.lastBackfillServer, failureRequestBackfill); ok {
+				logger.WithError(err).Errorf("gomatrixserverlib.RequestBackfill failed")
+			}
+			return err
+		}
+		// If we got an error but still got events, that's fine, because a server might have returned a 404 (or something)
+		// but other servers could provide the missing event.
+		roundEvents = eventsInRoom(persistCtx, req.RoomID, roundEvents)
+		roundEvents = eventsInRoomVersion(persistCtx, info.RoomVersion, roundEvents)
+		roundEvents = r.eventsAfterPurgeHorizon(persistCtx, req.RoomID, roundEvents)
+		newEvents := roundEvents[:0]
+		for _, ev := range roundEvents {
+			if !seen[ev.EventID()] {
+				seen[ev.EventID()] = true
+				newEvents = append(newEvents, ev)
+			}
+		}
+		if err = r.persistBackfillRound(persistCtx, roundReq, res, info, requester, newEvents); err != nil {
+			return err
+		}
+		requester.unpinEvents()
+		events = append(events, newEvents...)
+		if res.Partial || len(newEvents) == 0 || len(events) >= req.Limit {
+			break
+		}
+		// The next round carries on from the prev_events of this round's events which we still don't have. They
+		// have been persisted, so the servers in the room at them can be worked out.
+		nextBwExtrems, nextErr := r.nextBackwardExtremities(persistCtx, newEvents)
+		if nextErr != nil {
+			logrus.WithError(nextErr).WithField("room_id", req.RoomID).Error("backfillViaFederation: failed to work out where to backfill from next")
+			break
+		}
+		if len(nextBwExtrems) == 0 {
+			break
+		}
+		nextReq := *req
+		nextReq.BackwardsExtremities = nextBwExtrems
+		roundReq = &nextReq
+		requester.bwExtrems = nextBwExtrems
+	}
+	ctx = persistCtx
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"room_id":             req.RoomID,
+		"federation_requests": requester.federationRequests,
+		"rounds":              rounds,
+		"forgotten_events":    requester.eventIDMap.evicted,
+	}).Infof("backfilled %d events", len(events))
+	trace.SetTag("backfilled_events", len(events))
+	trace.SetTag("federation_requests", requester.federationRequests)
+	if r.PreferRecentServers && len(events) > 0 && requester.backfilledFrom != "" {
+		r.recent.remember(req.RoomID, requester.backfilledFrom)
+	}
+
+	res.Events = make([]*types.HeaderedEvent, len(events))
+	for i := range events {
+		res.Events[i] = &types.HeaderedEvent{PDU: events[i]}
+	}
+	for _, ev := range events {
+		if isRoomStart(ev) {
+			res.ReachedRoomStart = true
+		}
+	}
+	res.HistoryVisibility = requester.historyVisiblity
+	if req.IncludeEventSources {
+		res.EventSources = eventSources(api.BackfillEventSourceFederation, len(res.Events))
+	}
+	if !req.DryRun {
+		r.checkUnderfilled(ctx, req, res, info.RoomNID, len(requester.serverLatencies))
+	}
+	if cache != nil {
+		cache.put(cacheKey, res)
+	}
+	return nil
+}
+
+// newRequester returns a requester for backfilling the room from the given backward extremities, configured in the
+// same way for every backfill.
+func (r *Backfiller) newRequester(
+	roomID string, virtualHost spec.ServerName, bwExtrems map[string][]string, roomVersion gomatrixserverlib.RoomVersion,
+) *backfillRequester {
+	requester := newBackfillRequester(r.readDB(), r.federation(), r.Querier, virtualHost, r.IsLocalServerName, bwExtrems, r.preferServers(), roomVersion, r.MaxFederationRequests)
+	requester.preferFastServers = r.PreferFastServers
+	requester.rememberAuthEvents = r.RememberAuthEvents
+	requester.preferServerWeights = r.PreferServerWeights
+	requester.limiter = r.serverLimiter()
+	requester.serverOrder = r.serverOrder
+	requester.roomID = roomID
+	requester.includeLeftServers = r.IncludeLeftServers
+	requester.fallbackToMemberServers = r.FallbackToMemberServers
+	requester.serversCache = r.roomServers()
+	requester.refreshServersConcurrently = r.RefreshServersConcurrently
+	requester.limitEvents(r.MaxRememberedEvents)
+	if r.PreferRecentServers {
+		requester.recentServer = r.recent.get(roomID)
+	}
+	return requester
+}
+
+// ReloadConfig applies a reloaded configuration to backfills, which prefer the key perspective servers of cfg from
+// the next backfill on. It is safe to call at the same time as backfills, and backfills already in flight carry on
+// with the servers they started with. cfg isn't read again afterwards, so it may be replaced by a later reload.
+func (r *Backfiller) ReloadConfig(cfg *config.Dendrite) {
+	servers := cfg.FederationAPI.KeyPerspectives.ServerNames()
+	r.preferServersOverride.Store(&servers)
+}
+
+// preferServers returns the servers which a backfill starting now should prefer.
+func (r *Backfiller) preferServers() []spec.ServerName {
+	if servers := r.preferServersOverride.Load(); servers != nil {
+		return *servers
+	}
+	return r.PreferServers
+}
+
+// unknownRoom records that the room to backfill is one we have no info on, and returns the error for it.
+func (r *Backfiller) unknownRoom(req *api.PerformBackfillRequest) error {
+	requester := "remote"
+	if r.IsLocalServerName(req.ServerName) {
+		requester = "local"
+	}
+	backfillUnknownRooms.WithLabelValues(requester).Inc()
+	logrus.WithFields(logrus.Fields{
+		"room_id":     req.RoomID,
+		"server_name": req.ServerName,
+	}).Debug("PerformBackfill: no room info for room")
+	return api.ErrUnknownRoom{RoomID: req.RoomID}
+}
+
+// BackfillServers returns the servers which a backfill of the room from the given event would ask for history, in
+// the order they would be asked, without backfilling anything. The event is either a backward extremity of the room
+// or one of the events missing before one.
+func (r *Backfiller) BackfillServers(ctx context.Context, roomID string, virtualHost spec.ServerName, eventID string) ([]spec.ServerName, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.IsStub() {
+		return nil, fmt.Errorf("BackfillServers: missing room info for room %s", roomID)
+	}
+	bwExtrems, err := r.DB.BackwardExtremitiesForRoom(ctx, info.RoomNID)
+	if err != nil {
+		return nil, fmt.Errorf("BackfillServers: failed to get backward extremities: %w", err)
+	}
+	missingID := ""
+	if prevEventIDs := bwExtrems[eventID]; len(prevEventIDs) > 0 {
+		missingID = prevEventIDs[0]
+	} else {
+		for _, prevEventIDs := range bwExtrems {
+			for _, prevEventID := range prevEventIDs {
+				if prevEventID == eventID {
+					missingID = eventID
+				}
+			}
+		}
+	}
+	if missingID == "" {
+		return nil, fmt.Errorf("BackfillServers: event %s is not a backward extremity of room %s or missing before one", eventID, roomID)
+	}
+	requester := r.newRequester(roomID, virtualHost, bwExtrems, info.RoomVersion)
+	servers := requester.ServersAtEvent(ctx, roomID, missingID)
+	if servers == nil {
+		servers = []spec.ServerName{}
+	}
+	return servers, nil
+}
+
+// maxRounds returns how many rounds of backfilling from federation the request may take.
+func (r *Backfiller) maxRounds(req *api.PerformBackfillRequest) int {
+	// Later rounds need the events of the earlier rounds to have been persisted, and a gap is filled in one go.
+	if r.MaxRounds <= 1 || req.DryRun || req.TargetGap != nil {
+		return 1
+	}
+	return r.MaxRounds
+}
+
+// persistBackfillRound persists the events of a round of backfilling from federation, or records the state before
+// them in the response for dry runs. If checkpointing is enabled, the checkpoint is updated as the events are
+// persisted.
+func (r *Backfiller) persistBackfillRound(
+	ctx context.Context, req *api.PerformBackfillRequest, res *api.PerformBackfillResponse, info *types.RoomInfo,
+	requester *backfillRequester, events []gomatrixserverlib.PDU,
+) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if req.DryRun {
+		res.BeforeStateIDs = make(map[string][]string, len(events))
+		for _, ev := range events {
+			res.BeforeStateIDs[ev.EventID()], _ = requester.eventIDToBeforeStateIDs.get(ev.EventID())
+		}
+		return nil
+	}
+	if r.CheckpointInterval <= 0 {
+		return r.persistBackfilledEvents(ctx, req, info, requester, events, nil)
+	}
+	// Persist the newest events first, so that the events persisted so far always carry on from where we
+	// started, and record the oldest of them after each batch so that an interrupted backfill can resume.
+	batch := make(map[string]gomatrixserverlib.PDU, len(events))
+	for _, ev := range events {
+		batch[ev.EventID()] = ev
+	}
+	for end := len(events); end > 0; end -= r.CheckpointInterval {
+		start := end - r.CheckpointInterval
+		if start < 0 {
+			start = 0
+		}
+		if err := r.persistBackfilledEvents(ctx, req, info, requester, events[start:end], batch); err != nil {
+			return err
+		}
+		res.Checkpoint = events[start].EventID()
+		if err := r.DB.SetBackfillCheckpoint(ctx, info.RoomNID, res.Checkpoint); err != nil {
+			logrus.WithError(err).WithField("room_id", req.RoomID).Error("backfillViaFederation: failed to record checkpoint")
+		}
+	}
+	return nil
+}
+
+// nextBackwardExtremities returns the backward extremities among the given events, as a map of event ID to the
+// prev_event IDs which we don't have.
+func (r *Backfiller) nextBackwardExtremities(ctx context.Context, events []gomatrixserverlib.PDU) (map[string][]string, error) {
+	inEvents := make(map[string]bool, len(events))
+	for _, ev := range events {
+		inEvents[ev.EventID()] = true
+	}
+	var prevEventIDs []string
+	for _, ev := range events {
+		for _, prevEventID := range ev.PrevEventIDs() {
+			if !inEvents[prevEventID] {
+				prevEventIDs = append(prevEventIDs, prevEventID)
+			}
+		}
+	}
+	if len(prevEventIDs) == 0 {
+		return nil, nil
+	}
+	existing, err := r.DB.ExistingEventIDs(ctx, prevEventIDs)
+	if err != nil {
+		return nil, err
+	}
+	bwExtrems := make(map[string][]string)
+	for _, ev := range events {
+		for _, prevEventID := range ev.PrevEventIDs() {
+			if !inEvents[prevEventID] && !existing[prevEventID] {
+				bwExtrems[ev.EventID()] = append(bwExtrems[ev.EventID()], prevEventID)
+			}
+		}
+	}
+	return bwExtrems, nil
+}
+
+// persistBackfilledEvents persists the given backfilled events along with the state before them, and updates the
+// backward extremities of the room. If the state before an event includes events which we don't have, they are
+// taken from batch if possible, otherwise they are fetched from other servers.
+func (r *Backfiller) persistBackfilledEvents(
+	ctx context.Context, req *api.PerformBackfillRequest, info *types.RoomInfo, requester *backfillRequester,
+	events []gomatrixserverlib.PDU, batch map[string]gomatrixserverlib.PDU,
+) error {
+	var err error
+	// Check for state resets before storing anything, so that an event whose state is refused is never stored.
+	if kept := r.withoutStateResets(ctx, req, info, requester, events, batch); len(kept) < len(events) {
+		// The kept events are replaced with the versions which were stored, which the caller returns.
+		defer func(events []gomatrixserverlib.PDU) {
+			stored := make(map[string]gomatrixserverlib.PDU, len(kept))
+			for _, ev := range kept {
+				stored[ev.EventID()] = ev
+			}
+			for i, ev := range events {
+				if storedEv, ok := stored[ev.EventID()]; ok {
+					events[i] = storedEv
+				}
+			}
+		}(events)
+		events = kept
 	}
-	// If we got an error but still got events, that's fine, because a server might have returned a 404 (or something)
-	// but other servers could provide the missing event.
-	logrus.WithError(err).WithField("room_id", req.RoomID).Infof("backfilled %d events", len(events))
 
 	// persist these new events - auth checks have already been done
-	roomNID, backfilledEventMap := persistEvents(ctx, r.DB, r.Querier, events)
+	roomNID, backfilledEventMap := persistEvents(ctx, r.DB, r.Querier, events, r.missingAuthEventsFetcher(ctx, info.RoomVersion, requester, req.VirtualHost), r.PersistConcurrency)
+	r.recordVirtualHost(ctx, req.VirtualHost, backfilledEventMap)
 
-	for _, ev := range backfilledEventMap {
+	// A run of events, such as messages, often has the same state before each of them, so an event reuses the state
+	// snapshot of an earlier one with the same state rather than adding it again.
+	snapshots := make(map[string]backfilledSnapshot)
+	for _, ev := range topologicallyOrdered(events, backfilledEventMap) {
 		// now add state for these events
-		stateIDs, ok := requester.eventIDToBeforeStateIDs[ev.EventID()]
+		stateIDs, ok := requester.eventIDToBeforeStateIDs.get(ev.EventID())
 		if !ok {
 			// this should be impossible as all events returned must have pass Step 5 of the PDU checks
 			// which requires a list of state IDs.
 			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("backfillViaFederation: failed to find state IDs for event which passed auth checks")
 			continue
 		}
-		var entries []types.StateEntry
-		if entries, err = r.DB.StateEntriesForEventIDs(ctx, stateIDs, true); err != nil {
-			// attempt to fetch the missing events
-			r.fetchAndStoreMissingEvents(ctx, info.RoomVersion, requester, stateIDs, req.VirtualHost)
-			// try again
-			entries, err = r.DB.StateEntriesForEventIDs(ctx, stateIDs, true)
-			if err != nil {
-				logrus.WithError(err).WithField("event_id", ev.EventID()).Error("backfillViaFederation: failed to get state entries for event")
-				return err
+		key := stateIDsKey(stateIDs)
+		snapshot, reuse := snapshots[key]
+		entries := snapshot.entries
+		if !reuse {
+			if entries, err = r.DB.StateEntriesForEventIDs(ctx, stateIDs, true); err != nil {
+				// attempt to fetch the missing events, which may be in a batch of backfilled events we haven't persisted yet
+				r.persistFromBatch(ctx, info.RoomVersion, requester, stateIDs, batch, req.VirtualHost)
+				r.fetchAndStoreMissingEvents(ctx, info.RoomVersion, requester, stateIDs, req.VirtualHost)
+				// try again
+				entries, err = r.DB.StateEntriesForEventIDs(ctx, stateIDs, true)
+				if err != nil {
+					logrus.WithError(err).WithField("event_id", ev.EventID()).Error("backfillViaFederation: failed to get state entries for event")
+					return err
+				}
 			}
 		}
 
-		var beforeStateSnapshotNID types.StateSnapshotNID
-		if beforeStateSnapshotNID, err = r.DB.AddState(ctx, roomNID, nil, entries); err != nil {
-			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("backfillViaFederation: failed to persist state entries to get snapshot nid")
+		if reuse {
+			if err = r.DB.SetState(ctx, ev.EventNID, snapshot.nid); err != nil {
+				logrus.WithError(err).WithField("event_id", ev.EventID()).Error("backfillViaFederation: failed to set state snapshot for event")
+				return err
+			}
+			continue
+		}
+		// add the state and point the event at it atomically, so that a failure doesn't orphan the snapshot
+		if snapshot.nid, err = r.DB.AddAndSetState(ctx, roomNID, ev.EventNID, nil, entries); err != nil {
+			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("backfillViaFederation: failed to persist state snapshot for event")
 			return err
 		}
-		if err = r.DB.SetState(ctx, ev.EventNID, beforeStateSnapshotNID); err != nil {
-			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("backfillViaFederation: failed to persist snapshot nid")
+		snapshot.entries = entries
+		snapshots[key] = snapshot
+	}
+
+	r.applyRedactions(ctx, info, events, backfilledEventMap)
+	// only export the events once the redactions have been applied, so that the sink never sees redacted content
+	r.exportToSink(ctx, events, backfilledEventMap)
+
+	// The events we've backfilled are no longer missing, but they may now be backwards extremities themselves.
+	persisted := make([]gomatrixserverlib.PDU, 0, len(backfilledEventMap))
+	for _, ev := range backfilledEventMap {
+		persisted = append(persisted, ev.PDU)
+	}
+	if err = r.DB.UpdateBackwardExtremities(ctx, info.RoomNID, persisted); err != nil {
+		logrus.WithError(err).WithField("room_id", req.RoomID).Error("backfillViaFederation: failed to update backward extremities")
+	}
+
+	return nil
+}
+
+// withoutStateResets checks the state before each of the events for state resets, returning the events without
+// those whose state would reset critical room state if RejectStateResets is set. Otherwise the resets are only
+// logged and counted, and all of the events are returned.
+func (r *Backfiller) withoutStateResets(
+	ctx context.Context, req *api.PerformBackfillRequest, info *types.RoomInfo, requester *backfillRequester,
+	events []gomatrixserverlib.PDU, batch map[string]gomatrixserverlib.PDU,
+) []gomatrixserverlib.PDU {
+	resets, err := r.newStateResetChecker(ctx, info, req.RoomID, func(eventID string) (gomatrixserverlib.PDU, bool) {
+		if ev, ok := batch[eventID]; ok {
+			return ev, true
 		}
+		return requester.eventIDMap.get(eventID)
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", req.RoomID).Warn("backfillViaFederation: unable to check for state resets")
+		return events
+	}
+	for _, ev := range events {
+		resets.learn(ev)
 	}
+	kept := make([]gomatrixserverlib.PDU, 0, len(events))
+	for _, ev := range events {
+		stateIDs, ok := requester.eventIDToBeforeStateIDs.get(ev.EventID())
+		if !ok {
+			kept = append(kept, ev)
+			continue
+		}
+		if reset, checkErr := resets.check(ctx, ev, stateIDs); checkErr != nil {
+			logrus.WithError(checkErr).WithField("event_id", ev.EventID()).Warn("backfillViaFederation: failed to check for a state reset")
+		} else if reset != "" && r.RejectStateResets {
+			continue
+		}
+		kept = append(kept, ev)
+	}
+	return kept
+}
 
-	// TODO: update backwards extremities, as that should be moved from syncapi to roomserver at some point.
+// backfilledSnapshot is a state snapshot added for a backfilled event, along with the state entries in it.
+type backfilledSnapshot struct {
+	nid     types.StateSnapshotNID
+	entries []types.StateEntry
+}
 
-	res.Events = make([]*types.HeaderedEvent, len(events))
-	for i := range events {
-		res.Events[i] = &types.HeaderedEvent{PDU: events[i]}
+// stateIDsKey returns a key which is the same for any order of the same state event IDs.
+func stateIDsKey(stateIDs []string) string {
+	sorted := append([]string(nil), stateIDs...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// topologicallyOrdered returns the persisted events, oldest first. Events are taken from persisted, which holds the
+// events as they were stored.
+func topologicallyOrdered(events []gomatrixserverlib.PDU, persisted map[string]types.Event) []types.Event {
+	pdus := make([]gomatrixserverlib.PDU, 0, len(persisted))
+	for _, ev := range events {
+		if _, ok := persisted[ev.EventID()]; ok {
+			pdus = append(pdus, ev)
+		}
 	}
-	res.HistoryVisibility = requester.historyVisiblity
+	pdus = gomatrixserverlib.ReverseTopologicalOrdering(pdus, gomatrixserverlib.TopologicalOrderByPrevEvents)
+	ordered := make([]types.Event, 0, len(persisted))
+	seen := make(map[string]bool, len(persisted))
+	for _, ev := range pdus {
+		if !seen[ev.EventID()] {
+			seen[ev.EventID()] = true
+			ordered = append(ordered, persisted[ev.EventID()])
+		}
+	}
+	// The ordering leaves out events which it can't order, which valid events never are, so keep them anyway.
+	for id, ev := range persisted {
+		if !seen[id] {
+			ordered = append(ordered, ev)
+		}
+	}
+	return ordered
+}
+
+// applyRedactions applies the backfilled redactions now that the state before them has been stored, which checking
+// whether they are allowed needs. Redactions stored without state, such as those fetched as missing state or auth
+// events, are checked against the power levels in their auth events instead. Backfilled events which they redact are
+// replaced with their redacted versions, both in events and in backfilledEventMap, so that the events we return
+// reflect the redactions.
+func (r *Backfiller) applyRedactions(ctx context.Context, info *types.RoomInfo, events []gomatrixserverlib.PDU, backfilledEventMap map[string]types.Event) {
+	resolver := &redactionPowerLevelResolver{
+		state: state.NewStateResolution(r.DB, info, r.Querier),
+		db:    r.DB,
+		info:  info,
+	}
+	var redacted bool
+	for _, ev := range backfilledEventMap {
+		if !isRedaction(ev.PDU) {
+			continue
+		}
+		_, redactedEvent, err := r.DB.MaybeRedactEvent(ctx, info, ev.EventNID, ev.PDU, resolver, r.Querier)
+		if err != nil {
+			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to redact event")
+			continue
+		}
+		if redactedEvent == nil {
+			continue
+		}
+		if target, ok := backfilledEventMap[redactedEvent.EventID()]; ok {
+			target.PDU = redactedEvent
+			backfilledEventMap[redactedEvent.EventID()] = target
+			redacted = true
+		}
+	}
+	if !redacted {
+		return
+	}
+	for j := range events {
+		if stored, ok := backfilledEventMap[events[j].EventID()]; ok {
+			events[j] = stored.PDU
+		}
+	}
+}
+
+// applyStoredRedactions applies the redactions among the events persisted outside of persistBackfilledEvents, which
+// are stored without state, see applyRedactions.
+func (r *Backfiller) applyStoredRedactions(ctx context.Context, roomID string, events []gomatrixserverlib.PDU, persisted map[string]types.Event) {
+	var found bool
+	for _, ev := range persisted {
+		if isRedaction(ev.PDU) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil || info == nil {
+		logrus.WithError(err).WithField("room_id", roomID).Error("Failed to get room info to apply redactions")
+		return
+	}
+	r.applyRedactions(ctx, info, events, persisted)
+}
+
+// redactionPowerLevelResolver resolves the power levels at a redaction from the state before it, or, if the
+// redaction was stored without state, from the power levels event among its auth events.
+type redactionPowerLevelResolver struct {
+	state state.StateResolution
+	db    storage.Database
+	info  *types.RoomInfo
+}
+
+func (p *redactionPowerLevelResolver) Resolve(ctx context.Context, eventID string) (*gomatrixserverlib.PowerLevelContent, error) {
+	powerLevels, err := p.state.Resolve(ctx, eventID)
+	if err == nil {
+		return powerLevels, nil
+	}
+	redactions, loadErr := p.db.EventsFromIDs(ctx, p.info, []string{eventID})
+	if loadErr != nil || len(redactions) == 0 {
+		return nil, err
+	}
+	authEvents, loadErr := p.db.EventsFromIDs(ctx, p.info, redactions[0].AuthEventIDs())
+	if loadErr != nil {
+		return nil, err
+	}
+	for _, ev := range authEvents {
+		if ev.Type() == spec.MRoomPowerLevels && ev.StateKeyEquals("") {
+			return ev.PowerLevels()
+		}
+	}
+	return nil, err
+}
+
+// isRedaction returns true if the event is a redaction event.
+func isRedaction(ev gomatrixserverlib.PDU) bool {
+	return ev.Type() == spec.MRoomRedaction && ev.StateKey() == nil
+}
+
+// isRoomStart returns true if the event is a well-formed create event of the room, which nothing comes before.
+func isRoomStart(ev gomatrixserverlib.PDU) bool {
+	return isCreateEvent(ev) && checkCreateEvent(ev) == nil
+}
+
+// isCreateEvent returns true if the event claims to be the create event of the room, whether or not it is well-formed.
+func isCreateEvent(ev gomatrixserverlib.PDU) bool {
+	return ev.Type() == spec.MRoomCreate && ev.StateKeyEquals("")
+}
+
+// checkCreateEvent returns an error if the create event isn't well-formed for its room version. A create event must
+// be the first event in the room, so it has no prev_events and a depth of 1.
+func checkCreateEvent(ev gomatrixserverlib.PDU) error {
+	if len(ev.PrevEventIDs()) > 0 {
+		return fmt.Errorf("create event %s has %d prev_events", ev.EventID(), len(ev.PrevEventIDs()))
+	}
+	if ev.Depth() != 1 {
+		return fmt.Errorf("create event %s has depth %d", ev.EventID(), ev.Depth())
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(ev.Version())
+	if err != nil {
+		return err
+	}
+	if err = verImpl.CheckCreateEvent(ev, gomatrixserverlib.KnownRoomVersion); err != nil {
+		return fmt.Errorf("create event %s is not valid for room version %q: %w", ev.EventID(), ev.Version(), err)
+	}
+	return nil
+}
+
+// persistFromBatch persists the events with the given IDs which are in batch.
+func (r *Backfiller) persistFromBatch(ctx context.Context, roomVer gomatrixserverlib.RoomVersion,
+	requester *backfillRequester, eventIDs []string, batch map[string]gomatrixserverlib.PDU, virtualHost spec.ServerName) {
+	var events []gomatrixserverlib.PDU
+	for _, id := range eventIDs {
+		if ev, ok := batch[id]; ok {
+			events = append(events, ev)
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	_, persisted := persistEvents(ctx, r.DB, r.Querier, events, r.missingAuthEventsFetcher(ctx, roomVer, requester, virtualHost), r.PersistConcurrency)
+	r.recordVirtualHost(ctx, virtualHost, persisted)
+	r.applyStoredRedactions(ctx, requester.roomID, events, persisted)
+	r.exportToSink(ctx, events, persisted)
+}
+
+// resumeRequest returns a copy of the request which backfills from the prev_events of the event to resume from.
+func (r *Backfiller) resumeRequest(ctx context.Context, req *api.PerformBackfillRequest) (*api.PerformBackfillRequest, error) {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.IsStub() {
+		return nil, fmt.Errorf("resumeRequest: missing room info for room %s", req.RoomID)
+	}
+	events, err := r.DB.EventsFromIDs(ctx, info, []string{req.ResumeFrom})
+	if err != nil {
+		return nil, fmt.Errorf("resumeRequest: failed to load event to resume from: %w", err)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("resumeRequest: event %s to resume from is not known", req.ResumeFrom)
+	}
+	resumed := *req
+	resumed.BackwardsExtremities = map[string][]string{req.ResumeFrom: events[0].PrevEventIDs()}
+	resumed.ResumeFrom = ""
+	return &resumed, nil
+}
+
+// gapRequest returns a copy of the request which backfills from the missing prev_events of the target gap.
+func gapRequest(req *api.PerformBackfillRequest) (*api.PerformBackfillRequest, error) {
+	if req.TargetGap.SuccessorEventID == "" || len(req.TargetGap.MissingEventIDs) == 0 {
+		return nil, fmt.Errorf("gapRequest: target gap in room %s needs a successor and missing event IDs", req.RoomID)
+	}
+	gap := *req
+	gap.BackwardsExtremities = map[string][]string{req.TargetGap.SuccessorEventID: req.TargetGap.MissingEventIDs}
+	return &gap, nil
+}
+
+// EstimateBackfill implements api.ClientRoomserverAPI
+func (r *Backfiller) EstimateBackfill(
+	ctx context.Context, virtualHost spec.ServerName, roomID string, prevEventIDs []string, limit int,
+) (*api.BackfillEstimate, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.IsStub() {
+		return nil, fmt.Errorf("EstimateBackfill: missing room info for room %s", roomID)
+	}
+
+	// Count the events we would be able to return without going over federation.
+	localNIDs, _, err := helpers.ScanEventTree(ctx, r.DB, info, prevEventIDs, make(map[string]bool, limit), limit, virtualHost, r.Querier)
+	if err != nil {
+		return nil, fmt.Errorf("EstimateBackfill: failed to scan event tree: %w", err)
+	}
+	estimate := &api.BackfillEstimate{LocalEvents: len(localNIDs)}
+	if estimate.LocalEvents >= limit {
+		return estimate, nil
+	}
+
+	bwExtrems, err := r.DB.BackwardExtremitiesForRoom(ctx, info.RoomNID)
+	if err != nil {
+		return nil, fmt.Errorf("EstimateBackfill: failed to get backward extremities: %w", err)
+	}
+	if len(bwExtrems) == 0 {
+		// we have the whole room history, so there is nothing to fetch
+		return estimate, nil
+	}
+	estimate.FederationEvents = limit - estimate.LocalEvents
+
+	// Work out which servers we would ask for the missing events, in the same way as a real backfill would.
+	requester := r.newRequester(roomID, virtualHost, bwExtrems, info.RoomVersion)
+	candidates := make(map[spec.ServerName]bool)
+	for _, missingIDs := range bwExtrems {
+		for _, missingID := range missingIDs {
+			for _, server := range requester.ServersAtEvent(ctx, roomID, missingID) {
+				candidates[server] = true
+			}
+		}
+	}
+	estimate.CandidateServers = len(candidates)
+	return estimate, nil
+}
+
+// checkUnderfilled warns if a backfill returned substantially fewer events than requested even though there is
+// more history in the room which we don't have, as this means we are failing to get the history over federation.
+func (r *Backfiller) checkUnderfilled(
+	ctx context.Context, req *api.PerformBackfillRequest, res *api.PerformBackfillResponse,
+	roomNID types.RoomNID, serversTried int,
+) {
+	if req.Limit <= 0 || float64(len(res.Events)) >= float64(req.Limit)*underfilledBackfillRatio {
+		return
+	}
+	bwExtrems, err := r.DB.BackwardExtremitiesForRoom(ctx, roomNID)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", req.RoomID).Error("checkUnderfilled: failed to get backward extremities")
+		return
+	}
+	if len(bwExtrems) == 0 {
+		// we have the whole room history, so there was nothing more to get
+		return
+	}
+	backfillUnderfilled.WithLabelValues(req.RoomID).Inc()
+	logrus.WithFields(logrus.Fields{
+		"room_id":              req.RoomID,
+		"limit":                req.Limit,
+		"events":               len(res.Events),
+		"servers_tried":        serversTried,
+		"backward_extremities": len(bwExtrems),
+	}).Warn("Backfill returned fewer events than requested while history is still missing")
+}
+
+// backfillMissingState fetches the given state events which we don't have from the servers currently in the room,
+// without backfilling the timeline. This is used to repair rooms which are missing specific state events.
+func (r *Backfiller) backfillMissingState(ctx context.Context, req *api.PerformBackfillRequest, res *api.PerformBackfillResponse) error {
+	if len(req.MissingStateEventIDs) == 0 {
+		return fmt.Errorf("backfillMissingState: no missing state event IDs given for room %s", req.RoomID)
+	}
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.IsStub() {
+		return r.unknownRoom(req)
+	}
+	joinedServers, err := r.DB.GetJoinedServerNamesInRoom(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("backfillMissingState: failed to get joined servers: %w", err)
+	}
+	requester := r.newRequester(req.RoomID, req.VirtualHost, nil, info.RoomVersion)
+	requester.serverHints = req.ServerHints
+	serverSet := make(map[spec.ServerName]bool, len(joinedServers))
+	for _, server := range joinedServers {
+		serverSet[server] = true
+	}
+	requester.servers = requester.orderServers(serverSet)
+
+	res.RecoveredEventIDs = r.fetchAndStoreMissingEvents(ctx, info.RoomVersion, requester, req.MissingStateEventIDs, req.VirtualHost)
+	logrus.WithFields(logrus.Fields{
+		"room_id":             req.RoomID,
+		"federation_requests": requester.federationRequests,
+	}).Infof("recovered %d of %d missing state events", len(res.RecoveredEventIDs), len(req.MissingStateEventIDs))
 	return nil
 }
 
-// fetchAndStoreMissingEvents does a best-effort fetch and store of missing events specified in stateIDs. Returns no error as it is just
-// best effort.
+// fetchAndStoreMissingEvents does a best-effort fetch and store of missing events specified in stateIDs. Returns the IDs of the
+// events which were stored, but no error as it is just best effort.
 func (r *Backfiller) fetchAndStoreMissingEvents(ctx context.Context, roomVer gomatrixserverlib.RoomVersion,
-	backfillRequester *backfillRequester, stateIDs []string, virtualHost spec.ServerName) {
+	backfillRequester *backfillRequester, stateIDs []string, virtualHost spec.ServerName) []string {
+	trace, ctx := internal.StartRegion(ctx, "Backfiller.fetchAndStoreMissingEvents")
+	defer trace.EndRegion()
+	trace.SetTag("room_id", backfillRequester.roomID)
 
 	servers := backfillRequester.servers
 
 	// work out which are missing
-	nidMap, err := r.DB.EventNIDs(ctx, stateIDs)
+	existing, err := r.DB.ExistingEventIDs(ctx, stateIDs)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Warn("cannot query missing events")
-		return
+		return nil
 	}
 	missingMap := make(map[string]*types.HeaderedEvent) // id -> event
 	for _, id := range stateIDs {
-		if _, ok := nidMap[id]; !ok {
+		if !existing[id] {
 			missingMap[id] = nil
 		}
 	}
 	util.GetLogger(ctx).Infof("Fetching %d missing state events (from %d possible servers)", len(missingMap), len(servers))
+	trace.SetTag("missing_events", len(missingMap))
 
 	// fetch the events from federation. Loop the servers first so if we find one that works we stick with them
-	for _, srv := range servers {
+	tried := make(map[spec.ServerName]bool, len(servers))
+	for srv, ok := backfillRequester.nextEventServer(servers, tried); ok; srv, ok = backfillRequester.nextEventServer(servers, tried) {
+		tried[srv] = true
 		for id, ev := range missingMap {
 			if ev != nil {
 				continue // already found
 			}
 			logger := util.GetLogger(ctx).WithField("server", srv).WithField("event_id", id)
-			res, err := r.FSAPI.GetEvent(ctx, virtualHost, srv, id)
+			if !backfillRequester.allowFederationRequest() {
+				logger.Warn("not fetching missing event, backfill federation request limit reached")
+				break
+			}
+			getEventTrace, _ := internal.StartRegion(ctx, "Backfiller.GetEvent")
+			getEventTrace.SetTag("server", string(srv))
+			getEventTrace.SetTag("event_id", id)
+			release, err := backfillRequester.limiter.acquire(ctx, srv)
+			if err != nil {
+				getEventTrace.EndRegion()
+				if logger, ok := r.failures().entry(logger, srv, failureServerLimit); ok {
+					logger.WithError(err).Warn("gave up waiting to fetch missing event")
+				}
+				break
+			}
+			start := time.Now()
+			res, err := backfillRequester.fsAPI.GetEvent(ctx, virtualHost, srv, id)
+			backfillRequester.observeLatency(srv, start)
+			release()
+			getEventTrace.EndRegion()
 			if err != nil {
-				logger.WithError(err).Warn("failed to get event from server")
+				if logger, ok := r.failures().entry(logger, srv, failureGetEvent); ok {
+					logger.WithError(err).Warn("failed to get event from server")
+				}
 				continue
 			}
-			loader := gomatrixserverlib.NewEventsLoader(roomVer, r.KeyRing, backfillRequester, backfillRequester.ProvideEvents, false)
+			loader := gomatrixserverlib.NewEventsLoader(roomVer, r.verifierFor(backfillRequester.roomID, srv), backfillRequester, backfillRequester.ProvideEvents, false)
 			result, err := loader.LoadAndVerify(ctx, res.PDUs, gomatrixserverlib.TopologicalOrderByPrevEvents, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 				return r.Querier.QueryUserIDForSender(ctx, roomID, senderID)
 			})
 			if err != nil {
-				logger.WithError(err).Warn("failed to load and verify event")
+				if logger, ok := r.failures().entry(logger, srv, failureLoadEvent); ok {
+					logger.WithError(err).Warn("failed to load and verify event")
+				}
 				continue
 			}
 			logger.Infof("returned %d PDUs which made events %+v", len(res.PDUs), result)
@@ -230,12 +1354,14 @@ func (r *Backfiller) fetchAndStoreMissingEvents(ctx context.Context, roomVer gom
 					logger.WithError(err).Errorf("event failed PDU checks, storing anyway")
 				case gomatrixserverlib.AuthChainErr, gomatrixserverlib.AuthRulesErr:
 					logger.WithError(err).Warn("event failed PDU checks")
+					r.quarantine(ctx, backfillRequester.roomID, srv, res.Event, err)
 					continue
 				default:
 					logger.WithError(err).Warn("event failed PDU checks")
 					continue
 				}
 				missingMap[id] = &types.HeaderedEvent{PDU: res.Event}
+				backfillRequester.lastEventServer = srv
 			}
 		}
 	}
@@ -246,8 +1372,163 @@ func (r *Backfiller) fetchAndStoreMissingEvents(ctx context.Context, roomVer gom
 			newEvents = append(newEvents, ev.PDU)
 		}
 	}
+	newEvents = eventsInRoom(ctx, backfillRequester.roomID, newEvents)
+	newEvents = eventsInRoomVersion(ctx, roomVer, newEvents)
 	util.GetLogger(ctx).Infof("Persisting %d new events", len(newEvents))
-	persistEvents(ctx, r.DB, r.Querier, newEvents)
+	_, persisted := persistEvents(ctx, r.DB, r.Querier, newEvents, r.missingAuthEventsFetcher(ctx, roomVer, backfillRequester, virtualHost), r.PersistConcurrency)
+	r.recordVirtualHost(ctx, virtualHost, persisted)
+	r.applyStoredRedactions(ctx, backfillRequester.roomID, newEvents, persisted)
+	r.exportToSink(ctx, newEvents, persisted)
+	storedIDs := make([]string, 0, len(persisted))
+	for id := range persisted {
+		storedIDs = append(storedIDs, id)
+	}
+	trace.SetTag("stored_events", len(storedIDs))
+	return storedIDs
+}
+
+// quarantine stores an event which failed auth checks, if enabled, so that operators can inspect it.
+func (r *Backfiller) quarantine(ctx context.Context, roomID string, origin spec.ServerName, event gomatrixserverlib.PDU, reason error) {
+	if !r.QuarantineRejectedEvents || event == nil {
+		return
+	}
+	err := r.DB.QuarantineEvent(ctx, &types.QuarantinedEvent{
+		EventID:       event.EventID(),
+		RoomID:        roomID,
+		Origin:        origin,
+		Reason:        reason.Error(),
+		EventJSON:     event.JSON(),
+		QuarantinedAt: spec.AsTimestamp(time.Now()),
+	})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("event_id", event.EventID()).Warn("failed to quarantine event")
+	}
+}
+
+// eventsInRoom returns the events which are in the given room. Remote servers could return events from
+// other rooms, which we must not persist as if they were part of this one, so those are dropped.
+func eventsInRoom(ctx context.Context, roomID string, events []gomatrixserverlib.PDU) []gomatrixserverlib.PDU {
+	inRoom := events[:0]
+	for _, ev := range events {
+		if ev.RoomID().String() != roomID {
+			util.GetLogger(ctx).WithFields(logrus.Fields{
+				"room_id":       roomID,
+				"event_id":      ev.EventID(),
+				"event_room_id": ev.RoomID().String(),
+			}).Warn("dropping backfilled event from another room")
+			backfillCrossRoomEvents.WithLabelValues(roomID).Inc()
+			continue
+		}
+		inRoom = append(inRoom, ev)
+	}
+	return inRoom
+}
+
+// eventsInRoomVersion returns the events which are in the format of the given room version. Remote servers
+// could return events in the format of another room version, which would corrupt the room if persisted,
+// so those are dropped.
+func eventsInRoomVersion(ctx context.Context, roomVersion gomatrixserverlib.RoomVersion, events []gomatrixserverlib.PDU) []gomatrixserverlib.PDU {
+	valid := events[:0]
+	for _, ev := range events {
+		if err := validateRoomVersion(ev, roomVersion); err != nil {
+			util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+				"room_id":  ev.RoomID().String(),
+				"event_id": ev.EventID(),
+			}).Warn("dropping backfilled event in the wrong format for the room version")
+			continue
+		}
+		valid = append(valid, ev)
+	}
+	return valid
+}
+
+// validateRoomVersion returns an error if the event isn't in the format of the given room version. The event
+// must have been parsed for the room version, and its event ID and the IDs of the events it references must be
+// in the event ID format of the room version. For room versions where the event ID is the reference hash of
+// the event, the event ID must match the hash of the event. Create events must also be well-formed, see
+// checkCreateEvent.
+func validateRoomVersion(ev gomatrixserverlib.PDU, roomVersion gomatrixserverlib.RoomVersion) error {
+	if ev.Version() != roomVersion {
+		return fmt.Errorf("event %s has room version %q, expected %q", ev.EventID(), ev.Version(), roomVersion)
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomVersion)
+	if err != nil {
+		return err
+	}
+	if isCreateEvent(ev) {
+		if err = checkCreateEvent(ev); err != nil {
+			return err
+		}
+	}
+	format := verImpl.EventIDFormat()
+	for _, id := range append(append([]string{ev.EventID()}, ev.PrevEventIDs()...), ev.AuthEventIDs()...) {
+		if !eventIDHasFormat(id, format) {
+			return fmt.Errorf("event ID %s is not in the event ID format of room version %q", id, roomVersion)
+		}
+	}
+	if format == gomatrixserverlib.EventIDFormatV1 {
+		return nil
+	}
+	parsed, err := verImpl.NewEventFromUntrustedJSON(ev.JSON())
+	if err != nil {
+		return fmt.Errorf("event %s is not valid for room version %q: %w", ev.EventID(), roomVersion, err)
+	}
+	if parsed.EventID() != ev.EventID() {
+		return fmt.Errorf("event ID %s does not match the reference hash %s", ev.EventID(), parsed.EventID())
+	}
+	return nil
+}
+
+// eventIDHasFormat returns true if the event ID is in the given event ID format.
+func eventIDHasFormat(eventID string, format gomatrixserverlib.EventIDFormat) bool {
+	if !strings.HasPrefix(eventID, "$") {
+		return false
+	}
+	var encoding *base64.Encoding
+	switch format {
+	case gomatrixserverlib.EventIDFormatV1:
+		// $localpart:domain
+		localpart, domain, ok := strings.Cut(eventID[1:], ":")
+		return ok && localpart != "" && domain != ""
+	case gomatrixserverlib.EventIDFormatV2:
+		encoding = base64.RawStdEncoding
+	case gomatrixserverlib.EventIDFormatV3:
+		encoding = base64.RawURLEncoding
+	default:
+		return false
+	}
+	// the base64 encoded SHA-256 reference hash of the event
+	hash, err := encoding.DecodeString(eventID[1:])
+	return err == nil && len(hash) == sha256.Size
+}
+
+// recordVirtualHost records that the persisted events were backfilled for the given virtual host, if enabled.
+func (r *Backfiller) recordVirtualHost(ctx context.Context, virtualHost spec.ServerName, persisted map[string]types.Event) {
+	if !r.RecordVirtualHost || len(persisted) == 0 {
+		return
+	}
+	eventNIDs := make([]types.EventNID, 0, len(persisted))
+	for _, ev := range persisted {
+		eventNIDs = append(eventNIDs, ev.EventNID)
+	}
+	if err := r.DB.RecordEventVirtualHost(ctx, virtualHost, eventNIDs); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("virtual_host", virtualHost).Warn("failed to record virtual host of backfilled events")
+	}
+}
+
+// missingAuthEventsFetcher returns a function which persistEvents can use to fetch auth events it doesn't have.
+// Fetched events may themselves be missing auth events, so this stops once maxAuthEventFetchDepth is reached.
+func (r *Backfiller) missingAuthEventsFetcher(ctx context.Context, roomVer gomatrixserverlib.RoomVersion,
+	backfillRequester *backfillRequester, virtualHost spec.ServerName) func(authEventIDs []string) {
+	return func(authEventIDs []string) {
+		if backfillRequester.authEventFetchDepth >= maxAuthEventFetchDepth {
+			util.GetLogger(ctx).WithField("auth_events", authEventIDs).Warn("not fetching missing auth events, max auth chain depth reached")
+			return
+		}
+		backfillRequester.authEventFetchDepth++
+		defer func() { backfillRequester.authEventFetchDepth-- }()
+		r.fetchAndStoreMissingEvents(ctx, roomVer, backfillRequester, authEventIDs, virtualHost)
+	}
 }
 
 // backfillRequester implements gomatrixserverlib.BackfillRequester
@@ -258,14 +1539,66 @@ type backfillRequester struct {
 	virtualHost       spec.ServerName
 	isLocalServerName func(spec.ServerName) bool
 	preferServer      map[spec.ServerName]bool
-	bwExtrems         map[string][]string
+	// servers with a positive weight are preferred too, those with the highest weight first
+	preferServerWeights map[spec.ServerName]int
+	serverHints         []spec.ServerName
+	bwExtrems           map[string][]string
 
 	// per-request state
-	servers                 []spec.ServerName
-	eventIDToBeforeStateIDs map[string][]string
-	eventIDMap              map[string]gomatrixserverlib.PDU
+	roomID  string
+	servers []spec.ServerName
+	// the state before events and the events we have seen, of which only the most recently used are kept if
+	// limited, except for the events being backfilled, which are pinned until they are persisted
+	eventIDToBeforeStateIDs *eventLRU[[]string]
+	eventIDMap              *eventLRU[gomatrixserverlib.PDU]
 	historyVisiblity        gomatrixserverlib.HistoryVisibility
 	roomVersion             gomatrixserverlib.RoomVersion
+	// the state before events which we had to fetch with /state as /state_ids was unavailable
+	eventIDToBeforeState map[string]map[string]gomatrixserverlib.PDU
+	// the number of federation requests made so far, and how many we may make (0 for no limit)
+	federationRequests    int
+	maxFederationRequests int
+	// how deep we currently are in fetching missing auth events
+	authEventFetchDepth int
+	// the observed round-trip times of each server, used to order servers when fetching missing events
+	// if preferFastServers is set
+	preferFastServers bool
+	serverLatencies   map[spec.ServerName]*serverLatency
+	lastEventServer   spec.ServerName
+	// whether to remember the auth events returned along with the state before events
+	rememberAuthEvents bool
+	// limits the requests in flight to each server across all backfills, nil for no limit
+	limiter *serverLimiter
+	// if set, only the events bridging this gap are fetched with /get_missing_events, telling the servers
+	// that we already have haveEventIDs
+	gap          *api.BackfillGap
+	haveEventIDs []string
+	// the server which most recently provided history of the room, which is tried first if set, and the
+	// first server which provided history during this backfill
+	recentServer   spec.ServerName
+	backfilledFrom spec.ServerName
+	// the server which the last /backfill request was sent to, which failures of the backfill are recorded against
+	lastBackfillServer spec.ServerName
+	// whether to backfill from servers whose users have left the room as well as from those still in it
+	includeLeftServers bool
+	// whether to backfill from the servers which have been in the room even if the history isn't visible to us
+	fallbackToMemberServers bool
+	// orders the servers which would otherwise be in map order, nil to leave them in map order
+	serverOrder func(servers []spec.ServerName)
+	// remembers the servers in the room at the points we backfill from, nil to work them out every time, and
+	// whether to use servers which expired recently while working them out again
+	serversCache               *roomServersCache
+	refreshServersConcurrently bool
+}
+
+// serverLatency is the total time taken by the federation requests made to a server, and how many there were.
+type serverLatency struct {
+	total    time.Duration
+	requests int
+}
+
+func (l *serverLatency) average() time.Duration {
+	return l.total / time.Duration(l.requests)
 }
 
 func newBackfillRequester(
@@ -275,83 +1608,265 @@ func newBackfillRequester(
 	isLocalServerName func(spec.ServerName) bool,
 	bwExtrems map[string][]string, preferServers []spec.ServerName,
 	roomVersion gomatrixserverlib.RoomVersion,
+	maxFederationRequests int,
 ) *backfillRequester {
 	preferServer := make(map[spec.ServerName]bool)
 	for _, p := range preferServers {
 		preferServer[p] = true
 	}
-	return &backfillRequester{
-		db:                      db,
-		fsAPI:                   fsAPI,
-		querier:                 querier,
-		virtualHost:             virtualHost,
-		isLocalServerName:       isLocalServerName,
-		eventIDToBeforeStateIDs: make(map[string][]string),
-		eventIDMap:              make(map[string]gomatrixserverlib.PDU),
-		bwExtrems:               bwExtrems,
-		preferServer:            preferServer,
-		historyVisiblity:        gomatrixserverlib.HistoryVisibilityShared,
-		roomVersion:             roomVersion,
+	return &backfillRequester{
+		db:                      db,
+		fsAPI:                   fsAPI,
+		querier:                 querier,
+		virtualHost:             virtualHost,
+		isLocalServerName:       isLocalServerName,
+		eventIDToBeforeStateIDs: newEventLRU[[]string](0),
+		eventIDToBeforeState:    make(map[string]map[string]gomatrixserverlib.PDU),
+		eventIDMap:              newEventLRU[gomatrixserverlib.PDU](0),
+		bwExtrems:               bwExtrems,
+		preferServer:            preferServer,
+		historyVisiblity:        gomatrixserverlib.HistoryVisibilityShared,
+		roomVersion:             roomVersion,
+		maxFederationRequests:   maxFederationRequests,
+	}
+}
+
+// observeLatency records how long a federation request to the given server which started at start took.
+func (b *backfillRequester) observeLatency(server spec.ServerName, start time.Time) {
+	if b.serverLatencies == nil {
+		b.serverLatencies = make(map[spec.ServerName]*serverLatency)
+	}
+	l, ok := b.serverLatencies[server]
+	if !ok {
+		l = &serverLatency{}
+		b.serverLatencies[server] = l
+	}
+	l.total += time.Since(start)
+	l.requests++
+}
+
+// nextEventServer returns the next server not in tried to fetch missing events from, or false if all servers
+// have been tried. Servers are tried in order, unless preferFastServers is set, in which case the server which
+// last returned an event is tried first, then the remaining servers from fastest to slowest. Servers we haven't
+// made a request to yet come last.
+func (b *backfillRequester) nextEventServer(servers []spec.ServerName, tried map[spec.ServerName]bool) (spec.ServerName, bool) {
+	var untried []spec.ServerName
+	for _, srv := range servers {
+		if !tried[srv] {
+			untried = append(untried, srv)
+		}
+	}
+	if len(untried) == 0 {
+		return "", false
+	}
+	if !b.preferFastServers {
+		return untried[0], true
+	}
+	for _, srv := range untried {
+		if srv == b.lastEventServer {
+			return srv, true
+		}
+	}
+	sort.SliceStable(untried, func(i, j int) bool {
+		li, iOK := b.serverLatencies[untried[i]]
+		lj, jOK := b.serverLatencies[untried[j]]
+		if iOK && jOK {
+			return li.average() < lj.average()
+		}
+		return iOK && !jOK
+	})
+	return untried[0], true
+}
+
+// stateProvider returns a provider which asks the given server for the state before events.
+func (b *backfillRequester) stateProvider(srv spec.ServerName) *gomatrixserverlib.FederatedStateProvider {
+	return &gomatrixserverlib.FederatedStateProvider{
+		FedClient:           limitedStateClient{b: b},
+		RememberAuthEvents:  b.rememberAuthEvents,
+		Server:              srv,
+		Origin:              b.virtualHost,
+		EventToAuthEventIDs: make(map[string][]string),
+		AuthEventMap:        make(map[string]gomatrixserverlib.PDU),
+	}
+}
+
+// rememberAuthEventsFrom adds the auth events the provider was sent to eventIDMap, if we remember auth events,
+// so that we can work out the state before more events without asking for it.
+func (b *backfillRequester) rememberAuthEventsFrom(c *gomatrixserverlib.FederatedStateProvider) {
+	if !b.rememberAuthEvents {
+		return
+	}
+	for eventID, ev := range c.AuthEventMap {
+		if _, ok := b.eventIDMap.get(eventID); !ok {
+			b.eventIDMap.set(eventID, ev)
+		}
+	}
+}
+
+// allowFederationRequest returns true and counts the request if we are still allowed to make
+// another federation request as part of this backfill, otherwise it returns false.
+func (b *backfillRequester) allowFederationRequest() bool {
+	if b.maxFederationRequests > 0 && b.federationRequests >= b.maxFederationRequests {
+		return false
 	}
+	b.federationRequests++
+	return true
 }
 
 func (b *backfillRequester) StateIDsBeforeEvent(ctx context.Context, targetEvent gomatrixserverlib.PDU) ([]string, error) {
-	b.eventIDMap[targetEvent.EventID()] = targetEvent
-	if ids, ok := b.eventIDToBeforeStateIDs[targetEvent.EventID()]; ok {
+	// The event and the state before it are needed until the event is persisted.
+	b.eventIDMap.pin(targetEvent.EventID())
+	b.eventIDToBeforeStateIDs.pin(targetEvent.EventID())
+	b.eventIDMap.set(targetEvent.EventID(), targetEvent)
+	if ids, ok := b.eventIDToBeforeStateIDs.get(targetEvent.EventID()); ok {
 		return ids, nil
 	}
-	if len(targetEvent.PrevEventIDs()) == 0 && targetEvent.Type() == "m.room.create" && targetEvent.StateKeyEquals("") {
+	if isCreateEvent(targetEvent) {
+		// There is no state before a well-formed create event, and a malformed one must not be persisted.
+		if err := checkCreateEvent(targetEvent); err != nil {
+			return nil, fmt.Errorf("backfillRequester.StateIDsBeforeEvent: %w", err)
+		}
 		util.GetLogger(ctx).WithField("room_id", targetEvent.RoomID().String()).Info("Backfilled to the beginning of the room")
-		b.eventIDToBeforeStateIDs[targetEvent.EventID()] = []string{}
+		b.eventIDToBeforeStateIDs.set(targetEvent.EventID(), []string{})
 		return nil, nil
 	}
 	// if we have exactly 1 prev event and we know the state of the room at that prev event, then just roll forward the prev event.
 	// Else, we have to hit /state_ids because either we don't know the state at all at this event (new backwards extremity) or
 	// we don't know the result of state res to merge forks (2 or more prev_events)
+	reason := stateFallbackMultiplePrevEvents
 	if len(targetEvent.PrevEventIDs()) == 1 {
 		prevEventID := targetEvent.PrevEventIDs()[0]
-		prevEvent, ok := b.eventIDMap[prevEventID]
+		prevEvent, ok := b.eventIDMap.get(prevEventID)
 		if !ok {
+			reason = stateFallbackNoPrevEvent
 			goto FederationHit
 		}
-		prevEventStateIDs, ok := b.eventIDToBeforeStateIDs[prevEventID]
+		prevEventStateIDs, ok := b.eventIDToBeforeStateIDs.get(prevEventID)
 		if !ok {
+			reason = stateFallbackMissingState
 			goto FederationHit
 		}
 		newStateIDs := b.calculateNewStateIDs(targetEvent, prevEvent, prevEventStateIDs)
 		if newStateIDs != nil {
-			b.eventIDToBeforeStateIDs[targetEvent.EventID()] = newStateIDs
+			backfillStateCalculations.WithLabelValues("fast_path", "").Inc()
+			b.eventIDToBeforeStateIDs.set(targetEvent.EventID(), newStateIDs)
 			return newStateIDs, nil
 		}
 		// else we failed to calculate the new state, so fallthrough
+		reason = stateFallbackCalculationFailed
 	}
 
 FederationHit:
 	var lastErr error
-	logrus.WithField("event_id", targetEvent.EventID()).Info("Requesting /state_ids at event")
+	backfillStateCalculations.WithLabelValues("federation", reason).Inc()
+	logrus.WithFields(logrus.Fields{
+		"event_id": targetEvent.EventID(),
+		"reason":   reason,
+	}).Info("Requesting /state_ids at event")
 	for _, srv := range b.servers { // hit any valid server
-		c := gomatrixserverlib.FederatedStateProvider{
-			FedClient:          b.fsAPI,
-			RememberAuthEvents: false,
-			Server:             srv,
-			Origin:             b.virtualHost,
+		if !b.allowFederationRequest() {
+			return nil, errFederationRequestLimit
 		}
+		c := b.stateProvider(srv)
+		start := time.Now()
 		res, err := c.StateIDsBeforeEvent(ctx, targetEvent)
+		b.observeLatency(srv, start)
 		if err != nil {
 			lastErr = err
 			continue
 		}
-		b.eventIDToBeforeStateIDs[targetEvent.EventID()] = res
+		b.eventIDToBeforeStateIDs.set(targetEvent.EventID(), res)
 		return res, nil
 	}
+	if lastErr == nil {
+		return nil, nil
+	}
+	// None of the servers answered /state_ids, which some servers don't implement, so fall back to asking for
+	// the full state with /state and then to what we know about the state locally.
+	if ids, err := b.stateIDsBeforeEventFromState(ctx, targetEvent); err == nil {
+		logrus.WithError(lastErr).WithField("event_id", targetEvent.EventID()).Warn("Failed to get /state_ids at event, fell back to /state")
+		return ids, nil
+	}
+	if ids, err := b.localStateIDsBeforeEvent(ctx, targetEvent); err == nil {
+		logrus.WithError(lastErr).WithField("event_id", targetEvent.EventID()).Warn("Failed to get /state_ids at event, fell back to the local state")
+		b.eventIDToBeforeStateIDs.set(targetEvent.EventID(), ids)
+		return ids, nil
+	}
+	return nil, lastErr
+}
+
+// stateIDsBeforeEventFromState asks the servers for the full state before the event with /state, remembering the
+// state events so that StateBeforeEvent doesn't need to fetch them again.
+func (b *backfillRequester) stateIDsBeforeEventFromState(ctx context.Context, targetEvent gomatrixserverlib.PDU) ([]string, error) {
+	var lastErr error
+	for _, srv := range b.servers {
+		if !b.allowFederationRequest() {
+			return nil, errFederationRequestLimit
+		}
+		c := b.stateProvider(srv)
+		start := time.Now()
+		state, err := c.StateBeforeEvent(ctx, b.roomVersion, targetEvent, nil)
+		b.observeLatency(srv, start)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b.rememberAuthEventsFrom(c)
+		ids := make([]string, 0, len(state))
+		for eventID := range state {
+			ids = append(ids, eventID)
+		}
+		b.eventIDToBeforeStateIDs.set(targetEvent.EventID(), ids)
+		b.eventIDToBeforeState[targetEvent.EventID()] = state
+		return ids, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no servers to request /state at event %s from", targetEvent.EventID())
+	}
 	return nil, lastErr
 }
 
+// localStateIDsBeforeEvent returns the state before the event from the database, if we have the event already.
+func (b *backfillRequester) localStateIDsBeforeEvent(ctx context.Context, targetEvent gomatrixserverlib.PDU) ([]string, error) {
+	info, err := b.db.RoomInfo(ctx, targetEvent.RoomID().String())
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.IsStub() {
+		return nil, fmt.Errorf("missing room info for room %s", targetEvent.RoomID().String())
+	}
+	nids, err := b.db.EventNIDs(ctx, []string{targetEvent.EventID()})
+	if err != nil {
+		return nil, err
+	}
+	nid, ok := nids[targetEvent.EventID()]
+	if !ok {
+		return nil, fmt.Errorf("event %s is not known locally", targetEvent.EventID())
+	}
+	stateEntries, err := helpers.StateBeforeEvent(ctx, b.db, info, nid.EventNID, b.querier)
+	if err != nil {
+		return nil, err
+	}
+	stateNIDs := make([]types.EventNID, len(stateEntries))
+	for i := range stateEntries {
+		stateNIDs[i] = stateEntries[i].EventNID
+	}
+	eventIDs, err := b.db.EventIDs(ctx, stateNIDs)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(eventIDs))
+	for _, id := range eventIDs {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 func (b *backfillRequester) calculateNewStateIDs(targetEvent, prevEvent gomatrixserverlib.PDU, prevEventStateIDs []string) []string {
 	newStateIDs := prevEventStateIDs[:]
 	if prevEvent.StateKey() == nil {
 		// state is the same as the previous event
-		b.eventIDToBeforeStateIDs[targetEvent.EventID()] = newStateIDs
+		b.eventIDToBeforeStateIDs.set(targetEvent.EventID(), newStateIDs)
 		return newStateIDs
 	}
 
@@ -359,7 +1874,7 @@ func (b *backfillRequester) calculateNewStateIDs(targetEvent, prevEvent gomatrix
 	foundEvent := false   // true if we found a (type, state_key) match
 	// find which state ID to replace, if any
 	for i, id := range newStateIDs {
-		ev, ok := b.eventIDMap[id]
+		ev, ok := b.eventIDMap.get(id)
 		if !ok {
 			missingState = true
 			continue
@@ -378,7 +1893,7 @@ func (b *backfillRequester) calculateNewStateIDs(targetEvent, prevEvent gomatrix
 	}
 
 	if foundEvent {
-		b.eventIDToBeforeStateIDs[targetEvent.EventID()] = newStateIDs
+		b.eventIDToBeforeStateIDs.set(targetEvent.EventID(), newStateIDs)
 		return newStateIDs
 	}
 	return nil
@@ -398,27 +1913,55 @@ func (b *backfillRequester) StateBeforeEvent(ctx context.Context, roomVer gomatr
 			result := make(map[string]gomatrixserverlib.PDU)
 			for i := range events {
 				result[events[i].EventID()] = events[i]
-				b.eventIDMap[events[i].EventID()] = events[i]
+				b.eventIDMap.set(events[i].EventID(), events[i])
+			}
+			return result, nil
+		}
+	}
+
+	// if we already fetched the full state with /state because /state_ids was unavailable, use that
+	if state, ok := b.eventIDToBeforeState[event.EventID()]; ok {
+		result := make(map[string]gomatrixserverlib.PDU, len(eventIDs))
+		for _, eventID := range eventIDs {
+			if ev, ok := state[eventID]; ok {
+				result[eventID] = ev
+				b.eventIDMap.set(eventID, ev)
+			}
+		}
+		if len(result) == len(eventIDs) {
+			return result, nil
+		}
+	}
+
+	// if we remember the auth events returned with earlier state, we might have every event already
+	if b.rememberAuthEvents {
+		result := make(map[string]gomatrixserverlib.PDU, len(eventIDs))
+		for _, eventID := range eventIDs {
+			if ev, ok := b.eventIDMap.get(eventID); ok {
+				result[eventID] = ev
 			}
+		}
+		if len(result) == len(eventIDs) {
 			return result, nil
 		}
 	}
 
 	var lastErr error
 	for _, srv := range b.servers {
-		c := gomatrixserverlib.FederatedStateProvider{
-			FedClient:          b.fsAPI,
-			RememberAuthEvents: false,
-			Server:             srv,
-			Origin:             b.virtualHost,
+		if !b.allowFederationRequest() {
+			return nil, errFederationRequestLimit
 		}
+		c := b.stateProvider(srv)
+		start := time.Now()
 		result, err := c.StateBeforeEvent(ctx, roomVer, event, eventIDs)
+		b.observeLatency(srv, start)
 		if err != nil {
 			lastErr = err
 			continue
 		}
+		b.rememberAuthEventsFrom(c)
 		for eventID, ev := range result {
-			b.eventIDMap[eventID] = ev
+			b.eventIDMap.set(eventID, ev)
 		}
 		return result, nil
 	}
@@ -430,56 +1973,101 @@ func (b *backfillRequester) StateBeforeEvent(ctx context.Context, roomVer gomatr
 // will be servers that are in the room already. The entries at the beginning are preferred servers
 // and will be tried first. An empty list will fail the request.
 func (b *backfillRequester) ServersAtEvent(ctx context.Context, roomID, eventID string) []spec.ServerName {
-	// eventID will be a prev_event ID of a backwards extremity, meaning we will not have a database entry for it. Instead, use
-	// its successor, so look it up.
-	successor := ""
-FindSuccessor:
+	trace, ctx := internal.StartRegion(ctx, "backfillRequester.ServersAtEvent")
+	defer trace.EndRegion()
+	trace.SetTag("room_id", roomID)
+	trace.SetTag("event_id", eventID)
+
+	successor := b.eventToDetermineServersAt(ctx, eventID)
+	if successor == "" {
+		logrus.WithField("event_id", eventID).Error("ServersAtEvent: failed to find successor of this event to determine room state")
+		return nil
+	}
+	key := roomServersCacheKey(roomID, successor, b.virtualHost, b.includeLeftServers, b.fallbackToMemberServers)
+	if b.serversCache != nil {
+		if entry, fresh, ok := b.serversCache.get(key); ok && (fresh || b.refreshServersConcurrently) {
+			if !fresh {
+				// Start backfilling from the servers we had straight away, and have them for next time.
+				b.refreshServers(key, roomID, successor)
+			}
+			trace.SetTag("cached", true)
+			b.historyVisiblity = entry.visibility
+			b.servers = b.orderServers(entry.servers)
+			trace.SetTag("servers", len(b.servers))
+			return b.servers
+		}
+	}
+
+	serverSet, visibility, ok := b.serverSetAtEvent(ctx, roomID, successor)
+	if !ok {
+		return nil
+	}
+	b.historyVisiblity = visibility
+	if b.serversCache != nil {
+		b.serversCache.put(key, serverSet, visibility)
+	}
+	b.servers = b.orderServers(serverSet)
+	trace.SetTag("servers", len(b.servers))
+	return b.servers
+}
+
+// eventToDetermineServersAt returns the event whose room state tells which servers to backfill from for the given
+// event, or an empty string if there isn't one. That is the event itself if we have it stored along with the state
+// before it. Usually eventID will be a prev_event ID of a backwards extremity though, meaning we will not have a
+// database entry for it, so then it is its successor. The same goes for events which we have without the state
+// before them, such as outliers or events whose backfill was interrupted before their state was stored.
+func (b *backfillRequester) eventToDetermineServersAt(ctx context.Context, eventID string) string {
+	// This fails with sql.ErrNoRows if we don't have the event or the state before it.
+	_, err := b.db.SnapshotNIDFromEventID(ctx, eventID)
+	if err == nil {
+		return eventID
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		logrus.WithField("event_id", eventID).WithError(err).Warn("ServersAtEvent: failed to look up event, trying its successor")
+	}
 	for sucID, prevEventIDs := range b.bwExtrems {
 		for _, pe := range prevEventIDs {
 			if pe == eventID {
-				successor = sucID
-				break FindSuccessor
+				return sucID
 			}
 		}
 	}
-	if successor == "" {
-		logrus.WithField("event_id", eventID).Error("ServersAtEvent: failed to find successor of this event to determine room state")
-		return nil
-	}
-	eventID = successor
+	return ""
+}
 
+// serverSetAtEvent returns the servers which were in the room at the given event, which we have stored, along with
+// the history visibility there. This only reads from the requester, so it is safe to call concurrently.
+func (b *backfillRequester) serverSetAtEvent(ctx context.Context, roomID, eventID string) (map[spec.ServerName]bool, gomatrixserverlib.HistoryVisibility, bool) {
 	// getMembershipsBeforeEventNID requires a NID, so retrieving the NID for
 	// the event is necessary.
 	NIDs, err := b.db.EventNIDs(ctx, []string{eventID})
 	if err != nil {
 		logrus.WithField("event_id", eventID).WithError(err).Error("ServersAtEvent: failed to get event NID for event")
-		return nil
+		return nil, "", false
 	}
 
 	info, err := b.db.RoomInfo(ctx, roomID)
 	if err != nil {
 		logrus.WithError(err).WithField("room_id", roomID).Error("ServersAtEvent: failed to get RoomInfo for room")
-		return nil
+		return nil, "", false
 	}
 	if info == nil || info.IsStub() {
 		logrus.WithField("room_id", roomID).Error("ServersAtEvent: failed to get RoomInfo for room, room is missing")
-		return nil
+		return nil, "", false
 	}
 
 	stateEntries, err := helpers.StateBeforeEvent(ctx, b.db, info, NIDs[eventID].EventNID, b.querier)
 	if err != nil {
 		logrus.WithField("event_id", eventID).WithError(err).Error("ServersAtEvent: failed to load state before event")
-		return nil
+		return nil, "", false
 	}
 
 	// possibly return all joined servers depending on history visiblity
-	memberEventsFromVis, visibility, err := joinEventsFromHistoryVisibility(ctx, b.db, b.querier, info, stateEntries, b.virtualHost)
-	b.historyVisiblity = visibility
+	serversFromVis, visibility, err := joinedServersFromHistoryVisibility(ctx, b.db, b.querier, roomID, info, stateEntries, b.virtualHost, b.includeLeftServers, b.fallbackToMemberServers)
 	if err != nil {
 		logrus.WithError(err).Error("ServersAtEvent: failed calculate servers from history visibility rules")
-		return nil
+		return nil, "", false
 	}
-	logrus.Infof("ServersAtEvent including %d current events from history visibility", len(memberEventsFromVis))
+	logrus.Infof("ServersAtEvent including %d current servers from history visibility", len(serversFromVis))
 
 	// Retrieve all "m.room.member" state events of "join" membership, which
 	// contains the list of users in the room before the event, therefore all
@@ -487,33 +2075,75 @@ FindSuccessor:
 	memberEvents, err := helpers.GetMembershipsAtState(ctx, b.db, info, stateEntries, true)
 	if err != nil {
 		logrus.WithField("event_id", eventID).WithError(err).Error("ServersAtEvent: failed to get memberships before event")
-		return nil
+		return nil, "", false
 	}
-	memberEvents = append(memberEvents, memberEventsFromVis...)
 
 	// Store the server names in a temporary map to avoid duplicates.
 	serverSet := make(map[spec.ServerName]bool)
+	for _, server := range serversFromVis {
+		serverSet[server] = true
+	}
 	for _, event := range memberEvents {
 		if sender, err := b.querier.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID()); err == nil {
 			serverSet[sender.Domain()] = true
 		}
 	}
-	var servers []spec.ServerName
-	for server := range serverSet {
-		if b.isLocalServerName(server) {
-			continue
+	return serverSet, visibility, true
+}
+
+// orderServers returns at most maxBackfillServers of the given servers to backfill from, excluding our own
+// server names. The server which most recently provided history of the room comes first if there is one, even
+// if it isn't one of the given servers. The preferred servers come next, in descending order of weight if any
+// servers have weights, followed by the server hints and then everyone else.
+func (b *backfillRequester) orderServers(serverSet map[spec.ServerName]bool) []spec.ServerName {
+	servers := make([]spec.ServerName, 0, len(serverSet)+len(b.serverHints))
+	seen := make(map[spec.ServerName]bool, cap(servers))
+	add := func(server spec.ServerName) {
+		if seen[server] || b.isLocalServerName(server) {
+			return
 		}
-		if b.preferServer[server] { // insert at the front
-			servers = append([]spec.ServerName{server}, servers...)
-		} else { // insert at the back
-			servers = append(servers, server)
+		seen[server] = true
+		servers = append(servers, server)
+	}
+	if b.recentServer != "" {
+		add(b.recentServer)
+	}
+	var preferred []spec.ServerName
+	for server := range serverSet {
+		if b.preferServer[server] || b.preferServerWeights[server] > 0 {
+			preferred = append(preferred, server)
 		}
 	}
+	if len(b.preferServerWeights) > 0 {
+		sort.Slice(preferred, func(i, j int) bool {
+			wi, wj := b.preferServerWeights[preferred[i]], b.preferServerWeights[preferred[j]]
+			if wi != wj {
+				return wi > wj
+			}
+			return preferred[i] < preferred[j]
+		})
+	} else if b.serverOrder != nil {
+		b.serverOrder(preferred)
+	}
+	for _, server := range preferred {
+		add(server)
+	}
+	for _, server := range b.serverHints {
+		add(server)
+	}
+	others := make([]spec.ServerName, 0, len(serverSet))
+	for server := range serverSet {
+		others = append(others, server)
+	}
+	if b.serverOrder != nil {
+		b.serverOrder(others)
+	}
+	for _, server := range others {
+		add(server)
+	}
 	if len(servers) > maxBackfillServers {
 		servers = servers[:maxBackfillServers]
 	}
-
-	b.servers = servers
 	return servers
 }
 
@@ -522,10 +2152,53 @@ FindSuccessor:
 func (b *backfillRequester) Backfill(ctx context.Context, origin, server spec.ServerName, roomID string,
 	limit int, fromEventIDs []string) (gomatrixserverlib.Transaction, error) {
 
-	tx, err := b.fsAPI.Backfill(ctx, origin, server, roomID, limit, fromEventIDs)
+	if !b.allowFederationRequest() {
+		return gomatrixserverlib.Transaction{}, errFederationRequestLimit
+	}
+	release, err := b.limiter.acquire(ctx, server)
+	if err != nil {
+		return gomatrixserverlib.Transaction{}, err
+	}
+	defer release()
+	b.lastBackfillServer = server
+	start := time.Now()
+	var tx gomatrixserverlib.Transaction
+	if b.gap != nil {
+		tx, err = b.missingEvents(ctx, origin, server, roomID, limit)
+	} else {
+		tx, err = b.fsAPI.Backfill(ctx, origin, server, roomID, limit, fromEventIDs)
+	}
+	b.observeLatency(server, start)
+	if err == nil && len(tx.PDUs) > 0 && b.backfilledFrom == "" {
+		b.backfilledFrom = server
+	}
 	return tx, err
 }
 
+// missingEvents asks the server for the events bridging the gap with /get_missing_events, returning them as
+// if they had been backfilled.
+// https://spec.matrix.org/v1.9/server-server-api/#post_matrixfederationv1get_missing_eventsroomid
+func (b *backfillRequester) missingEvents(ctx context.Context, origin, server spec.ServerName, roomID string,
+	limit int) (gomatrixserverlib.Transaction, error) {
+	res, err := b.fsAPI.LookupMissingEvents(ctx, origin, server, roomID, fclient.MissingEvents{
+		Limit:          limit,
+		EarliestEvents: b.haveEventIDs,
+		LatestEvents:   []string{b.gap.SuccessorEventID},
+	}, b.roomVersion)
+	if err != nil {
+		return gomatrixserverlib.Transaction{}, err
+	}
+	pdus := make([]json.RawMessage, len(res.Events))
+	for i := range res.Events {
+		pdus[i] = json.RawMessage(res.Events[i])
+	}
+	return gomatrixserverlib.Transaction{
+		Origin:         server,
+		OriginServerTS: spec.AsTimestamp(time.Now()),
+		PDUs:           pdus,
+	}, nil
+}
+
 func (b *backfillRequester) ProvideEvents(roomVer gomatrixserverlib.RoomVersion, eventIDs []string) ([]gomatrixserverlib.PDU, error) {
 	ctx := context.Background()
 	nidMap, err := b.db.EventNIDs(ctx, eventIDs)
@@ -551,27 +2224,61 @@ func (b *backfillRequester) ProvideEvents(roomVer gomatrixserverlib.RoomVersion,
 	return events, nil
 }
 
-// joinEventsFromHistoryVisibility returns all CURRENTLY joined members if our server can read the room history
+// joinedServersFromHistoryVisibility returns the servers of all CURRENTLY joined members if our server can read the room history.
+// If includeLeft is set, the servers of members who have since left or been banned are included too, as they are likely
+// to still hold the history from when they were joined.
+// Whether we can read the history is decided using our own server's memberships in the given state, so a user on
+// our server who has only knocked on the room doesn't grant us access, whereas one who joined (including via a
+// restricted join rule) does.
+// If fallbackToMembers is set and we can't read the history, the servers of all members who have been in the room,
+// including those who have left or been banned, are returned anyway. These are only servers we may ask for the
+// history, as whether we may serve it is still decided by the returned history visibility.
 //
 // TODO: Long term we probably want a history_visibility table which stores eventNID | visibility_enum so we can just
 // pull all events and then filter by that table.
-func joinEventsFromHistoryVisibility(
-	ctx context.Context, db storage.RoomDatabase, querier api.QuerySenderIDAPI, roomInfo *types.RoomInfo, stateEntries []types.StateEntry,
-	thisServer spec.ServerName) ([]types.Event, gomatrixserverlib.HistoryVisibility, error) {
+func joinedServersFromHistoryVisibility(
+	ctx context.Context, db storage.RoomDatabase, querier api.QuerySenderIDAPI, roomID string, roomInfo *types.RoomInfo,
+	stateEntries []types.StateEntry, thisServer spec.ServerName, includeLeft, fallbackToMembers bool) ([]spec.ServerName, gomatrixserverlib.HistoryVisibility, error) {
+
+	// Get all of the events in this state
+	if roomInfo == nil {
+		return nil, gomatrixserverlib.HistoryVisibilityJoined, types.ErrorInvalidRoomInfo
+	}
 
 	var eventNIDs []types.EventNID
+	var memberEntries []types.StateEntry
+	var memberStateKeyNIDs []types.EventStateKeyNID
 	for _, entry := range stateEntries {
-		// Filter the events to retrieve to only keep the membership events
-		if entry.EventTypeNID == types.MRoomHistoryVisibilityNID && entry.EventStateKeyNID == types.EmptyStateKeyNID {
+		// Filter the events to retrieve to only keep the history visibility event and membership events
+		switch {
+		case entry.EventTypeNID == types.MRoomHistoryVisibilityNID && entry.EventStateKeyNID == types.EmptyStateKeyNID:
 			eventNIDs = append(eventNIDs, entry.EventNID)
-			break
+		case entry.EventTypeNID == types.MRoomMemberNID:
+			memberEntries = append(memberEntries, entry)
+			memberStateKeyNIDs = append(memberStateKeyNIDs, entry.EventStateKeyNID)
 		}
 	}
 
-	// Get all of the events in this state
-	if roomInfo == nil {
-		return nil, gomatrixserverlib.HistoryVisibilityJoined, types.ErrorInvalidRoomInfo
+	// Only keep the membership events for users on our server, as those are the only ones
+	// which affect whether we are allowed to see the history.
+	if len(memberEntries) > 0 {
+		stateKeys, err := db.EventStateKeys(ctx, memberStateKeyNIDs)
+		if err != nil {
+			return nil, gomatrixserverlib.HistoryVisibilityJoined, err
+		}
+		validRoomID, err := spec.NewRoomID(roomID)
+		if err != nil {
+			return nil, gomatrixserverlib.HistoryVisibilityJoined, err
+		}
+		for _, entry := range memberEntries {
+			userID, err := querier.QueryUserIDForSender(ctx, *validRoomID, spec.SenderID(stateKeys[entry.EventStateKeyNID]))
+			if err != nil || userID == nil || userID.Domain() != thisServer {
+				continue
+			}
+			eventNIDs = append(eventNIDs, entry.EventNID)
+		}
 	}
+
 	stateEvents, err := db.Events(ctx, roomInfo.RoomVersion, eventNIDs)
 	if err != nil {
 		// even though the default should be shared, restricting the visibility to joined
@@ -583,12 +2290,31 @@ func joinEventsFromHistoryVisibility(
 		events[i] = stateEvents[i].PDU
 	}
 
+	// Were we in the room at this point? This is decided by our memberships in the given state rather
+	// than our current ones, and only joins count here, not knocks or invites.
+	isInRoom := auth.IsAnyUserOnServerWithMembership(ctx, querier, thisServer, events, spec.Join)
+
 	// Can we see events in the room?
-	canSeeEvents := auth.IsServerAllowed(ctx, querier, thisServer, true, events)
+	canSeeEvents := auth.IsServerAllowed(ctx, querier, thisServer, isInRoom, events)
 	visibility := auth.HistoryVisibilityForRoom(events)
 	if !canSeeEvents {
-		logrus.Infof("ServersAtEvent history not visible to us: %s", visibility)
-		return nil, visibility, nil
+		if !fallbackToMembers {
+			logrus.Infof("ServersAtEvent history not visible to us: %s", visibility)
+			return nil, visibility, nil
+		}
+		// Any server which has been in the room may still have the history, and asking them for it is harmless.
+		logrus.Infof("ServersAtEvent history not visible to us: %s, falling back to servers which have been in the room", visibility)
+		includeLeft = true
+	}
+	if roomInfo.RoomVersion != gomatrixserverlib.RoomVersionPseudoIDs {
+		// The membership state keys are user IDs, so the database can work out the servers
+		// without us having to load every joined membership event.
+		servers, err := db.GetJoinedServerNamesInRoom(ctx, roomInfo.RoomNID)
+		if err != nil || !includeLeft {
+			return servers, visibility, err
+		}
+		left, err := leftServers(ctx, db, querier, roomInfo)
+		return append(servers, left...), visibility, err
 	}
 	// get joined members
 	joinEventNIDs, err := db.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, false)
@@ -596,69 +2322,368 @@ func joinEventsFromHistoryVisibility(
 		return nil, visibility, err
 	}
 	evs, err := db.Events(ctx, roomInfo.RoomVersion, joinEventNIDs)
-	return evs, visibility, err
+	if err != nil {
+		return nil, visibility, err
+	}
+	serverSet := make(map[spec.ServerName]struct{}, len(evs))
+	servers := make([]spec.ServerName, 0, len(evs))
+	for _, ev := range evs {
+		sender, err := querier.QueryUserIDForSender(ctx, ev.RoomID(), ev.SenderID())
+		if err != nil || sender == nil {
+			continue
+		}
+		if _, ok := serverSet[sender.Domain()]; !ok {
+			serverSet[sender.Domain()] = struct{}{}
+			servers = append(servers, sender.Domain())
+		}
+	}
+	if includeLeft {
+		left, err := leftServers(ctx, db, querier, roomInfo)
+		return append(servers, left...), visibility, err
+	}
+	return servers, visibility, nil
+}
+
+// leftServers returns the servers of the members of the room who have left or been banned, which may include
+// servers which are still in the room.
+func leftServers(
+	ctx context.Context, db storage.RoomDatabase, querier api.QuerySenderIDAPI, roomInfo *types.RoomInfo,
+) ([]spec.ServerName, error) {
+	membershipNIDs, err := db.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, false, false)
+	if err != nil {
+		return nil, err
+	}
+	evs, err := db.Events(ctx, roomInfo.RoomVersion, membershipNIDs)
+	if err != nil {
+		return nil, err
+	}
+	serverSet := make(map[spec.ServerName]struct{}, len(evs))
+	servers := make([]spec.ServerName, 0, len(evs))
+	for _, ev := range evs {
+		membership, err := ev.Membership()
+		if err != nil || (membership != spec.Leave && membership != spec.Ban) || ev.StateKey() == nil {
+			continue
+		}
+		// The sender of a kick or ban is someone else, so it's the member's server we want.
+		member, err := querier.QueryUserIDForSender(ctx, ev.RoomID(), spec.SenderID(*ev.StateKey()))
+		if err != nil || member == nil {
+			continue
+		}
+		if _, ok := serverSet[member.Domain()]; !ok {
+			serverSet[member.Domain()] = struct{}{}
+			servers = append(servers, member.Domain())
+		}
+	}
+	return servers, nil
 }
 
-func persistEvents(ctx context.Context, db storage.Database, querier api.QuerySenderIDAPI, events []gomatrixserverlib.PDU) (types.RoomNID, map[string]types.Event) {
+// persistEvents stores the given events. Events are never stored before the events in the batch they reference as an
+// auth or prev event, whatever order they were given in. Events with auth events which are neither stored nor in the
+// batch are deferred, along with the events in the batch which reference them, until the rest have been stored. If
+// fetchAuthEvents is not nil, it is then called with the missing auth events, before the deferred events are stored
+// with whichever of them could be fetched. Up to concurrency events are stored at the same time. Redaction events
+// aren't applied, which every caller does afterwards, see applyRedactions.
+func persistEvents(
+	ctx context.Context, db storage.Database, querier api.QuerySenderIDAPI, events []gomatrixserverlib.PDU,
+	fetchAuthEvents func(authEventIDs []string), concurrency int,
+) (types.RoomNID, map[string]types.Event) {
+	trace, ctx := internal.StartRegion(ctx, "persistEvents")
+	defer trace.EndRegion()
+	trace.SetTag("events", len(events))
+
 	var roomNID types.RoomNID
-	var eventNID types.EventNID
 	backfilledEventMap := make(map[string]types.Event)
-	for j, ev := range events {
-		nidMap, err := db.EventNIDs(ctx, ev.AuthEventIDs())
-		if err != nil { // this shouldn't happen as RequestBackfill already found them
-			logrus.WithError(err).WithField("auth_events", ev.AuthEventIDs()).Error("Failed to find one or more auth events")
-			continue
+	defer func() { trace.SetTag("persisted_events", len(backfilledEventMap)) }()
+
+	ready, deferred, missingAuthEventIDs := deferMissingLinks(ctx, db, events)
+	persistEventsPass(ctx, db, querier, events, ready, fetchAuthEvents, concurrency, &roomNID, backfilledEventMap)
+	if len(deferred) == 0 {
+		return roomNID, backfilledEventMap
+	}
+	trace.SetTag("deferred_events", len(deferred))
+	logrus.WithFields(logrus.Fields{
+		"deferred_events": len(deferred),
+		"auth_events":     missingAuthEventIDs,
+	}).Info("Deferring backfilled events until their missing auth events have been fetched")
+	if fetchAuthEvents != nil {
+		fetchAuthEvents(missingAuthEventIDs)
+	}
+	// The missing auth events have been fetched already, so don't try again for each deferred event.
+	persistEventsPass(ctx, db, querier, events, deferred, nil, concurrency, &roomNID, backfilledEventMap)
+	return roomNID, backfilledEventMap
+}
+
+// deferMissingLinks splits the indexes of the events into those which can be stored straight away and those which
+// reference an auth event which is neither stored nor in the batch, or which reference such an event in the batch
+// as an auth or prev event. The missing auth events are returned too. If the stored events can't be looked up, no
+// events are deferred.
+func deferMissingLinks(ctx context.Context, db storage.Database, events []gomatrixserverlib.PDU) (ready, deferred []int, missingAuthEventIDs []string) {
+	indexes := make(map[string]int, len(events))
+	for i, ev := range events {
+		indexes[ev.EventID()] = i
+	}
+	var outside []string
+	for _, ev := range events {
+		for _, id := range ev.AuthEventIDs() {
+			if _, ok := indexes[id]; !ok {
+				outside = append(outside, id)
+			}
 		}
-		authNids := make([]types.EventNID, len(nidMap))
-		i := 0
-		for _, nid := range nidMap {
-			authNids[i] = nid.EventNID
-			i++
+	}
+	all := make([]int, len(events))
+	for i := range events {
+		all[i] = i
+	}
+	if len(outside) == 0 {
+		return all, nil, nil
+	}
+	existing, err := db.ExistingEventIDs(ctx, outside)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to look up the auth events of backfilled events, not deferring any")
+		return all, nil, nil
+	}
+	missing := make(map[string]bool)
+	for _, id := range outside {
+		if !existing[id] && !missing[id] {
+			missing[id] = true
+			missingAuthEventIDs = append(missingAuthEventIDs, id)
 		}
+	}
+	if len(missing) == 0 {
+		return all, nil, nil
+	}
 
-		roomInfo, err := db.GetOrCreateRoomInfo(ctx, ev)
-		if err != nil {
-			logrus.WithError(err).Error("failed to get or create roomNID")
-			continue
+	const unvisited, visiting = 0, 1
+	const isReady, isDeferred = 2, 3
+	status := make([]int, len(events))
+	var visit func(i int) int
+	visit = func(i int) int {
+		switch status[i] {
+		case unvisited:
+		case visiting: // a cycle, which valid events can't have
+			return isReady
+		default:
+			return status[i]
+		}
+		status[i] = visiting
+		result := isReady
+		for _, id := range events[i].AuthEventIDs() {
+			if missing[id] {
+				result = isDeferred
+			}
 		}
-		roomNID = roomInfo.RoomNID
+		for _, ids := range [][]string{events[i].AuthEventIDs(), events[i].PrevEventIDs()} {
+			for _, id := range ids {
+				if j, ok := indexes[id]; ok && j != i && visit(j) == isDeferred {
+					result = isDeferred
+				}
+			}
+		}
+		status[i] = result
+		return result
+	}
+	for i := range events {
+		if visit(i) == isDeferred {
+			deferred = append(deferred, i)
+		} else {
+			ready = append(ready, i)
+		}
+	}
+	return ready, deferred, missingAuthEventIDs
+}
 
-		eventTypeNID, err := db.GetOrCreateEventTypeNID(ctx, ev.Type())
-		if err != nil {
-			logrus.WithError(err).Error("failed to get or create eventType NID")
-			continue
+// persistEventsPass stores the events at the given indexes, replacing them in events with the stored events and adding
+// them to backfilledEventMap.
+func persistEventsPass(
+	ctx context.Context, db storage.Database, querier api.QuerySenderIDAPI, events []gomatrixserverlib.PDU, indexes []int,
+	fetchAuthEvents func(authEventIDs []string), concurrency int, roomNID *types.RoomNID, backfilledEventMap map[string]types.Event,
+) {
+	if len(indexes) == 0 {
+		return
+	}
+	pass := make([]gomatrixserverlib.PDU, len(indexes))
+	for k, j := range indexes {
+		pass[k] = events[j]
+	}
+	groups := dependencyGroups(pass)
+	if concurrency <= 1 {
+		for _, group := range groups {
+			for _, k := range group {
+				evRoomNID, stored, ok := persistEvent(ctx, db, querier, pass[k], fetchAuthEvents)
+				if !ok {
+					continue
+				}
+				*roomNID = evRoomNID
+				events[indexes[k]] = stored.PDU
+				backfilledEventMap[stored.EventID()] = stored
+			}
 		}
+		return
+	}
 
-		eventStateKeyNID, err := db.GetOrCreateEventStateKeyNID(ctx, ev.StateKey())
-		if err != nil {
-			logrus.WithError(err).Error("failed to get or create eventStateKey NID")
-			continue
+	// The auth event fetcher isn't safe to call concurrently.
+	if fetchAuthEvents != nil {
+		var fetchMu sync.Mutex
+		fetch := fetchAuthEvents
+		fetchAuthEvents = func(authEventIDs []string) {
+			fetchMu.Lock()
+			defer fetchMu.Unlock()
+			fetch(authEventIDs)
+		}
+	}
+	var mu sync.Mutex
+	sem := make(chan struct{}, concurrency)
+	for _, group := range groups {
+		var wg sync.WaitGroup
+		for _, k := range group {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(k int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				evRoomNID, stored, ok := persistEvent(ctx, db, querier, pass[k], fetchAuthEvents)
+				if !ok {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				*roomNID = evRoomNID
+				events[indexes[k]] = stored.PDU
+				backfilledEventMap[stored.EventID()] = stored
+			}(k)
+		}
+		wg.Wait()
+	}
+}
+
+// dependencyGroups splits the events into groups which can be stored in parallel, returning the indexes of the
+// events in each group. Every event is in a later group than the events in the batch it has as auth or prev events.
+func dependencyGroups(events []gomatrixserverlib.PDU) [][]int {
+	indexes := make(map[string]int, len(events))
+	for i, ev := range events {
+		indexes[ev.EventID()] = i
+	}
+	const unvisited, visiting = -1, -2
+	depths := make([]int, len(events))
+	for i := range depths {
+		depths[i] = unvisited
+	}
+	var depthOf func(i int) int
+	depthOf = func(i int) int {
+		switch depths[i] {
+		case unvisited:
+		case visiting: // a cycle, which valid events can't have
+			return 0
+		default:
+			return depths[i]
+		}
+		depths[i] = visiting
+		depth := 0
+		for _, ids := range [][]string{events[i].AuthEventIDs(), events[i].PrevEventIDs()} {
+			for _, id := range ids {
+				if j, ok := indexes[id]; ok && j != i {
+					if d := depthOf(j) + 1; d > depth {
+						depth = d
+					}
+				}
+			}
 		}
+		depths[i] = depth
+		return depth
+	}
+	var groups [][]int
+	for i := range events {
+		depth := depthOf(i)
+		for len(groups) <= depth {
+			groups = append(groups, nil)
+		}
+		groups[depth] = append(groups[depth], i)
+	}
+	return groups
+}
 
-		eventNID, _, err = db.StoreEvent(ctx, ev, roomInfo, eventTypeNID, eventStateKeyNID, authNids, false)
+// persistEvent stores a single backfilled event, returning the stored event, which may have been redacted as a result
+// of storing it, and false if it couldn't be stored.
+func persistEvent(
+	ctx context.Context, db storage.Database, querier api.QuerySenderIDAPI, ev gomatrixserverlib.PDU,
+	fetchAuthEvents func(authEventIDs []string),
+) (types.RoomNID, types.Event, bool) {
+	nidMap, err := db.EventNIDs(ctx, ev.AuthEventIDs())
+	if err != nil { // this shouldn't happen as RequestBackfill already found them
+		logrus.WithError(err).WithField("auth_events", ev.AuthEventIDs()).Error("Failed to find one or more auth events")
+		return 0, types.Event{}, false
+	}
+	if missing := missingEventIDs(ev.AuthEventIDs(), nidMap); len(missing) > 0 && fetchAuthEvents != nil {
+		// the auth events weren't delivered along with this event, so try to get them before giving up
+		fetchAuthEvents(missing)
+		nidMap, err = db.EventNIDs(ctx, ev.AuthEventIDs())
 		if err != nil {
-			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to persist event")
-			continue
+			logrus.WithError(err).WithField("auth_events", ev.AuthEventIDs()).Error("Failed to find one or more auth events")
+			return 0, types.Event{}, false
 		}
+		if missing = missingEventIDs(ev.AuthEventIDs(), nidMap); len(missing) > 0 {
+			logrus.WithField("event_id", ev.EventID()).WithField("auth_events", missing).Warn("Failed to fetch one or more missing auth events")
+		}
+	}
+	authNids := make([]types.EventNID, len(nidMap))
+	i := 0
+	for _, nid := range nidMap {
+		authNids[i] = nid.EventNID
+		i++
+	}
+
+	roomInfo, err := db.GetOrCreateRoomInfo(ctx, ev)
+	if err != nil {
+		logrus.WithError(err).Error("failed to get or create roomNID")
+		return 0, types.Event{}, false
+	}
+
+	eventTypeNID, err := db.GetOrCreateEventTypeNID(ctx, ev.Type())
+	if err != nil {
+		logrus.WithError(err).Error("failed to get or create eventType NID")
+		return 0, types.Event{}, false
+	}
+
+	eventStateKeyNID, err := db.GetOrCreateEventStateKeyNID(ctx, ev.StateKey())
+	if err != nil {
+		logrus.WithError(err).Error("failed to get or create eventStateKey NID")
+		return 0, types.Event{}, false
+	}
+
+	eventNID, _, err := db.StoreEvent(ctx, ev, roomInfo, eventTypeNID, eventStateKeyNID, authNids, false)
+	if err != nil {
+		logrus.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to persist event")
+		return 0, types.Event{}, false
+	}
 
+	// Redactions are applied once the state before them is known, as the power levels at the redaction decide
+	// whether it is allowed, so only check whether this event has been redacted already.
+	if !isRedaction(ev) {
 		resolver := state.NewStateResolution(db, roomInfo, querier)
 
 		_, redactedEvent, err := db.MaybeRedactEvent(ctx, roomInfo, eventNID, ev, &resolver, querier)
 		if err != nil {
 			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to redact event")
-			continue
+			return 0, types.Event{}, false
 		}
 		// If storing this event results in it being redacted, then do so.
-		// It's also possible for this event to be a redaction which results in another event being
-		// redacted, which we don't care about since we aren't returning it in this backfill.
 		if redactedEvent != nil && redactedEvent.EventID() == ev.EventID() {
 			ev = redactedEvent
-			events[j] = ev
 		}
-		backfilledEventMap[ev.EventID()] = types.Event{
-			EventNID: eventNID,
-			PDU:      ev,
+	}
+	return roomInfo.RoomNID, types.Event{
+		EventNID: eventNID,
+		PDU:      ev,
+	}, true
+}
+
+// missingEventIDs returns the event IDs which aren't in nidMap.
+func missingEventIDs(eventIDs []string, nidMap map[string]types.EventMetadata) []string {
+	var missing []string
+	for _, id := range eventIDs {
+		if _, ok := nidMap[id]; !ok {
+			missing = append(missing, id)
 		}
 	}
-	return roomNID, backfilledEventMap
+	return missing
 }
@@ -0,0 +1,86 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// backfillAborts tracks the backfills in flight for each room, so that they can be aborted.
+// The zero value is ready to use, and it is safe for concurrent use.
+type backfillAborts struct {
+	mu       sync.Mutex
+	inFlight map[string]map[*inFlightBackfill]struct{}
+}
+
+type inFlightBackfill struct {
+	cancel context.CancelCauseFunc
+}
+
+// track registers a backfill of the room, returning a context which is cancelled if the backfill is aborted
+// and a function to call with the result of the backfill once it has finished. That function returns
+// api.ErrBackfillAborted instead if the backfill was aborted.
+func (a *backfillAborts) track(ctx context.Context, roomID string) (context.Context, func(error) error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	backfill := &inFlightBackfill{cancel: cancel}
+	a.mu.Lock()
+	if a.inFlight == nil {
+		a.inFlight = make(map[string]map[*inFlightBackfill]struct{})
+	}
+	if a.inFlight[roomID] == nil {
+		a.inFlight[roomID] = make(map[*inFlightBackfill]struct{})
+	}
+	a.inFlight[roomID][backfill] = struct{}{}
+	a.mu.Unlock()
+
+	return ctx, func(err error) error {
+		a.mu.Lock()
+		delete(a.inFlight[roomID], backfill)
+		if len(a.inFlight[roomID]) == 0 {
+			delete(a.inFlight, roomID)
+		}
+		a.mu.Unlock()
+
+		var aborted api.ErrBackfillAborted
+		if err != nil && errors.As(context.Cause(ctx), &aborted) {
+			err = aborted
+		}
+		cancel(nil)
+		return err
+	}
+}
+
+// abort cancels the context of every backfill of the room which is in flight, returning how many there were.
+func (a *backfillAborts) abort(roomID string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for backfill := range a.inFlight[roomID] {
+		backfill.cancel(api.ErrBackfillAborted{RoomID: roomID})
+	}
+	return len(a.inFlight[roomID])
+}
+
+// AbortBackfills aborts every backfill of the room which is in flight, returning how many were aborted.
+// The aborted backfills return api.ErrBackfillAborted. An abort can interrupt persisting the events, which
+// stores each event before the state before it, so an event may be left stored without its state. The backward
+// extremities of the room are only moved once the state is stored though, so the next backfill of the room
+// fetches such events again and stores the state before them.
+func (r *Backfiller) AbortBackfills(roomID string) int {
+	return r.aborts.abort(roomID)
+}
@@ -0,0 +1,118 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// backfillResultCache remembers the responses of recent backfills for a short time, so that clients
+// which retry a failed pagination straight away don't make us backfill the same events again.
+// It is safe for concurrent use.
+type backfillResultCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]backfillResultCacheEntry
+	now     func() time.Time
+}
+
+type backfillResultCacheEntry struct {
+	res     api.PerformBackfillResponse
+	expires time.Time
+}
+
+func newBackfillResultCache(ttl time.Duration, size int) *backfillResultCache {
+	return &backfillResultCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]backfillResultCacheEntry, size),
+		now:     time.Now,
+	}
+}
+
+// backfillResultCacheKey returns the key to cache the response to the given request under. Everything
+// which can change the response is part of the key, and the order of the prev events doesn't matter.
+func backfillResultCacheKey(req *api.PerformBackfillRequest) string {
+	prevEventIDs := req.PrevEventIDs()
+	sort.Strings(prevEventIDs)
+	return fmt.Sprintf("%s|%s|%s|%d|%t|%s", req.RoomID, req.ServerName, req.VirtualHost, req.Limit, req.TargetGap != nil, strings.Join(prevEventIDs, ","))
+}
+
+// get returns a copy of the cached response for the key, if there is one which hasn't expired.
+func (c *backfillResultCache) get(key string) (*api.PerformBackfillResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return copyBackfillResponse(&entry.res), true
+}
+
+// put caches a copy of the response for the key. If the cache is full, expired entries are removed
+// first and then the entry which would expire soonest.
+func (c *backfillResultCache) put(key string, res *api.PerformBackfillResponse) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		var oldestKey string
+		var oldest time.Time
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldestKey == "" || entry.expires.Before(oldest) {
+				oldestKey, oldest = k, entry.expires
+			}
+		}
+		if len(c.entries) >= c.size {
+			delete(c.entries, oldestKey)
+		}
+	}
+	c.entries[key] = backfillResultCacheEntry{
+		res:     *copyBackfillResponse(res),
+		expires: now.Add(c.ttl),
+	}
+}
+
+// copyBackfillResponse copies the response, so that callers sorting or appending to the events
+// of a cached response don't affect anyone else.
+func copyBackfillResponse(res *api.PerformBackfillResponse) *api.PerformBackfillResponse {
+	return &api.PerformBackfillResponse{
+		Events:            append([]*types.HeaderedEvent(nil), res.Events...),
+		HistoryVisibility: res.HistoryVisibility,
+		RecoveredEventIDs: append([]string(nil), res.RecoveredEventIDs...),
+		Checkpoint:        res.Checkpoint,
+		RedactedEventIDs:  append([]string(nil), res.RedactedEventIDs...),
+		ReachedRoomStart:  res.ReachedRoomStart,
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// ExportBackfill backfills up to limit events before the backward extremities of the room from federation as a
+// dry run, and writes them along with the state before them to w instead of persisting them. The export is
+// newline-delimited JSON with one api.ExportedBackfillEvent per line, oldest event first. Returns how many
+// events were exported.
+func (r *Backfiller) ExportBackfill(ctx context.Context, roomID string, virtualHost spec.ServerName, limit int, w io.Writer) (int, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return 0, err
+	}
+	if info == nil || info.IsStub() {
+		return 0, fmt.Errorf("ExportBackfill: missing room info for room %s", roomID)
+	}
+	bwExtrems, err := r.DB.BackwardExtremitiesForRoom(ctx, info.RoomNID)
+	if err != nil {
+		return 0, fmt.Errorf("ExportBackfill: failed to get backward extremities: %w", err)
+	}
+	if len(bwExtrems) == 0 {
+		// We have the whole history of the room, so there is nothing to backfill.
+		return 0, nil
+	}
+
+	req := api.PerformBackfillRequest{
+		RoomID:               roomID,
+		BackwardsExtremities: bwExtrems,
+		Limit:                limit,
+		ServerName:           virtualHost,
+		VirtualHost:          virtualHost,
+		DryRun:               true,
+	}
+	var res api.PerformBackfillResponse
+	if err = r.PerformBackfill(ctx, &req, &res); err != nil {
+		return 0, err
+	}
+
+	events := make([]gomatrixserverlib.PDU, len(res.Events))
+	for i := range res.Events {
+		events[i] = res.Events[i].PDU
+	}
+	events = gomatrixserverlib.ReverseTopologicalOrdering(events, gomatrixserverlib.TopologicalOrderByPrevEvents)
+	enc := json.NewEncoder(w)
+	for i, ev := range events {
+		stateBeforeIDs := res.BeforeStateIDs[ev.EventID()]
+		if stateBeforeIDs == nil {
+			stateBeforeIDs = []string{}
+		}
+		if err = enc.Encode(api.ExportedBackfillEvent{
+			EventID:        ev.EventID(),
+			RoomVersion:    ev.Version(),
+			Event:          ev.JSON(),
+			StateBeforeIDs: stateBeforeIDs,
+		}); err != nil {
+			return i, fmt.Errorf("ExportBackfill: failed to write event %s: %w", ev.EventID(), err)
+		}
+	}
+	return len(events), nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var backfillPurgedEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_purged_events",
+		Help:      "Number of events dropped during backfill because they were from before the room was purged",
+	},
+	[]string{"room_id"},
+)
+
+func init() {
+	prometheus.MustRegister(backfillPurgedEvents)
+}
+
+// eventsAfterPurgeHorizon returns the events which are from after the purge horizon of the room. Other servers
+// still have the history which was purged, so without this backfill would bring it back. Only the timeline is
+// filtered: the state and auth events of the room are still needed regardless of when they were sent.
+func (r *Backfiller) eventsAfterPurgeHorizon(ctx context.Context, roomID string, events []gomatrixserverlib.PDU) []gomatrixserverlib.PDU {
+	horizon, err := r.DB.PurgeHorizon(ctx, roomID)
+	if err != nil {
+		// Fail closed, as persisting purged history can't be undone without purging the room again.
+		util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("failed to get the purge horizon, dropping backfilled events")
+		return events[:0]
+	}
+	if horizon == nil {
+		return events
+	}
+	after := events[:0]
+	for _, ev := range events {
+		if horizon.Before(ev) {
+			util.GetLogger(ctx).WithFields(logrus.Fields{
+				"room_id":  roomID,
+				"event_id": ev.EventID(),
+				"depth":    ev.Depth(),
+			}).Debug("dropping backfilled event from before the purge horizon")
+			backfillPurgedEvents.WithLabelValues(roomID).Inc()
+			continue
+		}
+		after = append(after, ev)
+	}
+	return after
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"sync"
+	"time"
+)
+
+// maxBackfillIntervals is how many rooms backfillIntervals remembers the last backfill of.
+const maxBackfillIntervals = 10000
+
+// backfillIntervals remembers when each room was last backfilled from federation, so that the same room isn't
+// backfilled again too soon. The zero value is ready to use, and it is safe for concurrent use.
+type backfillIntervals struct {
+	mu      sync.Mutex
+	started map[string]time.Time
+	now     func() time.Time
+}
+
+// claim records that a backfill of the room is starting, unless the last one started less than interval ago, in which
+// case it returns how long it will be until the room can be backfilled again and false. An interval of 0 or less
+// always allows the backfill. The returned function forgets the claim, for backfills which fail, so that they don't
+// hold up the next backfill of the room.
+func (b *backfillIntervals) claim(roomID string, interval time.Duration) (func(), time.Duration, bool) {
+	if interval <= 0 {
+		return func() {}, 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if b.now != nil {
+		now = b.now()
+	}
+	if b.started == nil {
+		b.started = make(map[string]time.Time)
+	}
+	if last, ok := b.started[roomID]; ok {
+		if wait := last.Add(interval).Sub(now); wait > 0 {
+			return nil, wait, false
+		}
+	} else if len(b.started) >= maxBackfillIntervals {
+		// Rooms whose interval has passed don't need remembering, and if there are none then forget any room.
+		for forget, last := range b.started {
+			if !now.Before(last.Add(interval)) {
+				delete(b.started, forget)
+			}
+		}
+		for forget := range b.started {
+			if len(b.started) < maxBackfillIntervals {
+				break
+			}
+			delete(b.started, forget)
+		}
+	}
+	b.started[roomID] = now
+	return func() { b.release(roomID, now) }, 0, true
+}
+
+// release forgets the claim on the room which was made at started, unless another has been made since.
+func (b *backfillIntervals) release(roomID string, started time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if last, ok := b.started[roomID]; ok && last.Equal(started) {
+		delete(b.started, roomID)
+	}
+}
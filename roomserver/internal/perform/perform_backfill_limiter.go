@@ -0,0 +1,89 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// serverLimiter caps how many federation requests can be in flight to each server at once, across every
+// backfill, so that backfilling lots of rooms doesn't overwhelm popular servers. A nil limiter allows any
+// number of requests. It is safe for concurrent use.
+type serverLimiter struct {
+	max   int
+	mu    sync.Mutex
+	slots map[spec.ServerName]chan struct{}
+}
+
+func newServerLimiter(max int) *serverLimiter {
+	return &serverLimiter{
+		max:   max,
+		slots: make(map[spec.ServerName]chan struct{}),
+	}
+}
+
+// acquire waits until a request may be made to the server, returning a function to call once the request
+// has finished. It returns an error instead if the context is done first.
+func (l *serverLimiter) acquire(ctx context.Context, server spec.ServerName) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	slots, ok := l.slots[server]
+	if !ok {
+		slots = make(chan struct{}, l.max)
+		l.slots[server] = slots
+	}
+	l.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// limitedStateClient makes the /state and /state_ids requests of a backfill, waiting for the
+// server limiter first.
+type limitedStateClient struct {
+	b *backfillRequester
+}
+
+func (c limitedStateClient) LookupState(
+	ctx context.Context, origin, s spec.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.StateResponse, error) {
+	release, err := c.b.limiter.acquire(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.b.fsAPI.LookupState(ctx, origin, s, roomID, eventID, roomVersion)
+}
+
+func (c limitedStateClient) LookupStateIDs(
+	ctx context.Context, origin, s spec.ServerName, roomID, eventID string,
+) (gomatrixserverlib.StateIDResponse, error) {
+	release, err := c.b.limiter.acquire(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.b.fsAPI.LookupStateIDs(ctx, origin, s, roomID, eventID)
+}
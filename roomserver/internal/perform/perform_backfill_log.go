@@ -0,0 +1,86 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// Classes of backfill failure which are logged at most once per interval for each server.
+const (
+	failureRequestBackfill = "request_backfill"
+	failureGetEvent        = "get_event"
+	failureLoadEvent       = "load_event"
+	failureServerLimit     = "server_limit"
+)
+
+// failureLog limits how often the same class of failure involving the same server is logged, so that the logs
+// stay useful when federation is broadly down rather than repeating the same line for every room. A nil
+// *failureLog logs every failure. It is safe for concurrent use.
+type failureLog struct {
+	interval   time.Duration
+	mu         sync.Mutex
+	logged     map[failureLogKey]time.Time
+	suppressed map[failureLogKey]int
+	now        func() time.Time
+}
+
+type failureLogKey struct {
+	server spec.ServerName
+	class  string
+}
+
+func newFailureLog(interval time.Duration) *failureLog {
+	return &failureLog{
+		interval:   interval,
+		logged:     make(map[failureLogKey]time.Time),
+		suppressed: make(map[failureLogKey]int),
+		now:        time.Now,
+	}
+}
+
+// entry returns the logger to log a failure of the given class involving the server with, and false if the
+// failure shouldn't be logged because the same failure was logged too recently. The returned logger counts
+// how many failures were suppressed since the last one was logged.
+func (l *failureLog) entry(logger *logrus.Entry, server spec.ServerName, class string) (*logrus.Entry, bool) {
+	if l == nil {
+		return logger, true
+	}
+	key := failureLogKey{server: server, class: class}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if last, ok := l.logged[key]; ok && now.Sub(last) < l.interval {
+		l.suppressed[key]++
+		return nil, false
+	}
+	// Forget failures which haven't happened for a while, so that the maps don't grow with every server we
+	// have ever failed to reach.
+	for k, last := range l.logged {
+		if now.Sub(last) >= l.interval && l.suppressed[k] == 0 {
+			delete(l.logged, k)
+		}
+	}
+	l.logged[key] = now
+	if suppressed := l.suppressed[key]; suppressed > 0 {
+		delete(l.suppressed, key)
+		return logger.WithField("suppressed", suppressed), true
+	}
+	return logger, true
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import "container/list"
+
+// eventLRU maps event IDs to values, forgetting the least recently used entries once it holds more than its
+// limit, so that long backfills don't hold the whole history they walked in memory. Pinned entries aren't
+// forgotten until they are unpinned, so it can briefly hold more than its limit. A limit of 0 means no limit.
+// It isn't safe for concurrent use.
+type eventLRU[V any] struct {
+	limit   int
+	entries map[string]*list.Element
+	order   *list.List // of *eventLRUEntry[V], most recently used first
+	pinned  map[string]bool
+	evicted int
+}
+
+type eventLRUEntry[V any] struct {
+	eventID string
+	value   V
+}
+
+func newEventLRU[V any](limit int) *eventLRU[V] {
+	return &eventLRU[V]{
+		limit:   limit,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		pinned:  make(map[string]bool),
+	}
+}
+
+// get returns the value for the event ID, marking it as recently used.
+func (m *eventLRU[V]) get(eventID string) (V, bool) {
+	elem, ok := m.entries[eventID]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	m.order.MoveToFront(elem)
+	return elem.Value.(*eventLRUEntry[V]).value, true
+}
+
+// set stores the value for the event ID, marking it as recently used, and forgets the least recently used
+// entries which aren't pinned if there are too many.
+func (m *eventLRU[V]) set(eventID string, value V) {
+	if elem, ok := m.entries[eventID]; ok {
+		elem.Value.(*eventLRUEntry[V]).value = value
+		m.order.MoveToFront(elem)
+		return
+	}
+	m.entries[eventID] = m.order.PushFront(&eventLRUEntry[V]{eventID: eventID, value: value})
+	m.evict()
+}
+
+// pin stops the event ID from being forgotten until unpinAll is called, whether it is stored yet or not.
+func (m *eventLRU[V]) pin(eventID string) {
+	m.pinned[eventID] = true
+}
+
+// unpinAll lets all entries be forgotten again, forgetting any which are over the limit.
+func (m *eventLRU[V]) unpinAll() {
+	m.pinned = make(map[string]bool)
+	m.evict()
+}
+
+func (m *eventLRU[V]) len() int {
+	return len(m.entries)
+}
+
+func (m *eventLRU[V]) evict() {
+	if m.limit <= 0 {
+		return
+	}
+	for elem := m.order.Back(); elem != nil && len(m.entries) > m.limit; {
+		prev := elem.Prev()
+		if eventID := elem.Value.(*eventLRUEntry[V]).eventID; !m.pinned[eventID] {
+			m.order.Remove(elem)
+			delete(m.entries, eventID)
+			m.evicted++
+		}
+		elem = prev
+	}
+}
+
+// limitEvents limits how many events, and how many sets of state before events, the requester remembers.
+func (b *backfillRequester) limitEvents(limit int) {
+	b.eventIDMap.limit = limit
+	b.eventIDToBeforeStateIDs.limit = limit
+}
+
+// unpinEvents lets the events which were being backfilled be forgotten, once they have been persisted.
+func (b *backfillRequester) unpinEvents() {
+	b.eventIDMap.unpinAll()
+	b.eventIDToBeforeStateIDs.unpinAll()
+}
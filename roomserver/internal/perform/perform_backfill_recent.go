@@ -0,0 +1,56 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// maxRecentServers is how many rooms recentServers remembers a server for.
+const maxRecentServers = 10000
+
+// recentServers remembers the server which most recently provided history of each room, as it is likely to
+// still have the history before that and be reachable. The zero value is ready to use, and it is safe for
+// concurrent use.
+type recentServers struct {
+	mu      sync.Mutex
+	servers map[string]spec.ServerName
+}
+
+// get returns the server which most recently provided history of the room, or an empty string if none has.
+func (s *recentServers) get(roomID string) spec.ServerName {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servers[roomID]
+}
+
+// remember records that the server provided history of the room. If too many rooms are remembered already,
+// another room is forgotten.
+func (s *recentServers) remember(roomID string, server spec.ServerName) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.servers == nil {
+		s.servers = make(map[string]spec.ServerName)
+	}
+	if _, ok := s.servers[roomID]; !ok && len(s.servers) >= maxRecentServers {
+		for forget := range s.servers {
+			delete(s.servers, forget)
+			break
+		}
+	}
+	s.servers[roomID] = server
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+)
+
+// relayFederationAPI sends the federation requests made while backfilling to the server they are meant for, and
+// only if that fails sends them to a relay server instead, which answers them on our behalf. Events are still
+// verified against the signatures of the servers which sent them, so the relay can't forge events, although it
+// could withhold them. The relay isn't told which server a request was meant for, so the same request meant for
+// different servers is only sent to the relay once, and later ones get the same response. A relayFederationAPI
+// is used for a single backfill, so that the responses of the relay aren't reused by later backfills.
+type relayFederationAPI struct {
+	federationAPI.RoomserverFederationAPI
+	relay   spec.ServerName
+	limiter *serverLimiter
+
+	mu      sync.Mutex
+	relayed map[string]*relayedRequest
+}
+
+// relayedRequest is a request sent to the relay, and its response once done is closed.
+type relayedRequest struct {
+	done chan struct{}
+	res  interface{}
+	err  error
+}
+
+// viaRelay makes the request with do, first to the server s it is meant for, then if that fails to the relay,
+// waiting for the server limiter of the relay first. Requests with the same key are only sent to the relay once.
+func (f *relayFederationAPI) viaRelay(
+	ctx context.Context, s spec.ServerName, key string, do func(server spec.ServerName) (interface{}, error),
+) (interface{}, error) {
+	res, err := do(s)
+	if err == nil || s == f.relay || ctx.Err() != nil {
+		return res, err
+	}
+	f.mu.Lock()
+	req, sent := f.relayed[key]
+	if !sent {
+		req = &relayedRequest{done: make(chan struct{})}
+		f.relayed[key] = req
+	}
+	f.mu.Unlock()
+	if sent {
+		select {
+		case <-req.done:
+			return req.res, req.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	defer close(req.done)
+	release, err := f.limiter.acquire(ctx, f.relay)
+	if err != nil {
+		req.err = err
+		return nil, err
+	}
+	defer release()
+	req.res, req.err = do(f.relay)
+	return req.res, req.err
+}
+
+func (f *relayFederationAPI) Backfill(
+	ctx context.Context, origin, s spec.ServerName, roomID string, limit int, eventIDs []string,
+) (gomatrixserverlib.Transaction, error) {
+	key := fmt.Sprintf("backfill %s %s %d %s", origin, roomID, limit, strings.Join(eventIDs, ","))
+	res, err := f.viaRelay(ctx, s, key, func(server spec.ServerName) (interface{}, error) {
+		return f.RoomserverFederationAPI.Backfill(ctx, origin, server, roomID, limit, eventIDs)
+	})
+	tx, _ := res.(gomatrixserverlib.Transaction)
+	return tx, err
+}
+
+func (f *relayFederationAPI) GetEvent(
+	ctx context.Context, origin, s spec.ServerName, eventID string,
+) (gomatrixserverlib.Transaction, error) {
+	key := fmt.Sprintf("event %s %s", origin, eventID)
+	res, err := f.viaRelay(ctx, s, key, func(server spec.ServerName) (interface{}, error) {
+		return f.RoomserverFederationAPI.GetEvent(ctx, origin, server, eventID)
+	})
+	tx, _ := res.(gomatrixserverlib.Transaction)
+	return tx, err
+}
+
+func (f *relayFederationAPI) LookupState(
+	ctx context.Context, origin, s spec.ServerName, roomID, eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (gomatrixserverlib.StateResponse, error) {
+	key := fmt.Sprintf("state %s %s %s", origin, roomID, eventID)
+	res, err := f.viaRelay(ctx, s, key, func(server spec.ServerName) (interface{}, error) {
+		return f.RoomserverFederationAPI.LookupState(ctx, origin, server, roomID, eventID, roomVersion)
+	})
+	state, _ := res.(gomatrixserverlib.StateResponse)
+	return state, err
+}
+
+func (f *relayFederationAPI) LookupStateIDs(
+	ctx context.Context, origin, s spec.ServerName, roomID, eventID string,
+) (gomatrixserverlib.StateIDResponse, error) {
+	key := fmt.Sprintf("state_ids %s %s %s", origin, roomID, eventID)
+	res, err := f.viaRelay(ctx, s, key, func(server spec.ServerName) (interface{}, error) {
+		return f.RoomserverFederationAPI.LookupStateIDs(ctx, origin, server, roomID, eventID)
+	})
+	stateIDs, _ := res.(gomatrixserverlib.StateIDResponse)
+	return stateIDs, err
+}
+
+func (f *relayFederationAPI) LookupMissingEvents(
+	ctx context.Context, origin, s spec.ServerName, roomID string, missing fclient.MissingEvents, roomVersion gomatrixserverlib.RoomVersion,
+) (fclient.RespMissingEvents, error) {
+	key := fmt.Sprintf("get_missing_events %s %s %d %s %s", origin, roomID, missing.Limit,
+		strings.Join(missing.EarliestEvents, ","), strings.Join(missing.LatestEvents, ","))
+	res, err := f.viaRelay(ctx, s, key, func(server spec.ServerName) (interface{}, error) {
+		return f.RoomserverFederationAPI.LookupMissingEvents(ctx, origin, server, roomID, missing, roomVersion)
+	})
+	missingEvents, _ := res.(fclient.RespMissingEvents)
+	return missingEvents, err
+}
+
+// federation returns the federation API for a single backfill to use, which falls back to sending requests
+// through the relay server if one is configured.
+func (r *Backfiller) federation() federationAPI.RoomserverFederationAPI {
+	if r.RelayServer == "" {
+		return r.FSAPI
+	}
+	return &relayFederationAPI{
+		RoomserverFederationAPI: r.FSAPI,
+		relay:                   r.RelayServer,
+		limiter:                 r.serverLimiter(),
+		relayed:                 make(map[string]*relayedRequest),
+	}
+}
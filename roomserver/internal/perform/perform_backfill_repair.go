@@ -0,0 +1,130 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// RepairState works out the state before each of the given events of the room again, by asking the servers
+// currently in the room for it with /state_ids, and replaces the state we stored before them. This repairs events
+// whose state was stored incorrectly, for example because a server returned bad /state_ids during a backfill.
+// State events which we don't have are fetched. Returns the IDs of the events whose state was replaced. Events
+// which no server would tell us the state before are left alone.
+func (r *Backfiller) RepairState(ctx context.Context, roomID string, virtualHost spec.ServerName, eventIDs []string) ([]string, error) {
+	if len(eventIDs) == 0 {
+		return nil, fmt.Errorf("RepairState: no event IDs given for room %s", roomID)
+	}
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.IsStub() {
+		return nil, fmt.Errorf("RepairState: missing room info for room %s", roomID)
+	}
+	if _, err = gomatrixserverlib.GetRoomVersion(info.RoomVersion); err != nil {
+		return nil, api.ErrUnsupportedRoomVersion{RoomID: roomID, RoomVersion: info.RoomVersion}
+	}
+	events, err := r.DB.EventsFromIDs(ctx, info, eventIDs)
+	if err != nil {
+		return nil, fmt.Errorf("RepairState: failed to load events: %w", err)
+	}
+	found := make(map[string]bool, len(events))
+	for _, ev := range events {
+		if ev.RoomID().String() != roomID {
+			return nil, fmt.Errorf("RepairState: event %s is not in room %s", ev.EventID(), roomID)
+		}
+		found[ev.EventID()] = true
+	}
+	for _, eventID := range eventIDs {
+		if !found[eventID] {
+			return nil, fmt.Errorf("RepairState: event %s is not known", eventID)
+		}
+	}
+
+	joinedServers, err := r.DB.GetJoinedServerNamesInRoom(ctx, info.RoomNID)
+	if err != nil {
+		return nil, fmt.Errorf("RepairState: failed to get joined servers: %w", err)
+	}
+	requester := r.newRequester(roomID, virtualHost, nil, info.RoomVersion)
+	serverSet := make(map[spec.ServerName]bool, len(joinedServers))
+	for _, server := range joinedServers {
+		serverSet[server] = true
+	}
+	requester.servers = requester.orderServers(serverSet)
+
+	repaired := make([]string, 0, len(events))
+	for _, ev := range events {
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id":  roomID,
+			"event_id": ev.EventID(),
+		})
+		stateIDs, err := requester.remoteStateIDsBeforeEvent(ctx, ev.PDU)
+		if err != nil {
+			logger.WithError(err).Warn("RepairState: failed to get the state before the event")
+			continue
+		}
+		var entries []types.StateEntry
+		if entries, err = r.DB.StateEntriesForEventIDs(ctx, stateIDs, true); err != nil {
+			r.fetchAndStoreMissingEvents(ctx, info.RoomVersion, requester, stateIDs, virtualHost)
+			if entries, err = r.DB.StateEntriesForEventIDs(ctx, stateIDs, true); err != nil {
+				logger.WithError(err).Warn("RepairState: failed to get the state events before the event")
+				continue
+			}
+		}
+		// add the state and point the event at it atomically, so that a failure doesn't orphan the snapshot
+		if _, err = r.DB.AddAndSetState(ctx, info.RoomNID, ev.EventNID, nil, entries); err != nil {
+			return repaired, fmt.Errorf("RepairState: failed to store the state before event %s: %w", ev.EventID(), err)
+		}
+		repaired = append(repaired, ev.EventID())
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":             roomID,
+		"federation_requests": requester.federationRequests,
+	}).Infof("Repaired the state before %d of %d events", len(repaired), len(eventIDs))
+	return repaired, nil
+}
+
+// remoteStateIDsBeforeEvent asks the servers for the state before the event with /state_ids. Unlike
+// StateIDsBeforeEvent, this never works the state out from what we have stored, as that may be what is wrong.
+func (b *backfillRequester) remoteStateIDsBeforeEvent(ctx context.Context, targetEvent gomatrixserverlib.PDU) ([]string, error) {
+	var lastErr error
+	for _, srv := range b.servers {
+		if !b.allowFederationRequest() {
+			return nil, errFederationRequestLimit
+		}
+		start := time.Now()
+		ids, err := b.stateProvider(srv).StateIDsBeforeEvent(ctx, targetEvent)
+		b.observeLatency(srv, start)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return ids, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no servers to request /state_ids at event %s from", targetEvent.EventID())
+	}
+	return nil, lastErr
+}
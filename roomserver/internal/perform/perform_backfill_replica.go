@@ -0,0 +1,101 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+var backfillReplicaFallbacks = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_replica_fallbacks",
+		Help:      "Number of backfill reads which were retried against the primary database because the read replica couldn't serve them",
+	},
+	[]string{"method"},
+)
+
+func init() {
+	prometheus.MustRegister(backfillReplicaFallbacks)
+}
+
+// readDB returns the database backfills read the history of rooms from, which is only ever read from.
+func (r *Backfiller) readDB() storage.Database {
+	if r.ReadDB == nil {
+		return r.DB
+	}
+	return replicaDatabase{Database: r.DB, replica: r.ReadDB}
+}
+
+// replicaDatabase serves the reads backfill makes most often from a read replica, falling back to the primary
+// database when the replica fails or doesn't have everything asked for, as it can lag behind the primary. Everything
+// else, including all writes, goes to the primary database.
+type replicaDatabase struct {
+	storage.Database
+	replica storage.Database
+}
+
+func (d replicaDatabase) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	info, err := d.replica.RoomInfo(ctx, roomID)
+	if err == nil && info != nil && !info.IsStub() {
+		return info, nil
+	}
+	backfillReplicaFallbacks.WithLabelValues("RoomInfo").Inc()
+	return d.Database.RoomInfo(ctx, roomID)
+}
+
+func (d replicaDatabase) EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventMetadata, error) {
+	nids, err := d.replica.EventNIDs(ctx, eventIDs)
+	if err == nil && len(nids) == distinctEventIDs(eventIDs) {
+		return nids, nil
+	}
+	backfillReplicaFallbacks.WithLabelValues("EventNIDs").Inc()
+	return d.Database.EventNIDs(ctx, eventIDs)
+}
+
+func (d replicaDatabase) Events(ctx context.Context, roomVersion gomatrixserverlib.RoomVersion, eventNIDs []types.EventNID) ([]types.Event, error) {
+	events, err := d.replica.Events(ctx, roomVersion, eventNIDs)
+	if err == nil && len(events) == len(eventNIDs) {
+		return events, nil
+	}
+	backfillReplicaFallbacks.WithLabelValues("Events").Inc()
+	return d.Database.Events(ctx, roomVersion, eventNIDs)
+}
+
+func (d replicaDatabase) StateEntriesForEventIDs(ctx context.Context, eventIDs []string, excludeRejected bool) ([]types.StateEntry, error) {
+	entries, err := d.replica.StateEntriesForEventIDs(ctx, eventIDs, excludeRejected)
+	if err == nil && len(entries) == distinctEventIDs(eventIDs) {
+		return entries, nil
+	}
+	backfillReplicaFallbacks.WithLabelValues("StateEntriesForEventIDs").Inc()
+	return d.Database.StateEntriesForEventIDs(ctx, eventIDs, excludeRejected)
+}
+
+// distinctEventIDs returns how many different events are asked for, which is how many results a read of them by
+// event ID has when they are all found.
+func distinctEventIDs(eventIDs []string) int {
+	distinct := make(map[string]struct{}, len(eventIDs))
+	for _, id := range eventIDs {
+		distinct[id] = struct{}{}
+	}
+	return len(distinct)
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+var backfillStateResets = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_state_resets",
+		Help:      "Number of backfilled events whose state before them would have reset critical room state",
+	},
+	[]string{"room_id", "event_type"},
+)
+
+// stateResetChecker looks for obvious state resets in the state before backfilled events of a room. A state reset
+// is when the state before an event is missing critical state, or has a different create event to the room. The
+// state before an event must contain an event of each critical type which the event was authorised by. It works from
+// event IDs, so that events can be checked before they are stored.
+type stateResetChecker struct {
+	r        *Backfiller
+	roomID   string
+	info     *types.RoomInfo
+	createID string
+	// find returns events which aren't stored yet, such as the other events being backfilled
+	find func(eventID string) (gomatrixserverlib.PDU, bool)
+	// the type and state key of the events which checks have needed so far, by event ID
+	tuples map[string]gomatrixserverlib.StateKeyTuple
+	// the events which checks have needed that we don't have
+	unknown map[string]bool
+}
+
+// criticalStateTypes are the types of the state which a backfilled event mustn't lose.
+var criticalStateTypes = map[string]bool{
+	spec.MRoomCreate:      true,
+	spec.MRoomPowerLevels: true,
+	spec.MRoomJoinRules:   true,
+}
+
+func (r *Backfiller) newStateResetChecker(
+	ctx context.Context, info *types.RoomInfo, roomID string, find func(eventID string) (gomatrixserverlib.PDU, bool),
+) (*stateResetChecker, error) {
+	create, err := r.DB.GetStateEvent(ctx, roomID, spec.MRoomCreate, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the create event: %w", err)
+	}
+	if create == nil {
+		return nil, fmt.Errorf("no create event in room %s", roomID)
+	}
+	return &stateResetChecker{
+		r:        r,
+		roomID:   roomID,
+		info:     info,
+		createID: create.EventID(),
+		find:     find,
+		tuples: map[string]gomatrixserverlib.StateKeyTuple{
+			create.EventID(): {EventType: spec.MRoomCreate, StateKey: ""},
+		},
+		unknown: map[string]bool{},
+	}, nil
+}
+
+// check returns the type of the critical state which the state before the event, given by stateIDs, would reset,
+// or an empty string if there is no obvious reset. Every reset found is logged and counted.
+func (c *stateResetChecker) check(ctx context.Context, ev gomatrixserverlib.PDU, stateIDs []string) (string, error) {
+	if ev.Type() == spec.MRoomCreate && ev.StateKeyEquals("") {
+		return "", nil
+	}
+	if err := c.lookup(ctx, append(append([]string(nil), stateIDs...), ev.AuthEventIDs()...)); err != nil {
+		return "", err
+	}
+	before := make(map[string]bool, len(criticalStateTypes))
+	for _, id := range stateIDs {
+		if tuple, ok := c.tuples[id]; ok && criticalStateTypes[tuple.EventType] && tuple.StateKey == "" {
+			before[tuple.EventType] = true
+		}
+	}
+
+	reset := ""
+	if !containsString(stateIDs, c.createID) {
+		reset = spec.MRoomCreate
+	} else {
+		// The auth events of a valid event are in the state before it, so an auth event of a critical type means
+		// that the state before must have one too. Auth events we don't have can't be checked.
+		for _, id := range ev.AuthEventIDs() {
+			if tuple, ok := c.tuples[id]; ok && criticalStateTypes[tuple.EventType] && tuple.StateKey == "" && !before[tuple.EventType] {
+				reset = tuple.EventType
+				break
+			}
+		}
+	}
+	if reset == "" {
+		return "", nil
+	}
+
+	backfillStateResets.WithLabelValues(c.roomID, reset).Inc()
+	logrus.WithFields(logrus.Fields{
+		"room_id":    c.roomID,
+		"event_id":   ev.EventID(),
+		"event_type": reset,
+		"enforced":   c.r.RejectStateResets,
+	}).Warn("Backfilled state before event would reset critical room state")
+	return reset, nil
+}
+
+// lookup learns the type and state key of the given events, from find or else the database.
+func (c *stateResetChecker) lookup(ctx context.Context, eventIDs []string) error {
+	var stored []string
+	for _, id := range eventIDs {
+		if _, ok := c.tuples[id]; ok || c.unknown[id] {
+			continue
+		}
+		if ev, ok := c.find(id); ok {
+			c.learn(ev)
+			continue
+		}
+		stored = append(stored, id)
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+	events, err := c.r.DB.EventsFromIDs(ctx, c.info, stored)
+	if err != nil {
+		return fmt.Errorf("failed to get events: %w", err)
+	}
+	for _, ev := range events {
+		if ev.PDU != nil {
+			c.learn(ev.PDU)
+		}
+	}
+	for _, id := range stored {
+		if _, ok := c.tuples[id]; !ok {
+			c.unknown[id] = true
+		}
+	}
+	return nil
+}
+
+func (c *stateResetChecker) learn(ev gomatrixserverlib.PDU) {
+	tuple := gomatrixserverlib.StateKeyTuple{EventType: ev.Type()}
+	if ev.StateKey() != nil {
+		tuple.StateKey = *ev.StateKey()
+	}
+	c.tuples[ev.EventID()] = tuple
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
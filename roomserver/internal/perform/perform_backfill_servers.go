@@ -0,0 +1,140 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// maxRoomServersEntries is how many backfill points roomServersCache remembers the servers at.
+const maxRoomServersEntries = 10000
+
+// roomServersCache remembers the servers which were in a room at the points backfills started from, along with
+// the history visibility there, so that repeated backfills of a room don't load the memberships again. Entries
+// which expired less than a TTL ago can still be used while they are being worked out again. It is safe for
+// concurrent use.
+type roomServersCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	entries    map[string]roomServersEntry
+	refreshing map[string]bool
+	now        func() time.Time
+}
+
+type roomServersEntry struct {
+	servers    map[spec.ServerName]bool
+	visibility gomatrixserverlib.HistoryVisibility
+	expires    time.Time
+}
+
+func newRoomServersCache(ttl time.Duration) *roomServersCache {
+	return &roomServersCache{
+		ttl:        ttl,
+		entries:    make(map[string]roomServersEntry),
+		refreshing: make(map[string]bool),
+		now:        time.Now,
+	}
+}
+
+// roomServersCacheKey returns the key to cache the servers at the event under. The servers we may backfill
+// from depend on which of our servers is asking, whether servers which have left count and whether we fall back
+// to the servers which have been in the room if the history isn't visible to us.
+func roomServersCacheKey(roomID, eventID string, virtualHost spec.ServerName, includeLeft, fallbackToMembers bool) string {
+	return fmt.Sprintf("%s|%s|%s|%t|%t", roomID, eventID, virtualHost, includeLeft, fallbackToMembers)
+}
+
+// get returns the cached entry for the key, if there is one which expired less than a TTL ago, and whether it
+// is still fresh. The servers must not be modified.
+func (c *roomServersCache) get(key string) (entry roomServersEntry, fresh, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok = c.entries[key]
+	if !ok {
+		return entry, false, false
+	}
+	now := c.now()
+	if !now.Before(entry.expires.Add(c.ttl)) {
+		delete(c.entries, key)
+		return roomServersEntry{}, false, false
+	}
+	return entry, now.Before(entry.expires), true
+}
+
+// put caches the servers at the key. If too many are cached already, another entry is forgotten.
+func (c *roomServersCache) put(key string, servers map[spec.ServerName]bool, visibility gomatrixserverlib.HistoryVisibility) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxRoomServersEntries {
+		for forget := range c.entries {
+			delete(c.entries, forget)
+			break
+		}
+	}
+	c.entries[key] = roomServersEntry{
+		servers:    servers,
+		visibility: visibility,
+		expires:    c.now().Add(c.ttl),
+	}
+}
+
+// startRefresh returns true if the caller should work out the servers at the key again, or false if someone
+// else is doing so already. Callers which get true must call endRefresh once they are done.
+func (c *roomServersCache) startRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+func (c *roomServersCache) endRefresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.refreshing, key)
+}
+
+// roomServers returns the cache of the servers in rooms, or nil if they aren't cached.
+func (r *Backfiller) roomServers() *roomServersCache {
+	r.serversOnce.Do(func() {
+		if r.ServersCacheTTL > 0 {
+			r.serversCache = newRoomServersCache(r.ServersCacheTTL)
+		}
+	})
+	return r.serversCache
+}
+
+// refreshServers works out the servers in the room at the event again in the background and caches them, unless
+// that is being done already.
+func (b *backfillRequester) refreshServers(key, roomID, eventID string) {
+	cache := b.serversCache
+	if !cache.startRefresh(key) {
+		return
+	}
+	go func() {
+		defer cache.endRefresh(key)
+		// The backfill which started this may well be over before we are done.
+		if servers, visibility, ok := b.serverSetAtEvent(context.Background(), roomID, eventID); ok {
+			cache.put(key, servers, visibility)
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// How many times a batch of backfilled events is given to the event sink before giving up on it, and how long to
+// wait before the first retry, doubling for each retry after that.
+const (
+	maxEventSinkAttempts   = 3
+	eventSinkRetryInterval = 100 * time.Millisecond
+)
+
+var backfillEventSinkBatches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "backfill_event_sink_batches",
+		Help:      "Number of batches of backfilled events given to the event sink, by whether they were exported, retried or dropped",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(backfillEventSinkBatches)
+}
+
+// EventSink receives the events which backfills have stored, so that they can be mirrored to an external store such
+// as a search index or an archive. It may export them straight away or queue them up to export asynchronously.
+// Events are exported once any redactions of them which were backfilled alongside them have been applied.
+type EventSink interface {
+	// ExportBackfilledEvents exports a batch of stored backfilled events, oldest first. If it returns an error the
+	// whole batch is given to it again, a few times at most, after which the batch is dropped. It may be called
+	// by several backfills at the same time.
+	ExportBackfilledEvents(ctx context.Context, events []*types.HeaderedEvent) error
+}
+
+// exportToSink gives the persisted events to the event sink, if there is one. Failures are retried, but never fail
+// the backfill, as the events have been stored regardless.
+func (r *Backfiller) exportToSink(ctx context.Context, events []gomatrixserverlib.PDU, persisted map[string]types.Event) {
+	if r.EventSink == nil || len(persisted) == 0 {
+		return
+	}
+	ordered := topologicallyOrdered(events, persisted)
+	batch := make([]*types.HeaderedEvent, 0, len(ordered))
+	for _, ev := range ordered {
+		batch = append(batch, &types.HeaderedEvent{PDU: ev.PDU})
+	}
+	wait := eventSinkRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := r.EventSink.ExportBackfilledEvents(ctx, batch)
+		if err == nil {
+			backfillEventSinkBatches.WithLabelValues("exported").Inc()
+			return
+		}
+		logger := util.GetLogger(ctx).WithError(err).WithField("events", len(batch))
+		if attempt >= maxEventSinkAttempts {
+			backfillEventSinkBatches.WithLabelValues("dropped").Inc()
+			logger.Error("Failed to export backfilled events to the event sink, dropping them")
+			return
+		}
+		backfillEventSinkBatches.WithLabelValues("retried").Inc()
+		logger.Warn("Failed to export backfilled events to the event sink, retrying")
+		select {
+		case <-ctx.Done():
+			backfillEventSinkBatches.WithLabelValues("dropped").Inc()
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,3150 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/backfilltest"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func mustCurrentStateEntries(t *testing.T, db storage.Database, room *test.Room) []types.StateEntry {
+	t.Helper()
+	var stateIDs []string
+	for _, ev := range room.CurrentState() {
+		stateIDs = append(stateIDs, ev.EventID())
+	}
+	stateEntries, err := db.StateEntriesForEventIDs(context.Background(), stateIDs, true)
+	if err != nil {
+		t.Fatalf("failed to get state entries: %v", err)
+	}
+	return stateEntries
+}
+
+func TestJoinedServersFromHistoryVisibilityKnockAndRestricted(t *testing.T) {
+	localServer := spec.ServerName("local")
+	remoteServer := spec.ServerName("remote")
+	knockServer := spec.ServerName("knocker")
+
+	alice := test.NewUser(t, test.WithSigningServer(remoteServer, "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t, test.WithSigningServer(localServer, "ed25519:local", test.PrivateKeyB))
+	charlie := test.NewUser(t, test.WithSigningServer(knockServer, "ed25519:knocker", test.PrivateKeyA))
+
+	testCases := []struct {
+		name        string
+		prepareRoom func(t *testing.T) *test.Room
+		// the servers we expect to be returned from the joined members, nil if history shouldn't be visible
+		wantServers []spec.ServerName
+	}{
+		{
+			name: "knock room, local user only knocked",
+			prepareRoom: func(t *testing.T) *test.Room {
+				room := test.NewRoom(t, alice)
+				room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{"join_rule": spec.Knock}, test.WithStateKey(""))
+				room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Knock}, test.WithStateKey(bob.ID))
+				return room
+			},
+		},
+		{
+			name: "knock room, local user knocked and was let in",
+			prepareRoom: func(t *testing.T) *test.Room {
+				room := test.NewRoom(t, alice)
+				room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{"join_rule": spec.Knock}, test.WithStateKey(""))
+				room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Knock}, test.WithStateKey(bob.ID))
+				room.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{"membership": spec.Invite}, test.WithStateKey(bob.ID))
+				room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+				// a remote server which only knocked should not be returned
+				room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Knock}, test.WithStateKey(charlie.ID))
+				return room
+			},
+			wantServers: []spec.ServerName{remoteServer, localServer},
+		},
+		{
+			name: "restricted room, local user joined via allowed condition",
+			prepareRoom: func(t *testing.T) *test.Room {
+				room := test.NewRoom(t, alice)
+				room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+					"join_rule": spec.Restricted,
+					"allow": []map[string]string{
+						{"type": spec.MRoomMembership, "room_id": "!other:remote"},
+					},
+				}, test.WithStateKey(""))
+				room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+					"membership":                       spec.Join,
+					"join_authorised_via_users_server": alice.ID,
+				}, test.WithStateKey(bob.ID))
+				return room
+			},
+			wantServers: []spec.ServerName{remoteServer, localServer},
+		},
+		{
+			name: "restricted room, local user is not a member",
+			prepareRoom: func(t *testing.T) *test.Room {
+				room := test.NewRoom(t, alice)
+				room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+					"join_rule": spec.Restricted,
+					"allow": []map[string]string{
+						{"type": spec.MRoomMembership, "room_id": "!other:remote"},
+					},
+				}, test.WithStateKey(""))
+				return room
+			},
+		},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				db, close := backfilltest.MustCreateDatabase(t, dbType)
+				defer close()
+
+				room := tc.prepareRoom(t)
+				roomInfo := backfilltest.MustStoreEvents(t, db, room, localServer, room.Events())
+				stateEntries := mustCurrentStateEntries(t, db, room)
+
+				gotServers, visibility, err := joinedServersFromHistoryVisibility(context.Background(), db, &backfilltest.Querier{}, room.ID, roomInfo, stateEntries, localServer, false, false)
+				assert.NoError(t, err)
+				assert.Equal(t, gomatrixserverlib.HistoryVisibilityShared, visibility)
+				assert.ElementsMatch(t, tc.wantServers, gotServers)
+			})
+		}
+	})
+}
+
+func TestJoinedServersFromHistoryVisibilityIncludeLeft(t *testing.T) {
+	localServer := spec.ServerName("local")
+	remoteServer := spec.ServerName("remote")
+	leftServer := spec.ServerName("departed")
+
+	alice := test.NewUser(t, test.WithSigningServer(remoteServer, "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t, test.WithSigningServer(localServer, "ed25519:local", test.PrivateKeyB))
+	charlie := test.NewUser(t, test.WithSigningServer(leftServer, "ed25519:departed", test.PrivateKeyA))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, localJoined := range []bool{false, true} {
+			for _, includeLeft := range []bool{false, true} {
+				t.Run(fmt.Sprintf("local joined %v, include left %v", localJoined, includeLeft), func(t *testing.T) {
+					db, close := backfilltest.MustCreateDatabase(t, dbType)
+					defer close()
+
+					room := test.NewRoom(t, alice)
+					room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{"join_rule": spec.Public}, test.WithStateKey(""))
+					room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(charlie.ID))
+					room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Leave}, test.WithStateKey(charlie.ID))
+					if localJoined {
+						room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+					}
+					roomInfo := backfilltest.MustStoreEvents(t, db, room, localServer, room.Events())
+					stateEntries := mustCurrentStateEntries(t, db, room)
+
+					gotServers, _, err := joinedServersFromHistoryVisibility(context.Background(), db, &backfilltest.Querier{}, room.ID, roomInfo, stateEntries, localServer, includeLeft, false)
+					assert.NoError(t, err)
+					// The servers which have left are only included if the history is visible to us.
+					var wantServers []spec.ServerName
+					if localJoined {
+						wantServers = []spec.ServerName{remoteServer, localServer}
+						if includeLeft {
+							wantServers = append(wantServers, leftServer)
+						}
+					}
+					assert.ElementsMatch(t, wantServers, gotServers)
+				})
+			}
+		}
+	})
+}
+
+func TestJoinedServersFromHistoryVisibilityFallbackToMembers(t *testing.T) {
+	localServer := spec.ServerName("local")
+	remoteServer := spec.ServerName("remote")
+	leftServer := spec.ServerName("departed")
+
+	alice := test.NewUser(t, test.WithSigningServer(remoteServer, "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t, test.WithSigningServer(localServer, "ed25519:local", test.PrivateKeyB))
+	charlie := test.NewUser(t, test.WithSigningServer(leftServer, "ed25519:departed", test.PrivateKeyA))
+
+	visibilities := []gomatrixserverlib.HistoryVisibility{
+		gomatrixserverlib.HistoryVisibilityWorldReadable,
+		gomatrixserverlib.HistoryVisibilityShared,
+		gomatrixserverlib.HistoryVisibilityInvited,
+		gomatrixserverlib.HistoryVisibilityJoined,
+	}
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, visibility := range visibilities {
+			for _, fallback := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s, fallback %v", visibility, fallback), func(t *testing.T) {
+					db, close := backfilltest.MustCreateDatabase(t, dbType)
+					defer close()
+
+					// We were in the room, but have since left, as has another server.
+					room := test.NewRoom(t, alice)
+					room.CreateAndInsert(t, alice, spec.MRoomHistoryVisibility, map[string]interface{}{"history_visibility": visibility}, test.WithStateKey(""))
+					room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{"join_rule": spec.Public}, test.WithStateKey(""))
+					room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+					room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(charlie.ID))
+					room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Leave}, test.WithStateKey(charlie.ID))
+					room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Leave}, test.WithStateKey(bob.ID))
+					roomInfo := backfilltest.MustStoreEvents(t, db, room, localServer, room.Events())
+					stateEntries := mustCurrentStateEntries(t, db, room)
+
+					gotServers, gotVisibility, err := joinedServersFromHistoryVisibility(context.Background(), db, &backfilltest.Querier{}, room.ID, roomInfo, stateEntries, localServer, false, fallback)
+					assert.NoError(t, err)
+					// Falling back only changes who we ask, not the visibility which decides what we may serve.
+					assert.Equal(t, visibility, gotVisibility)
+					var wantServers []spec.ServerName
+					switch {
+					case visibility == gomatrixserverlib.HistoryVisibilityWorldReadable:
+						wantServers = []spec.ServerName{remoteServer}
+					case fallback:
+						wantServers = []spec.ServerName{remoteServer, leftServer, localServer}
+					}
+					assert.ElementsMatch(t, wantServers, gotServers)
+				})
+			}
+		}
+	})
+}
+
+func TestJoinedServersFromHistoryVisibilityMembershipAtEvent(t *testing.T) {
+	localServer := spec.ServerName("local")
+	remoteServer := spec.ServerName("remote")
+
+	alice := test.NewUser(t, test.WithSigningServer(remoteServer, "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t, test.WithSigningServer(localServer, "ed25519:local", test.PrivateKeyB))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := backfilltest.MustCreateDatabase(t, dbType)
+		defer close()
+
+		// We are in the room now, but weren't at the time of the message, so the history
+		// before our join must not be visible to us.
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, alice, spec.MRoomHistoryVisibility, map[string]interface{}{"history_visibility": gomatrixserverlib.HistoryVisibilityShared}, test.WithStateKey(""))
+		room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{"join_rule": spec.Public}, test.WithStateKey(""))
+		room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "before bob"})
+		var stateIDs []string
+		for _, ev := range room.CurrentState() {
+			stateIDs = append(stateIDs, ev.EventID())
+		}
+		room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+		roomInfo := backfilltest.MustStoreEvents(t, db, room, localServer, room.Events())
+		stateEntries, err := db.StateEntriesForEventIDs(context.Background(), stateIDs, true)
+		assert.NoError(t, err)
+
+		gotServers, visibility, err := joinedServersFromHistoryVisibility(context.Background(), db, &backfilltest.Querier{}, room.ID, roomInfo, stateEntries, localServer, false, false)
+		assert.NoError(t, err)
+		assert.Equal(t, gomatrixserverlib.HistoryVisibilityShared, visibility)
+		assert.Empty(t, gotServers)
+
+		// Whereas the state after our join is.
+		gotServers, _, err = joinedServersFromHistoryVisibility(context.Background(), db, &backfilltest.Querier{}, room.ID, roomInfo, mustCurrentStateEntries(t, db, room), localServer, false, false)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []spec.ServerName{remoteServer, localServer}, gotServers)
+	})
+}
+
+// backfillFixture is a room where the remote server has the full history, but
+// we only have the room state and the latest message.
+type backfillFixture struct {
+	room       *test.Room
+	remoteUser *test.User
+	messages   []*types.HeaderedEvent
+	db         *backfilltest.Database
+	fsAPI      *backfilltest.FederationAPI
+	backfiller *Backfiller
+	info       *types.RoomInfo
+}
+
+const (
+	fixtureLocalServer  = spec.ServerName("local")
+	fixtureRemoteServer = spec.ServerName("remote")
+)
+
+func newBackfillFixture(t *testing.T, dbType test.DBType, messageCount int) (*backfillFixture, func()) {
+	t.Helper()
+	alice := test.NewUser(t, test.WithSigningServer(fixtureRemoteServer, "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t, test.WithSigningServer(fixtureLocalServer, "ed25519:local", test.PrivateKeyB))
+
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	stateEvents := append([]*types.HeaderedEvent(nil), room.Events()...)
+	var messages []*types.HeaderedEvent
+	for i := 0; i < messageCount; i++ {
+		messages = append(messages, room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"}))
+	}
+
+	db, close := backfilltest.MustCreateDatabase(t, dbType)
+	info := backfilltest.MustStoreEvents(t, db, room, fixtureLocalServer, append(stateEvents, messages[len(messages)-1]))
+
+	// Like the input API would, track that we are missing the history before the latest message.
+	var storedPDUs []gomatrixserverlib.PDU
+	for _, ev := range append(stateEvents, messages[len(messages)-1]) {
+		storedPDUs = append(storedPDUs, ev.PDU)
+	}
+	if err := db.UpdateBackwardExtremities(context.Background(), info.RoomNID, storedPDUs); err != nil {
+		t.Fatalf("failed to update backward extremities: %v", err)
+	}
+
+	fsAPI := backfilltest.NewFederationAPI()
+	fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(room))
+	fakeDB := backfilltest.NewDatabase(db)
+	return &backfillFixture{
+		room:       room,
+		remoteUser: alice,
+		messages:   messages,
+		db:         fakeDB,
+		fsAPI:      fsAPI,
+		info:       info,
+		backfiller: &Backfiller{
+			IsLocalServerName: func(s spec.ServerName) bool { return s == fixtureLocalServer },
+			DB:                fakeDB,
+			FSAPI:             fsAPI,
+			KeyRing:           &test.NopJSONVerifier{},
+			Querier:           &backfilltest.Querier{},
+			serverOrder:       seededServerOrder(0),
+		},
+	}, close
+}
+
+// request returns a backfill request from the backwards extremity at the latest message.
+func (f *backfillFixture) request(limit int) *api.PerformBackfillRequest {
+	latest := f.messages[len(f.messages)-1]
+	return &api.PerformBackfillRequest{
+		RoomID:               f.room.ID,
+		BackwardsExtremities: map[string][]string{latest.EventID(): latest.PrevEventIDs()},
+		Limit:                limit,
+		ServerName:           fixtureLocalServer,
+		VirtualHost:          fixtureLocalServer,
+	}
+}
+
+func TestBackfillViaFederation(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, concurrency := range []int{1, 4} {
+			t.Run(fmt.Sprintf("persist concurrency %d", concurrency), func(t *testing.T) {
+				testBackfillViaFederation(t, dbType, concurrency)
+			})
+		}
+	})
+}
+
+func testBackfillViaFederation(t *testing.T, dbType test.DBType, persistConcurrency int) {
+	f, close := newBackfillFixture(t, dbType, 5)
+	defer close()
+	f.backfiller.PersistConcurrency = persistConcurrency
+
+	var res api.PerformBackfillResponse
+	err := f.backfiller.PerformBackfill(context.Background(), f.request(10), &res)
+	assert.NoError(t, err)
+
+	// All messages we were missing should be returned and persisted.
+	gotIDs := make(map[string]bool)
+	for _, ev := range res.Events {
+		gotIDs[ev.EventID()] = true
+	}
+	var missing []string
+	for _, ev := range f.messages[:len(f.messages)-1] {
+		assert.True(t, gotIDs[ev.EventID()], "expected event %s to be backfilled", ev.EventID())
+		missing = append(missing, ev.EventID())
+	}
+	nids, err := f.db.EventNIDs(context.Background(), missing)
+	assert.NoError(t, err)
+	assert.Len(t, nids, len(missing))
+	assert.Equal(t, gomatrixserverlib.HistoryVisibilityShared, res.HistoryVisibility)
+
+	// The whole room was returned in one go, so the state could be rolled
+	// forward without asking for /state_ids.
+	assert.Equal(t, 1, f.fsAPI.CountRequests(backfilltest.EndpointBackfill))
+	assert.Equal(t, 0, f.fsAPI.CountRequests(backfilltest.EndpointStateIDs))
+}
+
+func TestFetchAndStoreMissingEvents(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+
+		requester := newBackfillRequester(
+			f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName,
+			nil, nil, f.info.RoomVersion, 0,
+		)
+		requester.roomID = f.room.ID
+		// the first server doesn't know anything, so we should move on to the second
+		requester.servers = []spec.ServerName{"unknown", fixtureRemoteServer}
+
+		missing := f.messages[0].EventID()
+		f.backfiller.fetchAndStoreMissingEvents(context.Background(), f.info.RoomVersion, requester, []string{missing}, fixtureLocalServer)
+
+		nids, err := f.db.EventNIDs(context.Background(), []string{missing})
+		assert.NoError(t, err)
+		assert.Contains(t, nids, missing)
+		var eventRequests []backfilltest.Request
+		for _, req := range f.fsAPI.Requests() {
+			if req.Endpoint == backfilltest.EndpointEvent {
+				eventRequests = append(eventRequests, req)
+			}
+		}
+		assert.Equal(t, []backfilltest.Request{
+			{Endpoint: backfilltest.EndpointEvent, Server: "unknown", EventID: missing},
+			{Endpoint: backfilltest.EndpointEvent, Server: fixtureRemoteServer, EventID: missing},
+		}, eventRequests)
+	})
+}
+
+func TestBackfillStateOnly(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 2)
+		defer close()
+
+		// The remote server knows about a topic change which we missed.
+		topic := f.room.CreateAndInsert(t, f.remoteUser, spec.MRoomTopic, map[string]interface{}{"topic": "missed"}, test.WithStateKey(""))
+		f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(f.room))
+
+		known := f.room.Events()[0].EventID()
+		var res api.PerformBackfillResponse
+		err := f.backfiller.PerformBackfill(context.Background(), &api.PerformBackfillRequest{
+			RoomID:               f.room.ID,
+			ServerName:           fixtureLocalServer,
+			VirtualHost:          fixtureLocalServer,
+			StateOnly:            true,
+			MissingStateEventIDs: []string{topic.EventID(), known},
+		}, &res)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{topic.EventID()}, res.RecoveredEventIDs)
+
+		nids, err := f.db.EventNIDs(context.Background(), []string{topic.EventID()})
+		assert.NoError(t, err)
+		assert.Contains(t, nids, topic.EventID())
+
+		// Only the missing event was fetched, and the timeline wasn't backfilled.
+		assert.Equal(t, 0, f.fsAPI.CountRequests(backfilltest.EndpointBackfill))
+		var eventRequests []string
+		for _, req := range f.fsAPI.Requests() {
+			if req.Endpoint == backfilltest.EndpointEvent {
+				eventRequests = append(eventRequests, req.EventID)
+			}
+		}
+		assert.Equal(t, []string{topic.EventID()}, eventRequests)
+	})
+}
+
+// recordingVerifier records the requests it is asked to verify and accepts them all.
+type recordingVerifier struct {
+	requests []gomatrixserverlib.VerifyJSONRequest
+}
+
+func (v *recordingVerifier) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	v.requests = append(v.requests, requests...)
+	return make([]gomatrixserverlib.VerifyJSONResult, len(requests)), nil
+}
+
+func TestBackfillVerificationPolicy(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 2)
+		defer close()
+
+		topic := f.room.CreateAndInsert(t, f.remoteUser, spec.MRoomTopic, map[string]interface{}{"topic": "missed"}, test.WithStateKey(""))
+		f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(f.room))
+
+		// Accept expired keys for events from the remote server.
+		keyRing := &recordingVerifier{}
+		f.backfiller.KeyRing = keyRing
+		type policyCall struct {
+			roomID string
+			server spec.ServerName
+		}
+		var calls []policyCall
+		f.backfiller.VerificationPolicy = func(roomID string, server spec.ServerName, kr gomatrixserverlib.JSONVerifier) gomatrixserverlib.JSONVerifier {
+			calls = append(calls, policyCall{roomID, server})
+			assert.Equal(t, keyRing, kr)
+			return &ValidityCheckVerifier{JSONVerifier: kr, ValidityCheck: gomatrixserverlib.NoStrictValidityCheck}
+		}
+
+		var res api.PerformBackfillResponse
+		err := f.backfiller.PerformBackfill(context.Background(), &api.PerformBackfillRequest{
+			RoomID:               f.room.ID,
+			ServerName:           fixtureLocalServer,
+			VirtualHost:          fixtureLocalServer,
+			StateOnly:            true,
+			MissingStateEventIDs: []string{topic.EventID()},
+		}, &res)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{topic.EventID()}, res.RecoveredEventIDs)
+
+		assert.Equal(t, []policyCall{{f.room.ID, fixtureRemoteServer}}, calls)
+		if assert.NotEmpty(t, keyRing.requests) {
+			for _, req := range keyRing.requests {
+				// a key which expired before the event was sent is accepted
+				assert.True(t, req.ValidityCheckingFunc(spec.Timestamp(2000), spec.Timestamp(1000)))
+			}
+		}
+	})
+}
+
+func TestBackfillVerificationPolicyDefault(t *testing.T) {
+	keyRing := &test.NopJSONVerifier{}
+	r := &Backfiller{KeyRing: keyRing}
+	assert.Equal(t, keyRing, r.verifierFor("!room:test", "remote"))
+}
+
+func TestPersistEventsFetchesMissingAuthEvents(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 1)
+		defer close()
+
+		// charlie joins and speaks, but we only receive the message and not the join it is authed by.
+		charlie := test.NewUser(t, test.WithSigningServer(fixtureRemoteServer, "ed25519:remote", test.PrivateKeyA))
+		join := f.room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(charlie.ID))
+		msg := f.room.CreateAndInsert(t, charlie, "m.room.message", map[string]interface{}{"body": "hi", "msgtype": "m.text"})
+		f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(f.room))
+
+		ctx := context.Background()
+		requester := newBackfillRequester(
+			f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName,
+			nil, nil, f.info.RoomVersion, 0,
+		)
+		requester.roomID = f.room.ID
+		requester.servers = []spec.ServerName{fixtureRemoteServer}
+		fetcher := f.backfiller.missingAuthEventsFetcher(ctx, f.info.RoomVersion, requester, fixtureLocalServer)
+
+		_, persisted := persistEvents(ctx, f.db, f.backfiller.Querier, []gomatrixserverlib.PDU{msg.PDU}, fetcher, 1)
+		assert.Contains(t, persisted, msg.EventID())
+
+		nids, err := f.db.EventNIDs(ctx, []string{join.EventID()})
+		assert.NoError(t, err)
+		assert.Contains(t, nids, join.EventID())
+		assert.Equal(t, 0, requester.authEventFetchDepth)
+	})
+}
+
+func TestPersistEventsOutOfOrderWithGaps(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, concurrency := range []int{1, 4} {
+			for _, fetch := range []bool{true, false} {
+				t.Run(fmt.Sprintf("concurrency %d fetch %v", concurrency, fetch), func(t *testing.T) {
+					f, close := newBackfillFixture(t, dbType, 1)
+					defer close()
+
+					// charlie joins and speaks twice, but we receive the messages newest first and without the join
+					// which authorises them, along with a message from alice which we can store straight away.
+					charlie := test.NewUser(t, test.WithSigningServer(fixtureRemoteServer, "ed25519:remote", test.PrivateKeyA))
+					other := f.room.CreateAndInsert(t, f.remoteUser, "m.room.message", map[string]interface{}{"body": "0", "msgtype": "m.text"})
+					join := f.room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(charlie.ID))
+					first := f.room.CreateAndInsert(t, charlie, "m.room.message", map[string]interface{}{"body": "1", "msgtype": "m.text"})
+					second := f.room.CreateAndInsert(t, charlie, "m.room.message", map[string]interface{}{"body": "2", "msgtype": "m.text"})
+					f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(f.room))
+
+					ctx := context.Background()
+					var fetcher func([]string)
+					if fetch {
+						requester := newBackfillRequester(
+							f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName,
+							nil, nil, f.info.RoomVersion, 0,
+						)
+						requester.roomID = f.room.ID
+						requester.servers = []spec.ServerName{fixtureRemoteServer}
+						fetcher = f.backfiller.missingAuthEventsFetcher(ctx, f.info.RoomVersion, requester, fixtureLocalServer)
+					}
+
+					events := []gomatrixserverlib.PDU{second.PDU, first.PDU, other.PDU}
+					_, persisted := persistEvents(ctx, f.db, f.backfiller.Querier, events, fetcher, concurrency)
+
+					// The deferred events are stored rather than dropped, after the missing join was fetched once.
+					assert.Len(t, persisted, len(events))
+					nids, err := f.db.EventNIDs(ctx, []string{join.EventID(), first.EventID(), second.EventID(), other.EventID()})
+					assert.NoError(t, err)
+					if fetch {
+						assert.Contains(t, nids, join.EventID())
+						assert.Equal(t, 1, f.fsAPI.CountRequests(backfilltest.EndpointEvent))
+					} else {
+						assert.NotContains(t, nids, join.EventID())
+					}
+					// Events are stored after the events they follow, and the deferred ones after the rest.
+					assert.Less(t, nids[first.EventID()].EventNID, nids[second.EventID()].EventNID)
+					assert.Less(t, nids[other.EventID()].EventNID, nids[first.EventID()].EventNID)
+				})
+			}
+		}
+	})
+}
+
+func TestMissingAuthEventsFetcherDepthLimit(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 1)
+		defer close()
+
+		ctx := context.Background()
+		requester := newBackfillRequester(
+			f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName,
+			nil, nil, f.info.RoomVersion, 0,
+		)
+		requester.servers = []spec.ServerName{fixtureRemoteServer}
+		requester.authEventFetchDepth = maxAuthEventFetchDepth
+		fetcher := f.backfiller.missingAuthEventsFetcher(ctx, f.info.RoomVersion, requester, fixtureLocalServer)
+
+		fetcher([]string{"$missing"})
+		assert.Equal(t, 0, f.fsAPI.CountRequests(backfilltest.EndpointEvent))
+	})
+}
+
+func TestDependencyGroups(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	first := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "1"})
+	second := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "2"})
+
+	// Events are grouped after the events they reference, regardless of the order they were given in.
+	events := []gomatrixserverlib.PDU{second.PDU, first.PDU}
+	for _, ev := range room.Events()[:len(room.Events())-2] {
+		events = append(events, ev.PDU)
+	}
+	groups := dependencyGroups(events)
+
+	groupOf := make(map[string]int)
+	for g, indexes := range groups {
+		for _, i := range indexes {
+			groupOf[events[i].EventID()] = g
+		}
+	}
+	assert.Len(t, groupOf, len(events))
+	for _, ev := range events {
+		for _, id := range append(ev.AuthEventIDs(), ev.PrevEventIDs()...) {
+			assert.Less(t, groupOf[id], groupOf[ev.EventID()], "event %s should be stored after %s", ev.EventID(), id)
+		}
+	}
+	assert.Equal(t, groupOf[first.EventID()]+1, groupOf[second.EventID()])
+}
+
+func TestBackfillUpdatesBackwardExtremities(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		t.Run("backfilled to the start of the room", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 5)
+			defer close()
+			latest := f.messages[len(f.messages)-1]
+
+			bwExtrems, err := f.db.BackwardExtremitiesForRoom(context.Background(), f.info.RoomNID)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]string{latest.EventID(): latest.PrevEventIDs()}, bwExtrems)
+
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+
+			bwExtrems, err = f.db.BackwardExtremitiesForRoom(context.Background(), f.info.RoomNID)
+			assert.NoError(t, err)
+			assert.Empty(t, bwExtrems)
+		})
+
+		t.Run("remote server is missing older history", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 5)
+			defer close()
+
+			// The remote server only has the last few messages, so we can only backfill up to messages[2].
+			srv := backfilltest.NewServer(f.room)
+			srv.Forget(f.messages[1].EventID())
+			f.fsAPI.AddServer(fixtureRemoteServer, srv)
+
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+
+			bwExtrems, err := f.db.BackwardExtremitiesForRoom(context.Background(), f.info.RoomNID)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]string{f.messages[2].EventID(): {f.messages[1].EventID()}}, bwExtrems)
+		})
+	})
+}
+
+func TestNextEventServer(t *testing.T) {
+	servers := []spec.ServerName{"a", "b", "c", "d"}
+	latencies := map[spec.ServerName]time.Duration{
+		"a": 300 * time.Millisecond,
+		"b": 100 * time.Millisecond,
+		"c": 200 * time.Millisecond,
+	}
+
+	testCases := []struct {
+		name              string
+		preferFastServers bool
+		lastEventServer   spec.ServerName
+		tried             []spec.ServerName
+		want              []spec.ServerName
+	}{
+		{
+			name: "in order by default",
+			want: []spec.ServerName{"a", "b", "c", "d"},
+		},
+		{
+			name:              "fastest first, unknown last",
+			preferFastServers: true,
+			want:              []spec.ServerName{"b", "c", "a", "d"},
+		},
+		{
+			name:              "last successful server first",
+			preferFastServers: true,
+			lastEventServer:   "a",
+			want:              []spec.ServerName{"a", "b", "c", "d"},
+		},
+		{
+			name:              "skips tried servers",
+			preferFastServers: true,
+			lastEventServer:   "a",
+			tried:             []spec.ServerName{"a", "b"},
+			want:              []spec.ServerName{"c", "d"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			requester := newBackfillRequester(nil, nil, nil, "local", nil, nil, nil, gomatrixserverlib.RoomVersionV10, 0)
+			requester.preferFastServers = tc.preferFastServers
+			requester.lastEventServer = tc.lastEventServer
+			now := time.Now()
+			for srv, latency := range latencies {
+				requester.observeLatency(srv, now.Add(-latency))
+			}
+
+			tried := make(map[spec.ServerName]bool)
+			for _, srv := range tc.tried {
+				tried[srv] = true
+			}
+			var got []spec.ServerName
+			for srv, ok := requester.nextEventServer(servers, tried); ok; srv, ok = requester.nextEventServer(servers, tried) {
+				tried[srv] = true
+				got = append(got, srv)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestBackfillUnderfilled(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		t.Run("history is missing", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 5)
+			defer close()
+
+			// The remote server doesn't have the older history, so we only get two events.
+			srv := backfilltest.NewServer(f.room)
+			srv.Forget(f.messages[1].EventID())
+			f.fsAPI.AddServer(fixtureRemoteServer, srv)
+
+			before := testutil.ToFloat64(backfillUnderfilled.WithLabelValues(f.room.ID))
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+			assert.Len(t, res.Events, 2)
+			assert.Equal(t, before+1, testutil.ToFloat64(backfillUnderfilled.WithLabelValues(f.room.ID)))
+		})
+
+		t.Run("backfilled to the start of the room", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 5)
+			defer close()
+
+			before := testutil.ToFloat64(backfillUnderfilled.WithLabelValues(f.room.ID))
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(100), &res))
+			assert.Less(t, len(res.Events), 50)
+			assert.Equal(t, before, testutil.ToFloat64(backfillUnderfilled.WithLabelValues(f.room.ID)))
+		})
+	})
+}
+
+func TestEstimateBackfill(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+		ctx := context.Background()
+		latest := f.messages[len(f.messages)-1]
+
+		// We have the latest message, so a backfill of one event from it doesn't need federation.
+		estimate, err := f.backfiller.EstimateBackfill(ctx, fixtureLocalServer, f.room.ID, []string{latest.EventID()}, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, &api.BackfillEstimate{LocalEvents: 1}, estimate)
+
+		// The messages before it are missing, so would have to come from the remote server.
+		estimate, err = f.backfiller.EstimateBackfill(ctx, fixtureLocalServer, f.room.ID, latest.PrevEventIDs(), 10)
+		assert.NoError(t, err)
+		assert.Equal(t, &api.BackfillEstimate{LocalEvents: 0, FederationEvents: 10, CandidateServers: 1}, estimate)
+
+		// The estimate asks the same servers as a real backfill would, including the one which recently had the history.
+		f.backfiller.PreferRecentServers = true
+		f.backfiller.recent.remember(f.room.ID, "recent")
+		estimate, err = f.backfiller.EstimateBackfill(ctx, fixtureLocalServer, f.room.ID, latest.PrevEventIDs(), 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, estimate.CandidateServers)
+
+		// Nothing was fetched or stored.
+		assert.Empty(t, f.fsAPI.Requests())
+		assert.Equal(t, 0, f.db.Calls("StoreEvent"))
+	})
+}
+
+func TestServersAtEventVirtualHostPerspective(t *testing.T) {
+	joinedHost := spec.ServerName("joined")
+	strangerHost := spec.ServerName("stranger")
+	thirdServer := spec.ServerName("third")
+
+	alice := test.NewUser(t, test.WithSigningServer(fixtureRemoteServer, "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t, test.WithSigningServer(joinedHost, "ed25519:joined", test.PrivateKeyB))
+	charlie := test.NewUser(t, test.WithSigningServer(thirdServer, "ed25519:third", test.PrivateKeyA))
+
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	stateEvents := append([]*types.HeaderedEvent(nil), room.Events()...)
+	missing := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "missing", "msgtype": "m.text"})
+	latest := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "latest", "msgtype": "m.text"})
+	// charlie joined after the missing event, so is only returned if we can see the current joined servers
+	charlieJoin := room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(charlie.ID))
+
+	testCases := []struct {
+		name        string
+		virtualHost spec.ServerName
+		wantServers []spec.ServerName
+	}{
+		{
+			name:        "virtual host in the room",
+			virtualHost: joinedHost,
+			wantServers: []spec.ServerName{fixtureRemoteServer, thirdServer},
+		},
+		{
+			name:        "virtual host not in the room",
+			virtualHost: strangerHost,
+			wantServers: []spec.ServerName{fixtureRemoteServer},
+		},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := backfilltest.MustCreateDatabase(t, dbType)
+		defer close()
+		info := backfilltest.MustStoreEvents(t, db, room, joinedHost, append(stateEvents, latest, charlieJoin))
+		isLocalServerName := func(s spec.ServerName) bool { return s == joinedHost || s == strangerHost }
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				requester := newBackfillRequester(
+					db, backfilltest.NewFederationAPI(), &backfilltest.Querier{}, tc.virtualHost, isLocalServerName,
+					map[string][]string{latest.EventID(): {missing.EventID()}}, nil, info.RoomVersion, 0,
+				)
+				gotServers := requester.ServersAtEvent(context.Background(), room.ID, missing.EventID())
+				assert.ElementsMatch(t, tc.wantServers, gotServers)
+			})
+		}
+	})
+}
+
+func TestServersAtEventKnownEvent(t *testing.T) {
+	alice := test.NewUser(t, test.WithSigningServer(fixtureRemoteServer, "ed25519:remote", test.PrivateKeyA))
+	bob := test.NewUser(t, test.WithSigningServer(fixtureLocalServer, "ed25519:local", test.PrivateKeyB))
+	strangerHost := spec.ServerName("stranger")
+	thirdServer := spec.ServerName("third")
+	charlie := test.NewUser(t, test.WithSigningServer(thirdServer, "ed25519:third", test.PrivateKeyA))
+
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	stateEvents := append([]*types.HeaderedEvent(nil), room.Events()...)
+	missing := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "missing", "msgtype": "m.text"})
+	latest := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "latest", "msgtype": "m.text"})
+	charlieJoin := room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(charlie.ID))
+	// charlie is only in the room at the known event, as we're backfilling for a virtual host which can't see the
+	// current joined servers
+	known := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "known", "msgtype": "m.text"})
+
+	testCases := []struct {
+		name        string
+		eventID     string
+		wantServers []spec.ServerName
+	}{
+		{
+			// we don't have the event, so the servers are those in the room at its successor
+			name:        "prev event of a backward extremity",
+			eventID:     missing.EventID(),
+			wantServers: []spec.ServerName{fixtureRemoteServer},
+		},
+		{
+			// the event isn't a prev event of any backward extremity, but we have it stored
+			name:        "known event",
+			eventID:     known.EventID(),
+			wantServers: []spec.ServerName{fixtureRemoteServer, thirdServer},
+		},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := backfilltest.MustCreateDatabase(t, dbType)
+		defer close()
+		info := backfilltest.MustStoreEvents(t, db, room, fixtureLocalServer, append(stateEvents, latest, charlieJoin, known))
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				requester := newBackfillRequester(
+					db, backfilltest.NewFederationAPI(), &backfilltest.Querier{}, strangerHost,
+					func(s spec.ServerName) bool { return s == fixtureLocalServer || s == strangerHost },
+					map[string][]string{latest.EventID(): {missing.EventID()}}, nil, info.RoomVersion, 0,
+				)
+				gotServers := requester.ServersAtEvent(context.Background(), room.ID, tc.eventID)
+				assert.ElementsMatch(t, tc.wantServers, gotServers)
+			})
+		}
+	})
+}
+
+func TestBackfillRejectsNonLocalVirtualHost(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 2)
+		defer close()
+
+		req := f.request(10)
+		req.VirtualHost = fixtureRemoteServer
+		var res api.PerformBackfillResponse
+		err := f.backfiller.PerformBackfill(context.Background(), req, &res)
+		assert.Error(t, err)
+		assert.Empty(t, f.fsAPI.Requests())
+	})
+}
+
+// withPrevEvents is an event with different prev_events, which may not pass auth checks.
+type withPrevEvents struct {
+	gomatrixserverlib.PDU
+	prevEventIDs []string
+}
+
+func (e withPrevEvents) PrevEventIDs() []string {
+	return e.prevEventIDs
+}
+
+// withDepth is an event with a different depth, which may not pass auth checks.
+type withDepth struct {
+	gomatrixserverlib.PDU
+	depth int64
+}
+
+func (e withDepth) Depth() int64 {
+	return e.depth
+}
+
+func TestIsRoomStartAllRoomVersions(t *testing.T) {
+	alice := test.NewUser(t, test.WithSigningServer(fixtureRemoteServer, "ed25519:remote", test.PrivateKeyA))
+	for roomVersion := range gomatrixserverlib.RoomVersions() {
+		t.Run(string(roomVersion), func(t *testing.T) {
+			room := test.NewRoom(t, alice, test.RoomVersion(roomVersion))
+			create := room.Events()[0]
+			assert.Empty(t, create.PrevEventIDs())
+			assert.True(t, isRoomStart(create))
+			assert.NoError(t, validateRoomVersion(create.PDU, roomVersion))
+			for _, ev := range room.Events()[1:] {
+				assert.False(t, isRoomStart(ev), "%s is not the start of the room", ev.Type())
+			}
+
+			fsAPI := backfilltest.NewFederationAPI()
+			newRequester := func() *backfillRequester {
+				return newBackfillRequester(
+					nil, fsAPI, &backfilltest.Querier{}, fixtureLocalServer, func(s spec.ServerName) bool { return s == fixtureLocalServer },
+					nil, nil, roomVersion, 0,
+				)
+			}
+			stateIDs, err := newRequester().StateIDsBeforeEvent(context.Background(), create.PDU)
+			assert.NoError(t, err)
+			assert.Empty(t, stateIDs)
+
+			// a create event which isn't the first event in the room is malformed, so it is neither the start of
+			// the room nor an event we would persist
+			for _, malformed := range []gomatrixserverlib.PDU{
+				withPrevEvents{PDU: create.PDU, prevEventIDs: []string{"$before"}},
+				withDepth{PDU: create.PDU, depth: 2},
+			} {
+				assert.False(t, isRoomStart(malformed))
+				assert.Error(t, validateRoomVersion(malformed, roomVersion))
+				_, err = newRequester().StateIDsBeforeEvent(context.Background(), malformed)
+				assert.Error(t, err)
+			}
+			assert.Empty(t, fsAPI.Requests())
+		})
+	}
+}
+
+func TestBackfillReachedRoomStart(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+
+		// the room is small enough for the whole of it to be backfilled
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+		var eventIDs []string
+		for _, ev := range res.Events {
+			eventIDs = append(eventIDs, ev.EventID())
+		}
+		assert.Contains(t, eventIDs, f.room.Events()[0].EventID())
+		assert.True(t, res.ReachedRoomStart)
+
+		// nothing before the create event is missing, so the room has no backward extremities left
+		bwExtrems, err := f.db.BackwardExtremitiesForRoom(context.Background(), f.info.RoomNID)
+		assert.NoError(t, err)
+		assert.Empty(t, bwExtrems)
+	})
+}
+
+func TestBackfillUnknownRoom(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 2)
+		defer close()
+
+		for requester, serverName := range map[string]spec.ServerName{"local": fixtureLocalServer, "remote": fixtureRemoteServer} {
+			req := f.request(10)
+			req.RoomID = "!unknown:" + string(serverName)
+			req.ServerName = serverName
+			before := testutil.ToFloat64(backfillUnknownRooms.WithLabelValues(requester))
+			var res api.PerformBackfillResponse
+			err := f.backfiller.PerformBackfill(context.Background(), req, &res)
+			var unknownRoom api.ErrUnknownRoom
+			assert.ErrorAs(t, err, &unknownRoom)
+			assert.Equal(t, req.RoomID, unknownRoom.RoomID)
+			assert.Equal(t, before+1, testutil.ToFloat64(backfillUnknownRooms.WithLabelValues(requester)))
+		}
+		assert.Empty(t, f.fsAPI.Requests())
+	})
+}
+
+func TestOrderServersWithHints(t *testing.T) {
+	requester := newBackfillRequester(
+		nil, nil, nil, fixtureLocalServer, func(s spec.ServerName) bool { return s == fixtureLocalServer },
+		nil, []spec.ServerName{"preferred"}, gomatrixserverlib.RoomVersionV10, 0,
+	)
+	requester.serverHints = []spec.ServerName{"hinted", fixtureLocalServer, "member", "hinted"}
+
+	servers := requester.orderServers(map[spec.ServerName]bool{
+		"preferred":        true,
+		"member":           true,
+		"other":            true,
+		fixtureLocalServer: true,
+	})
+	assert.Equal(t, []spec.ServerName{"preferred", "hinted", "member", "other"}, servers)
+}
+
+func TestOrderServersWithWeights(t *testing.T) {
+	requester := newBackfillRequester(
+		nil, nil, nil, fixtureLocalServer, func(s spec.ServerName) bool { return s == fixtureLocalServer },
+		nil, []spec.ServerName{"preferred"}, gomatrixserverlib.RoomVersionV10, 0,
+	)
+	requester.preferServerWeights = map[spec.ServerName]int{
+		"heavy":            10,
+		"also-heavy":       10,
+		"ignored":          0,
+		fixtureLocalServer: 100,
+	}
+	requester.serverHints = []spec.ServerName{"hinted"}
+
+	servers := requester.orderServers(map[spec.ServerName]bool{
+		"preferred":        true,
+		"heavy":            true,
+		"also-heavy":       true,
+		"ignored":          true,
+		"hinted":           true,
+		fixtureLocalServer: true,
+	})
+	// Weighted servers come first, highest weight first and ties by name, then preferred servers without a weight.
+	assert.Equal(t, []spec.ServerName{"also-heavy", "heavy", "preferred", "hinted", "ignored"}, servers)
+}
+
+func TestOrderServersWithRecentServer(t *testing.T) {
+	requester := newBackfillRequester(
+		nil, nil, nil, fixtureLocalServer, func(s spec.ServerName) bool { return s == fixtureLocalServer },
+		nil, []spec.ServerName{"preferred"}, gomatrixserverlib.RoomVersionV10, 0,
+	)
+	requester.recentServer = "recent"
+	requester.serverHints = []spec.ServerName{"hinted"}
+
+	// The recent server comes first even though it isn't in the room.
+	servers := requester.orderServers(map[spec.ServerName]bool{
+		"preferred":        true,
+		fixtureLocalServer: true,
+	})
+	assert.Equal(t, []spec.ServerName{"recent", "preferred", "hinted"}, servers)
+}
+
+func TestBackfillServers(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		ctx := context.Background()
+		latest := f.messages[len(f.messages)-1]
+
+		// The servers are ordered using the same configuration as a real backfill.
+		f.backfiller.PreferRecentServers = true
+		f.backfiller.recent.remember(f.room.ID, "recent.test")
+		want := []spec.ServerName{"recent.test", fixtureRemoteServer}
+		for _, eventID := range []string{latest.EventID(), latest.PrevEventIDs()[0]} {
+			servers, err := f.backfiller.BackfillServers(ctx, f.room.ID, fixtureLocalServer, eventID)
+			assert.NoError(t, err)
+			assert.Equal(t, want, servers)
+		}
+
+		_, err := f.backfiller.BackfillServers(ctx, f.room.ID, fixtureLocalServer, f.messages[0].EventID())
+		assert.Error(t, err)
+		assert.Empty(t, f.fsAPI.Requests())
+	})
+}
+
+// seededServerOrder returns a server ordering for tests which shuffles the servers the same way every time for the
+// same seed and the same servers, regardless of the order they were given in.
+func seededServerOrder(seed int64) func([]spec.ServerName) {
+	return func(servers []spec.ServerName) {
+		sort.Slice(servers, func(i, j int) bool { return servers[i] < servers[j] })
+		rand.New(rand.NewSource(seed)).Shuffle(len(servers), func(i, j int) {
+			servers[i], servers[j] = servers[j], servers[i]
+		})
+	}
+}
+
+func TestOrderServersDeterministic(t *testing.T) {
+	serverSet := map[spec.ServerName]bool{fixtureLocalServer: true}
+	var preferServers []spec.ServerName
+	for i := 0; i < 20; i++ {
+		serverSet[spec.ServerName(fmt.Sprintf("server%d", i))] = true
+		if i%4 == 0 {
+			preferServers = append(preferServers, spec.ServerName(fmt.Sprintf("server%d", i)))
+		}
+	}
+	order := func(seed int64) []spec.ServerName {
+		requester := newBackfillRequester(
+			nil, nil, nil, fixtureLocalServer, func(s spec.ServerName) bool { return s == fixtureLocalServer },
+			nil, preferServers, gomatrixserverlib.RoomVersionV10, 0,
+		)
+		requester.serverOrder = seededServerOrder(seed)
+		return requester.orderServers(serverSet)
+	}
+
+	want := order(1)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, want, order(1))
+	}
+	// The preferred servers still come first.
+	assert.ElementsMatch(t, preferServers, want[:len(preferServers)])
+	assert.NotEqual(t, want, order(2), "the seed should change the order")
+}
+
+func TestBackfillServerHints(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+
+		// The hinted server isn't in the room, but knows its history.
+		hinted := spec.ServerName("hinted")
+		f.fsAPI.AddServer(hinted, backfilltest.NewServer(f.room))
+
+		req := f.request(10)
+		req.ServerHints = []spec.ServerName{hinted}
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), req, &res))
+		assert.NotEmpty(t, res.Events)
+
+		requests := f.fsAPI.Requests()
+		if assert.NotEmpty(t, requests) {
+			assert.Equal(t, backfilltest.Request{Endpoint: backfilltest.EndpointBackfill, Server: hinted, EventID: req.PrevEventIDs()[0]}, requests[0])
+		}
+	})
+}
+
+func TestBackfillResultCache(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		f.backfiller.ResultCacheTTL = time.Minute
+		f.backfiller.ResultCacheSize = 10
+		ctx := context.Background()
+
+		var first api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &first))
+		assert.NotEmpty(t, first.Events)
+		requests := len(f.fsAPI.Requests())
+		stored := f.db.Calls("StoreEvent")
+
+		// An identical retry is answered from the cache without going over federation or storing anything.
+		var retry api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &retry))
+		assert.Equal(t, first, retry)
+		assert.Len(t, f.fsAPI.Requests(), requests)
+		assert.Equal(t, stored, f.db.Calls("StoreEvent"))
+
+		// A different request isn't.
+		var other api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(1), &other))
+		assert.Greater(t, len(f.fsAPI.Requests()), requests)
+	})
+}
+
+func TestBackfillResultCacheExpiryAndEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := newBackfillResultCache(5*time.Second, 2)
+	cache.now = func() time.Time { return now }
+	res := func(id string) *api.PerformBackfillResponse {
+		return &api.PerformBackfillResponse{RecoveredEventIDs: []string{id}}
+	}
+
+	cache.put("a", res("a"))
+	now = now.Add(time.Second)
+	cache.put("b", res("b"))
+
+	// cached responses are copies
+	got, ok := cache.get("a")
+	assert.True(t, ok)
+	got.RecoveredEventIDs[0] = "changed"
+	got, _ = cache.get("a")
+	assert.Equal(t, res("a"), got)
+
+	// the cache is full, so the entry which expires soonest is evicted
+	now = now.Add(time.Second)
+	cache.put("c", res("c"))
+	_, ok = cache.get("a")
+	assert.False(t, ok)
+	_, ok = cache.get("b")
+	assert.True(t, ok)
+
+	// entries expire after the TTL
+	now = now.Add(4 * time.Second)
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	_, ok = cache.get("c")
+	assert.True(t, ok)
+}
+
+func TestBackfillRecordsVirtualHost(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, record := range []bool{false, true} {
+			t.Run(fmt.Sprintf("record %v", record), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 3)
+				defer close()
+				f.backfiller.RecordVirtualHost = record
+				ctx := context.Background()
+
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+				assert.NotEmpty(t, res.Events)
+
+				want := spec.ServerName("")
+				if record {
+					want = fixtureLocalServer
+				}
+				nids, err := f.db.EventNIDs(ctx, []string{f.messages[0].EventID()})
+				assert.NoError(t, err)
+				virtualHost, err := f.db.EventVirtualHost(ctx, nids[f.messages[0].EventID()].EventNID)
+				assert.NoError(t, err)
+				assert.Equal(t, want, virtualHost)
+
+				// events we didn't backfill have no virtual host
+				latest := f.messages[len(f.messages)-1].EventID()
+				nids, err = f.db.EventNIDs(ctx, []string{latest})
+				assert.NoError(t, err)
+				virtualHost, err = f.db.EventVirtualHost(ctx, nids[latest].EventNID)
+				assert.NoError(t, err)
+				assert.Equal(t, spec.ServerName(""), virtualHost)
+			})
+		}
+	})
+}
+
+func TestBackfillFallsBackToState(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+
+		// The remote server is missing some history, so we need the state at the oldest event it
+		// returns, but it doesn't implement /state_ids.
+		srv := backfilltest.NewServer(f.room)
+		srv.Forget(f.messages[1].EventID())
+		srv.NoStateIDs = true
+		f.fsAPI.AddServer(fixtureRemoteServer, srv)
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+		assert.Len(t, res.Events, 2)
+		assert.Equal(t, 1, f.fsAPI.CountRequests(backfilltest.EndpointStateIDs))
+		assert.Equal(t, 1, f.fsAPI.CountRequests(backfilltest.EndpointState))
+
+		// the state before the backfilled events was stored
+		oldest := f.messages[2].EventID()
+		stateAt, err := f.db.StateAtEventIDs(context.Background(), []string{oldest})
+		assert.NoError(t, err)
+		if assert.Len(t, stateAt, 1) {
+			assert.NotZero(t, stateAt[0].BeforeStateSnapshotNID)
+		}
+	})
+}
+
+func TestBackfillTracing(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	t.Cleanup(func() { opentracing.SetGlobalTracer(opentracing.NoopTracer{}) })
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+
+		// only look at the spans for this room, as the database types run in parallel
+		spans := make(map[string]*mocktracer.MockSpan)
+		for _, span := range tracer.FinishedSpans() {
+			if span.Tag("room_id") == f.room.ID {
+				spans[span.OperationName] = span
+			}
+		}
+		for _, name := range []string{"Backfiller.PerformBackfill", "Backfiller.backfillViaFederation", "backfillRequester.ServersAtEvent"} {
+			assert.Contains(t, spans, name)
+		}
+		root, viaFederation := spans["Backfiller.PerformBackfill"], spans["Backfiller.backfillViaFederation"]
+		if root != nil && viaFederation != nil {
+			// the phases are nested within the backfill
+			assert.Equal(t, root.SpanContext.SpanID, viaFederation.ParentID)
+			assert.Equal(t, len(res.Events), viaFederation.Tag("backfilled_events"))
+		}
+	})
+}
+
+func TestBackfillCheckpoints(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+		f.backfiller.CheckpointInterval = 2
+		ctx := context.Background()
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+		if !assert.NotEmpty(t, res.Events) {
+			return
+		}
+
+		// the checkpoint is the oldest backfilled event, once everything has been persisted
+		assert.Equal(t, res.Events[0].EventID(), res.Checkpoint)
+		checkpoint, err := f.db.BackfillCheckpoint(ctx, f.info.RoomNID)
+		assert.NoError(t, err)
+		assert.Equal(t, res.Checkpoint, checkpoint)
+
+		var eventIDs []string
+		for _, ev := range res.Events {
+			eventIDs = append(eventIDs, ev.EventID())
+		}
+		stateAt, err := f.db.StateAtEventIDs(ctx, eventIDs)
+		assert.NoError(t, err)
+		assert.Len(t, stateAt, len(eventIDs))
+		for _, state := range stateAt {
+			assert.NotZero(t, state.BeforeStateSnapshotNID)
+		}
+	})
+}
+
+func TestBackfillResumeFrom(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+		ctx := context.Background()
+
+		// resuming from an event we don't have fails
+		req := f.request(10)
+		req.ResumeFrom = f.messages[2].EventID()
+		var res api.PerformBackfillResponse
+		assert.Error(t, f.backfiller.PerformBackfill(ctx, req, &res))
+
+		// once we have it, we backfill from its prev events whatever the backwards extremities are
+		backfilltest.MustStoreEvents(t, f.db, f.room, fixtureLocalServer, f.messages[2:3])
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, req, &res))
+		assert.NotEmpty(t, res.Events)
+		requests := f.fsAPI.Requests()
+		if assert.NotEmpty(t, requests) {
+			assert.Equal(t, backfilltest.Request{Endpoint: backfilltest.EndpointBackfill, Server: fixtureRemoteServer, EventID: f.messages[1].EventID()}, requests[0])
+		}
+	})
+}
+
+func TestBackfillDropsEventsFromOtherRooms(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		ctx := context.Background()
+
+		otherRoom := test.NewRoom(t, f.remoteUser)
+		otherMsg := otherRoom.CreateAndInsert(t, f.remoteUser, "m.room.message", map[string]interface{}{"body": "elsewhere", "msgtype": "m.text"})
+		otherState := otherRoom.Events()[0]
+
+		// The remote server slips an event from another room into its /backfill response, and
+		// returns an event from another room when asked for one of the missing state events.
+		srv := backfilltest.NewServer(f.room)
+		for _, ev := range otherRoom.Events() {
+			srv.BackfillExtra = append(srv.BackfillExtra, ev.PDU)
+		}
+		f.fsAPI.AddServer(fixtureRemoteServer, srv)
+
+		before := testutil.ToFloat64(backfillCrossRoomEvents.WithLabelValues(f.room.ID))
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+		assert.NotEmpty(t, res.Events)
+		for _, ev := range res.Events {
+			assert.Equal(t, f.room.ID, ev.RoomID().String())
+		}
+		dropped := testutil.ToFloat64(backfillCrossRoomEvents.WithLabelValues(f.room.ID))
+		assert.Greater(t, dropped, before)
+
+		requester := newBackfillRequester(
+			f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName,
+			nil, nil, f.info.RoomVersion, 0,
+		)
+		requester.roomID = f.room.ID
+		requester.servers = []spec.ServerName{fixtureRemoteServer}
+		srv.Events["$missing"] = otherState.PDU
+		stored := f.backfiller.fetchAndStoreMissingEvents(ctx, f.info.RoomVersion, requester, []string{"$missing"}, fixtureLocalServer)
+		assert.Empty(t, stored)
+		assert.Equal(t, dropped+1, testutil.ToFloat64(backfillCrossRoomEvents.WithLabelValues(f.room.ID)))
+
+		nids, err := f.db.EventNIDs(ctx, []string{otherMsg.EventID(), otherState.EventID()})
+		assert.NoError(t, err)
+		assert.Empty(t, nids)
+	})
+}
+
+// blockingBackfillAPI blocks /backfill requests until their context is done.
+type blockingBackfillAPI struct {
+	*backfilltest.FederationAPI
+	started chan struct{}
+}
+
+func (f *blockingBackfillAPI) Backfill(ctx context.Context, origin, s spec.ServerName, roomID string, limit int, fromEventIDs []string) (gomatrixserverlib.Transaction, error) {
+	f.started <- struct{}{}
+	<-ctx.Done()
+	return gomatrixserverlib.Transaction{}, ctx.Err()
+}
+
+func TestAbortBackfills(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		fsAPI := &blockingBackfillAPI{FederationAPI: f.fsAPI, started: make(chan struct{}, 1)}
+		f.backfiller.FSAPI = fsAPI
+
+		errs := make(chan error, 1)
+		go func() {
+			var res api.PerformBackfillResponse
+			errs <- f.backfiller.PerformBackfill(context.Background(), f.request(10), &res)
+		}()
+		<-fsAPI.started
+
+		assert.Equal(t, 0, f.backfiller.AbortBackfills("!other:remote"))
+		assert.Equal(t, 1, f.backfiller.AbortBackfills(f.room.ID))
+		err := <-errs
+		var aborted api.ErrBackfillAborted
+		if assert.ErrorAs(t, err, &aborted) {
+			assert.Equal(t, f.room.ID, aborted.RoomID)
+		}
+
+		// nothing was persisted, and the backfill is no longer in flight
+		nids, err := f.db.EventNIDs(context.Background(), []string{f.messages[0].EventID()})
+		assert.NoError(t, err)
+		assert.Empty(t, nids)
+		assert.Equal(t, 0, f.backfiller.AbortBackfills(f.room.ID))
+	})
+}
+
+func TestBackfillRecoversFromInterruptedPersistence(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		ctx := context.Background()
+		bwExtremsBefore, err := f.db.BackwardExtremitiesForRoom(ctx, f.info.RoomNID)
+		assert.NoError(t, err)
+
+		// The backfill is interrupted after the events are stored but before the state before them is.
+		f.db.AddStateErr = context.Canceled
+		var res api.PerformBackfillResponse
+		assert.Error(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+		nids, err := f.db.EventNIDs(ctx, []string{f.messages[0].EventID()})
+		assert.NoError(t, err)
+		assert.Len(t, nids, 1)
+		_, err = f.db.SnapshotNIDFromEventID(ctx, f.messages[0].EventID())
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		// so the gap in the history is left where it was
+		bwExtrems, err := f.db.BackwardExtremitiesForRoom(ctx, f.info.RoomNID)
+		assert.NoError(t, err)
+		assert.Equal(t, bwExtremsBefore, bwExtrems)
+
+		// and the next backfill stores the state before the events it left without.
+		f.db.AddStateErr = nil
+		res = api.PerformBackfillResponse{}
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+		for _, ev := range f.messages[:len(f.messages)-1] {
+			_, err = f.db.SnapshotNIDFromEventID(ctx, ev.EventID())
+			assert.NoError(t, err, "event %s has no state", ev.EventID())
+		}
+	})
+}
+
+func TestFetchAndStoreMissingEventsAppliesRedactions(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 1)
+		defer close()
+		ctx := context.Background()
+
+		// A room where we have a message of alice's, but not her redaction of it, which is only fetched as a
+		// missing event and so is stored without state.
+		alice := f.remoteUser
+		bob := test.NewUser(t, test.WithSigningServer(fixtureLocalServer, "ed25519:local", test.PrivateKeyB))
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+		target := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "oops", "msgtype": "m.text"})
+		redaction := room.CreateAndInsert(t, alice, spec.MRoomRedaction, map[string]interface{}{}, test.WithRedacts(target.EventID()))
+		backfilltest.MustStoreEvents(t, f.db, room, fixtureLocalServer, room.Events()[:len(room.Events())-1])
+		f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(room))
+
+		requester := newBackfillRequester(
+			f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName,
+			nil, nil, room.Version, 0,
+		)
+		requester.roomID = room.ID
+		requester.servers = []spec.ServerName{fixtureRemoteServer}
+
+		stored := f.backfiller.fetchAndStoreMissingEvents(ctx, room.Version, requester, []string{redaction.EventID()}, fixtureLocalServer)
+		assert.Equal(t, []string{redaction.EventID()}, stored)
+
+		info, err := f.db.RoomInfo(ctx, room.ID)
+		assert.NoError(t, err)
+		events, err := f.db.EventsFromIDs(ctx, info, []string{target.EventID()})
+		assert.NoError(t, err)
+		if assert.Len(t, events, 1) {
+			assert.JSONEq(t, "{}", string(events[0].Content()), "the target of the redaction should be redacted")
+			assert.Equal(t, redaction.EventID(), gjson.GetBytes(events[0].Unsigned(), "redacted_by").Str)
+		}
+	})
+}
+
+func TestFetchAndStoreMissingEventsQuarantine(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, quarantine := range []bool{false, true} {
+			t.Run(fmt.Sprintf("quarantine %v", quarantine), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 1)
+				defer close()
+				f.backfiller.QuarantineRejectedEvents = quarantine
+				ctx := context.Background()
+
+				// the message only cites the create event, which doesn't show its sender is in the room
+				create := f.room.Events()[0]
+				rejected := f.room.CreateAndInsert(t, f.remoteUser, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+					test.WithAuthIDs([]string{create.EventID()}))
+				f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(f.room))
+
+				requester := newBackfillRequester(
+					f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName,
+					nil, nil, f.info.RoomVersion, 0,
+				)
+				requester.roomID = f.room.ID
+				requester.servers = []spec.ServerName{fixtureRemoteServer}
+				stored := f.backfiller.fetchAndStoreMissingEvents(ctx, f.info.RoomVersion, requester, []string{rejected.EventID()}, fixtureLocalServer)
+				assert.Empty(t, stored)
+
+				events, err := f.db.QuarantinedEvents(ctx, f.room.ID)
+				assert.NoError(t, err)
+				event, err := f.db.QuarantinedEvent(ctx, rejected.EventID())
+				assert.NoError(t, err)
+				if !quarantine {
+					assert.Empty(t, events)
+					assert.Nil(t, event)
+					return
+				}
+				if assert.Len(t, events, 1) && assert.NotNil(t, event) {
+					assert.Equal(t, events[0], *event)
+					assert.Equal(t, rejected.EventID(), event.EventID)
+					assert.Equal(t, f.room.ID, event.RoomID)
+					assert.Equal(t, fixtureRemoteServer, event.Origin)
+					assert.NotEmpty(t, event.Reason)
+					assert.JSONEq(t, string(rejected.JSON()), string(event.EventJSON))
+				}
+			})
+		}
+	})
+}
+
+func TestBackfillMinInterval(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		f.backfiller.MinInterval = time.Hour
+		f.backfiller.ResultCacheTTL = time.Minute
+		f.backfiller.ResultCacheSize = 10
+		ctx := context.Background()
+
+		var first api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &first))
+		requests := len(f.fsAPI.Requests())
+
+		// An identical backfill within the interval gets the previous result.
+		var retry api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &retry))
+		assert.Equal(t, first, retry)
+
+		// A different one is too soon, and doesn't go over federation.
+		var other api.PerformBackfillResponse
+		err := f.backfiller.PerformBackfill(ctx, f.request(1), &other)
+		var tooSoon api.ErrBackfillTooSoon
+		assert.ErrorAs(t, err, &tooSoon)
+		assert.Equal(t, f.room.ID, tooSoon.RoomID)
+		assert.Greater(t, tooSoon.RetryAfter, time.Duration(0))
+		assert.LessOrEqual(t, tooSoon.RetryAfter, time.Hour)
+		assert.Len(t, f.fsAPI.Requests(), requests)
+
+		// Serving another server from the database isn't limited.
+		var served api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, &api.PerformBackfillRequest{
+			RoomID:               f.room.ID,
+			BackwardsExtremities: map[string][]string{"$ignored": {f.messages[2].EventID()}},
+			Limit:                10,
+			ServerName:           fixtureRemoteServer,
+			VirtualHost:          fixtureLocalServer,
+		}, &served))
+		assert.NotEmpty(t, served.Events)
+	})
+}
+
+func TestBackfillIntervals(t *testing.T) {
+	now := time.Unix(1000, 0)
+	intervals := backfillIntervals{now: func() time.Time { return now }}
+
+	_, _, ok := intervals.claim("!a:test", 0)
+	assert.True(t, ok)
+	_, _, ok = intervals.claim("!a:test", 5*time.Second)
+	assert.True(t, ok)
+
+	// The same room is too soon until the interval has passed, other rooms aren't.
+	now = now.Add(2 * time.Second)
+	_, wait, ok := intervals.claim("!a:test", 5*time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+	releaseB, _, ok := intervals.claim("!b:test", 5*time.Second)
+	assert.True(t, ok)
+
+	// A released claim doesn't hold up the next backfill of the room.
+	releaseB()
+	_, _, ok = intervals.claim("!b:test", 5*time.Second)
+	assert.True(t, ok)
+
+	now = now.Add(3 * time.Second)
+	releaseA, _, ok := intervals.claim("!a:test", 5*time.Second)
+	assert.True(t, ok)
+
+	// Releasing a claim which has been superseded leaves the newer claim alone.
+	now = now.Add(5 * time.Second)
+	_, _, ok = intervals.claim("!a:test", 5*time.Second)
+	assert.True(t, ok)
+	releaseA()
+	_, _, ok = intervals.claim("!a:test", 5*time.Second)
+	assert.False(t, ok)
+}
+
+func TestBackfillMinIntervalOnlyCountsSuccessfulBackfills(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		f.backfiller.MinInterval = time.Hour
+		ctx := context.Background()
+		var tooSoon api.ErrBackfillTooSoon
+
+		// A backfill which fails validation never claims the room.
+		invalid := f.request(10)
+		invalid.VirtualHost = "elsewhere.test"
+		err := f.backfiller.PerformBackfill(ctx, invalid, &api.PerformBackfillResponse{})
+		assert.Error(t, err)
+		assert.False(t, errors.As(err, &tooSoon))
+
+		// A backfill which fails releases its claim on the room.
+		f.db.AddStateErr = fmt.Errorf("database unavailable")
+		err = f.backfiller.PerformBackfill(ctx, f.request(10), &api.PerformBackfillResponse{})
+		assert.Error(t, err)
+		assert.False(t, errors.As(err, &tooSoon))
+		f.db.AddStateErr = nil
+
+		// So the next one goes ahead, and only then is the room claimed.
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &api.PerformBackfillResponse{}))
+		err = f.backfiller.PerformBackfill(ctx, f.request(1), &api.PerformBackfillResponse{})
+		assert.ErrorAs(t, err, &tooSoon)
+	})
+}
+
+func TestBackfillForRemoteWithoutHistory(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		remoteRequest := func(f *backfillFixture, fromEventIDs ...string) *api.PerformBackfillRequest {
+			return &api.PerformBackfillRequest{
+				RoomID:               f.room.ID,
+				BackwardsExtremities: map[string][]string{"$ignored": fromEventIDs},
+				Limit:                10,
+				ServerName:           fixtureRemoteServer,
+				VirtualHost:          fixtureLocalServer,
+			}
+		}
+
+		t.Run("history is served", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 2)
+			defer close()
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), remoteRequest(f, f.messages[1].EventID()), &res))
+			assert.NotEmpty(t, res.Events)
+		})
+
+		t.Run("we don't have the events to backfill from", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 2)
+			defer close()
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), remoteRequest(f, f.messages[0].EventID()), &res))
+			assert.Empty(t, res.Events)
+			assert.Empty(t, f.fsAPI.Requests())
+		})
+
+		t.Run("we were never in the room", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 2)
+			defer close()
+			// a room we know about, but which only remote users were ever in
+			room := test.NewRoom(t, f.remoteUser)
+			msg := room.CreateAndInsert(t, f.remoteUser, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+			backfilltest.MustStoreEvents(t, f.db, room, fixtureLocalServer, room.Events())
+			f.room = room
+
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), remoteRequest(f, msg.EventID()), &res))
+			assert.Empty(t, res.Events)
+			assert.Empty(t, f.fsAPI.Requests())
+		})
+	})
+}
+
+func TestBackfillRememberAuthEvents(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, remember := range []bool{false, true} {
+			t.Run(fmt.Sprintf("remember %v", remember), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 1)
+				defer close()
+				ctx := context.Background()
+
+				// A room we know nothing about, where alice changes her displayname. The state before
+				// the earlier message contains her original join, which is only in the auth chain of
+				// the state before the later message.
+				alice := f.remoteUser
+				room := test.NewRoom(t, alice)
+				earlier := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+				room.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{"membership": spec.Join, "displayname": "Alice"}, test.WithStateKey(alice.ID))
+				later := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello again", "msgtype": "m.text"})
+				f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(room))
+				stateIDs := backfilltest.StateIDsBefore(room)
+
+				requester := newBackfillRequester(
+					f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName,
+					nil, nil, room.Version, 0,
+				)
+				requester.roomID = room.ID
+				requester.servers = []spec.ServerName{fixtureRemoteServer}
+				requester.rememberAuthEvents = remember
+
+				state, err := requester.StateBeforeEvent(ctx, room.Version, later.PDU, stateIDs[later.EventID()])
+				assert.NoError(t, err)
+				assert.Len(t, state, len(stateIDs[later.EventID()]))
+				state, err = requester.StateBeforeEvent(ctx, room.Version, earlier.PDU, stateIDs[earlier.EventID()])
+				assert.NoError(t, err)
+				assert.Len(t, state, len(stateIDs[earlier.EventID()]))
+
+				wantRequests := 2
+				if remember {
+					wantRequests = 1
+				}
+				assert.Equal(t, wantRequests, f.fsAPI.CountRequests(backfilltest.EndpointState))
+			})
+		}
+	})
+}
+
+func TestServerLimiter(t *testing.T) {
+	ctx := context.Background()
+	limiter := newServerLimiter(1)
+
+	release, err := limiter.acquire(ctx, "a.test")
+	assert.NoError(t, err)
+	// other servers have their own slots
+	releaseB, err := limiter.acquire(ctx, "b.test")
+	assert.NoError(t, err)
+	releaseB()
+
+	// the server is full, so we wait until the context is done
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = limiter.acquire(timeoutCtx, "a.test")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// or until the slot is released
+	acquired := make(chan struct{})
+	go func() {
+		release, err := limiter.acquire(ctx, "a.test")
+		assert.NoError(t, err)
+		release()
+		close(acquired)
+	}()
+	release()
+	<-acquired
+
+	// a nil limiter doesn't limit anything
+	var unlimited *serverLimiter
+	release, err = unlimited.acquire(ctx, "a.test")
+	assert.NoError(t, err)
+	release()
+}
+
+// concurrencyTrackingAPI records the most /backfill requests it has had in flight at once.
+type concurrencyTrackingAPI struct {
+	*backfilltest.FederationAPI
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (f *concurrencyTrackingAPI) Backfill(ctx context.Context, origin, s spec.ServerName, roomID string, limit int, fromEventIDs []string) (gomatrixserverlib.Transaction, error) {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	f.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+	return f.FederationAPI.Backfill(ctx, origin, s, roomID, limit, fromEventIDs)
+}
+
+func TestBackfillMaxConcurrentRequestsPerServer(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		fsAPI := &concurrencyTrackingAPI{FederationAPI: f.fsAPI}
+		f.backfiller.FSAPI = fsAPI
+		f.backfiller.MaxConcurrentRequestsPerServer = 1
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 4, f.fsAPI.CountRequests(backfilltest.EndpointBackfill))
+		assert.Equal(t, 1, fsAPI.maxInFlight)
+	})
+}
+
+func TestBackfillRedactedEventIDs(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, include := range []bool{false, true} {
+			t.Run(fmt.Sprintf("include %v", include), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 2)
+				defer close()
+				// backfill the history first, so that we have it to serve
+				var backfilled api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &backfilled))
+
+				// a server which was never in the room may not see its history
+				req := &api.PerformBackfillRequest{
+					RoomID:                  f.room.ID,
+					BackwardsExtremities:    map[string][]string{"$ignored": {f.messages[1].EventID()}},
+					Limit:                   10,
+					ServerName:              "third.test",
+					VirtualHost:             fixtureLocalServer,
+					IncludeRedactedEventIDs: include,
+				}
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), req, &res))
+				assert.NotEmpty(t, res.Events)
+
+				if !include {
+					assert.Nil(t, res.RedactedEventIDs)
+					return
+				}
+				if !assert.NotEmpty(t, res.RedactedEventIDs) {
+					return
+				}
+				events := make(map[string]*types.HeaderedEvent, len(res.Events))
+				for _, ev := range res.Events {
+					events[ev.EventID()] = ev
+				}
+				for _, id := range res.RedactedEventIDs {
+					if assert.Contains(t, events, id) {
+						assert.True(t, events[id].Redacted())
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestBackfillRemoteNeverSeesHiddenEvents(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 2)
+		defer close()
+		var backfilled api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &backfilled))
+
+		// a server which was never in the room may not see its history, whatever else it asks for
+		req := &api.PerformBackfillRequest{
+			RoomID:                  f.room.ID,
+			BackwardsExtremities:    map[string][]string{"$ignored": {f.messages[1].EventID()}},
+			Limit:                   10,
+			ServerName:              "third.test",
+			VirtualHost:             fixtureLocalServer,
+			IncludeRedactedEventIDs: true,
+			IncludeEventSources:     true,
+		}
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), req, &res))
+		assert.NotEmpty(t, res.RedactedEventIDs)
+		events := make(map[string]*types.HeaderedEvent, len(res.Events))
+		for _, ev := range res.Events {
+			events[ev.EventID()] = ev
+		}
+		for _, id := range res.RedactedEventIDs {
+			if assert.Contains(t, events, id) {
+				assert.True(t, events[id].Redacted())
+				assert.NotContains(t, string(events[id].JSON()), "hello")
+			}
+		}
+	})
+}
+
+func TestBackfillUnredacted(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 2)
+		defer close()
+		var backfilled api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &backfilled))
+		requests := f.fsAPI.CountRequests(backfilltest.EndpointBackfill)
+
+		// a server which was never in the room may only see its history redacted, but admin tooling can
+		// see the original content even once the events have been served redacted
+		req := &api.PerformBackfillRequest{
+			RoomID:                  f.room.ID,
+			BackwardsExtremities:    map[string][]string{"$ignored": {f.messages[1].EventID()}},
+			Limit:                   10,
+			ServerName:              "third.test",
+			VirtualHost:             fixtureLocalServer,
+			IncludeRedactedEventIDs: true,
+		}
+		var served api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), req, &served))
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.BackfillUnredacted(context.Background(), req, &res))
+		assert.NotEmpty(t, res.RedactedEventIDs)
+		assert.ElementsMatch(t, served.RedactedEventIDs, res.RedactedEventIDs)
+
+		redacted := make(map[string]*types.HeaderedEvent, len(served.Events))
+		for _, ev := range served.Events {
+			redacted[ev.EventID()] = ev
+		}
+		events := make(map[string]*types.HeaderedEvent, len(res.Events))
+		for _, ev := range res.Events {
+			events[ev.EventID()] = ev
+		}
+		messages := 0
+		for _, id := range res.RedactedEventIDs {
+			if assert.Contains(t, events, id) && assert.Contains(t, redacted, id) {
+				assert.True(t, redacted[id].Redacted())
+				assert.False(t, events[id].Redacted())
+				if events[id].Type() == "m.room.message" {
+					messages++
+					assert.Contains(t, string(events[id].Content()), "hello")
+					assert.NotContains(t, string(redacted[id].JSON()), "hello")
+				}
+			}
+		}
+		assert.NotZero(t, messages)
+
+		// our own view of the history is served from the database rather than backfilled again
+		local := *req
+		local.ServerName = fixtureLocalServer
+		res = api.PerformBackfillResponse{}
+		assert.NoError(t, f.backfiller.BackfillUnredacted(context.Background(), &local, &res))
+		assert.NotEmpty(t, res.Events)
+		assert.Equal(t, requests, f.fsAPI.CountRequests(backfilltest.EndpointBackfill))
+
+		local.DryRun = true
+		assert.Error(t, f.backfiller.BackfillUnredacted(context.Background(), &local, &api.PerformBackfillResponse{}))
+	})
+}
+
+// failingEventSink records the batches of events exported to it, failing the first failures times it is called.
+type failingEventSink struct {
+	failures int
+	calls    int
+	exported [][]string
+	events   map[string]*types.HeaderedEvent
+}
+
+func (s *failingEventSink) ExportBackfilledEvents(ctx context.Context, events []*types.HeaderedEvent) error {
+	s.calls++
+	if s.calls <= s.failures {
+		return fmt.Errorf("sink unavailable")
+	}
+	var eventIDs []string
+	if s.events == nil {
+		s.events = make(map[string]*types.HeaderedEvent)
+	}
+	for _, ev := range events {
+		eventIDs = append(eventIDs, ev.EventID())
+		s.events[ev.EventID()] = ev
+	}
+	s.exported = append(s.exported, eventIDs)
+	return nil
+}
+
+func TestBackfillEventSink(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, tc := range []struct {
+			name     string
+			failures int
+			result   string
+		}{
+			{name: "exported", failures: 0, result: "exported"},
+			{name: "retried", failures: 1, result: "retried"},
+			{name: "dropped", failures: maxEventSinkAttempts, result: "dropped"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 3)
+				defer close()
+				sink := &failingEventSink{failures: tc.failures}
+				f.backfiller.EventSink = sink
+				before := testutil.ToFloat64(backfillEventSinkBatches.WithLabelValues(tc.result))
+
+				// failures of the sink never fail the backfill
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+				assert.Equal(t, before+1, testutil.ToFloat64(backfillEventSinkBatches.WithLabelValues(tc.result)))
+				if tc.failures >= maxEventSinkAttempts {
+					assert.Empty(t, sink.exported)
+					return
+				}
+				// the missing messages are exported oldest first, after the earlier events they were returned with
+				if assert.Len(t, sink.exported, 1) && assert.GreaterOrEqual(t, len(sink.exported[0]), len(f.messages)-1) {
+					var want []string
+					for _, ev := range f.messages[:len(f.messages)-1] {
+						want = append(want, ev.EventID())
+					}
+					assert.Equal(t, want, sink.exported[0][len(sink.exported[0])-len(want):])
+				}
+			})
+		}
+	})
+}
+
+func TestWarmBackfillState(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, warm := range []bool{false, true} {
+			t.Run(fmt.Sprintf("warm %v", warm), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 3)
+				defer close()
+				ctx := context.Background()
+
+				// The remote server only returns the messages, so the state before the oldest of them has to be
+				// requested unless we know the state before the state event it follows, which we have already.
+				stateEvents := f.room.Events()[:len(f.room.Events())-len(f.messages)]
+				srv := backfilltest.NewServer(f.room)
+				for _, ev := range stateEvents {
+					delete(srv.Events, ev.EventID())
+				}
+				f.fsAPI.AddServer(fixtureRemoteServer, srv)
+
+				if warm {
+					fromEventIDs := []string{stateEvents[len(stateEvents)-1].EventID(), "$unknown:remote"}
+					warmed, err := f.backfiller.WarmBackfillState(ctx, f.room.ID, fromEventIDs)
+					assert.NoError(t, err)
+					assert.Equal(t, 1, warmed)
+				}
+
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+				assert.NotEmpty(t, res.Events)
+				wantRequests := 1
+				if warm {
+					wantRequests = 0
+				}
+				assert.Equal(t, wantRequests, f.fsAPI.CountRequests(backfilltest.EndpointStateIDs))
+
+				// The backfill used up the warmed state, so it isn't held any longer.
+				assert.Nil(t, f.backfiller.warm.take(f.room.ID))
+			})
+		}
+	})
+}
+
+func TestBackfillWarmStateIsBounded(t *testing.T) {
+	now := time.Unix(1000, 0)
+	warm := backfillWarmState{now: func() time.Time { return now }}
+	stateIDs := map[string][]string{"$event:test": {"$create:test"}}
+
+	// Warmed state is held until it expires.
+	warm.add("!a:test", nil, stateIDs)
+	now = now.Add(warmedRoomTTL - time.Second)
+	if room := warm.take("!a:test"); assert.NotNil(t, room) {
+		assert.Equal(t, stateIDs, room.beforeStateIDs)
+	}
+	assert.Nil(t, warm.take("!a:test"))
+	warm.add("!a:test", nil, stateIDs)
+	now = now.Add(warmedRoomTTL)
+	assert.Nil(t, warm.take("!a:test"))
+
+	// Expired rooms are forgotten first once too many rooms are warmed, then any room.
+	for i := 0; i < maxWarmedRooms; i++ {
+		warm.add(fmt.Sprintf("!%d:test", i), nil, stateIDs)
+	}
+	now = now.Add(warmedRoomTTL)
+	warm.add("!fresh:test", nil, stateIDs)
+	assert.Len(t, warm.rooms, 1)
+	for i := 0; i < maxWarmedRooms; i++ {
+		warm.add(fmt.Sprintf("!%d:test", i), nil, stateIDs)
+	}
+	assert.Len(t, warm.rooms, maxWarmedRooms)
+}
+
+func TestBackfillRedactionInBatch(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, concurrency := range []int{1, 4} {
+			t.Run(fmt.Sprintf("persist concurrency %d", concurrency), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 1)
+				defer close()
+				f.backfiller.PersistConcurrency = concurrency
+				ctx := context.Background()
+
+				// A room where alice redacts one of her messages, in which we only have the latest message.
+				alice := f.remoteUser
+				bob := test.NewUser(t, test.WithSigningServer(fixtureLocalServer, "ed25519:local", test.PrivateKeyB))
+				room := test.NewRoom(t, alice)
+				room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+				stateEvents := append([]*types.HeaderedEvent(nil), room.Events()...)
+				target := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "oops", "msgtype": "m.text"})
+				redaction := room.CreateAndInsert(t, alice, spec.MRoomRedaction, map[string]interface{}{}, test.WithRedacts(target.EventID()))
+				latest := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+				backfilltest.MustStoreEvents(t, f.db, room, fixtureLocalServer, append(stateEvents, latest))
+				f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(room))
+
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(ctx, &api.PerformBackfillRequest{
+					RoomID:               room.ID,
+					BackwardsExtremities: map[string][]string{latest.EventID(): latest.PrevEventIDs()},
+					Limit:                10,
+					ServerName:           fixtureLocalServer,
+					VirtualHost:          fixtureLocalServer,
+				}, &res))
+
+				var found bool
+				for _, ev := range res.Events {
+					switch ev.EventID() {
+					case target.EventID():
+						found = true
+						assert.JSONEq(t, "{}", string(ev.Content()), "the target of the redaction should be returned redacted")
+						assert.Equal(t, redaction.EventID(), gjson.GetBytes(ev.Unsigned(), "redacted_by").Str)
+					case redaction.EventID():
+						assert.Equal(t, target.EventID(), ev.Redacts())
+					}
+				}
+				assert.True(t, found, "the target of the redaction should be backfilled")
+			})
+		}
+	})
+}
+
+func TestBackfillEventSinkRedactions(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 1)
+		defer close()
+		sink := &failingEventSink{}
+		f.backfiller.EventSink = sink
+		ctx := context.Background()
+
+		// A room where alice redacts one of her messages, which is backfilled along with the redaction.
+		alice := f.remoteUser
+		bob := test.NewUser(t, test.WithSigningServer(fixtureLocalServer, "ed25519:local", test.PrivateKeyB))
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+		stateEvents := append([]*types.HeaderedEvent(nil), room.Events()...)
+		target := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "oops", "msgtype": "m.text"})
+		redaction := room.CreateAndInsert(t, alice, spec.MRoomRedaction, map[string]interface{}{}, test.WithRedacts(target.EventID()))
+		latest := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+		backfilltest.MustStoreEvents(t, f.db, room, fixtureLocalServer, append(stateEvents, latest))
+		f.fsAPI.AddServer(fixtureRemoteServer, backfilltest.NewServer(room))
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, &api.PerformBackfillRequest{
+			RoomID:               room.ID,
+			BackwardsExtremities: map[string][]string{latest.EventID(): latest.PrevEventIDs()},
+			Limit:                10,
+			ServerName:           fixtureLocalServer,
+			VirtualHost:          fixtureLocalServer,
+		}, &res))
+
+		assert.Contains(t, sink.events, redaction.EventID())
+		if exported, ok := sink.events[target.EventID()]; assert.True(t, ok, "the target of the redaction should be exported") {
+			assert.JSONEq(t, "{}", string(exported.Content()), "the sink should only see the redacted content")
+			assert.NotContains(t, string(exported.JSON()), "oops")
+		}
+	})
+}
+
+func TestBackfillStateResets(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, reject := range []bool{false, true} {
+			t.Run(fmt.Sprintf("reject %v", reject), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 3)
+				defer close()
+				f.backfiller.RejectStateResets = reject
+
+				// The remote server only returns the messages, and claims that there are no power levels
+				// in the state before the oldest of them, even though they are one of its auth events.
+				var powerLevelsID string
+				stateEvents := f.room.Events()[:len(f.room.Events())-len(f.messages)]
+				srv := backfilltest.NewServer(f.room)
+				for _, ev := range stateEvents {
+					delete(srv.Events, ev.EventID())
+					if ev.Type() == spec.MRoomPowerLevels {
+						powerLevelsID = ev.EventID()
+					}
+				}
+				var stateIDs []string
+				for _, id := range srv.StateIDs[f.messages[0].EventID()] {
+					if id != powerLevelsID {
+						stateIDs = append(stateIDs, id)
+					}
+				}
+				srv.StateIDs[f.messages[0].EventID()] = stateIDs
+				f.fsAPI.AddServer(fixtureRemoteServer, srv)
+
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+				assert.Len(t, res.Events, 2)
+				assert.Equal(t, float64(2), testutil.ToFloat64(backfillStateResets.WithLabelValues(f.room.ID, spec.MRoomPowerLevels)))
+
+				wantStates := 2
+				if reject {
+					wantStates = 0
+				}
+				assert.Equal(t, wantStates, f.db.Calls("AddAndSetState")+f.db.Calls("SetState"))
+
+				// Events whose state is refused aren't stored at all, rather than being left without state.
+				for _, ev := range res.Events {
+					nids, err := f.db.EventNIDs(context.Background(), []string{ev.EventID()})
+					assert.NoError(t, err)
+					if reject {
+						assert.NotContains(t, nids, ev.EventID())
+						continue
+					}
+					_, err = f.db.SnapshotNIDFromEventID(context.Background(), ev.EventID())
+					assert.NoError(t, err)
+				}
+			})
+		}
+	})
+}
+
+func TestBackfillTargetGap(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+		ctx := context.Background()
+
+		latest := f.messages[len(f.messages)-1]
+		req := f.request(2)
+		req.BackwardsExtremities = nil
+		req.TargetGap = &api.BackfillGap{SuccessorEventID: latest.EventID(), MissingEventIDs: latest.PrevEventIDs()}
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, req, &res))
+
+		// Only the events right before the successor are fetched, without walking backwards with /backfill.
+		var gotIDs []string
+		for _, ev := range res.Events {
+			gotIDs = append(gotIDs, ev.EventID())
+		}
+		assert.ElementsMatch(t, []string{f.messages[2].EventID(), f.messages[3].EventID()}, gotIDs)
+		assert.Equal(t, 0, f.fsAPI.CountRequests(backfilltest.EndpointBackfill))
+		if requests := f.fsAPI.Requests(); assert.NotEmpty(t, requests) {
+			assert.Equal(t, backfilltest.Request{Endpoint: backfilltest.EndpointMissingEvents, Server: fixtureRemoteServer, EventID: latest.EventID()}, requests[0])
+		}
+		nids, err := f.db.EventNIDs(ctx, gotIDs)
+		assert.NoError(t, err)
+		assert.Len(t, nids, 2)
+
+		// A gap needs both a successor and the events missing before it.
+		req.TargetGap = &api.BackfillGap{SuccessorEventID: latest.EventID()}
+		assert.Error(t, f.backfiller.PerformBackfill(ctx, req, &api.PerformBackfillResponse{}))
+	})
+}
+
+func TestFailureLog(t *testing.T) {
+	now := time.Unix(1000, 0)
+	failures := newFailureLog(time.Minute)
+	failures.now = func() time.Time { return now }
+	logger := logrus.NewEntry(logrus.New())
+
+	entry, ok := failures.entry(logger, "a", failureGetEvent)
+	assert.True(t, ok)
+	assert.NotContains(t, entry.Data, "suppressed")
+
+	// The same failure with the same server is suppressed, but not other failures or servers.
+	_, ok = failures.entry(logger, "a", failureGetEvent)
+	assert.False(t, ok)
+	_, ok = failures.entry(logger, "a", failureGetEvent)
+	assert.False(t, ok)
+	_, ok = failures.entry(logger, "b", failureGetEvent)
+	assert.True(t, ok)
+	_, ok = failures.entry(logger, "a", failureLoadEvent)
+	assert.True(t, ok)
+
+	// Once the interval has passed it is logged again, along with how many were suppressed.
+	now = now.Add(time.Minute)
+	entry, ok = failures.entry(logger, "a", failureGetEvent)
+	assert.True(t, ok)
+	assert.Equal(t, 2, entry.Data["suppressed"])
+	entry, ok = failures.entry(logger, "b", failureGetEvent)
+	assert.True(t, ok)
+	assert.NotContains(t, entry.Data, "suppressed")
+
+	// Without a failure log every failure is logged.
+	var unlimited *failureLog
+	for i := 0; i < 2; i++ {
+		_, ok = unlimited.entry(logger, "a", failureGetEvent)
+		assert.True(t, ok)
+	}
+}
+
+func TestBackfillFailureLoggedAgainstServer(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		f.backfiller.FailureLogInterval = time.Minute
+		f.fsAPI.AddServer(fixtureRemoteServer, &backfilltest.Server{Unreachable: true})
+
+		var res api.PerformBackfillResponse
+		assert.Error(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+
+		// The failure is recorded against the server which was asked, so it is only suppressed for that server.
+		failures := f.backfiller.failures()
+		assert.Contains(t, failures.logged, failureLogKey{server: fixtureRemoteServer, class: failureRequestBackfill})
+		assert.NotContains(t, failures.logged, failureLogKey{server: "", class: failureRequestBackfill})
+	})
+}
+
+func TestBackfillPreferRecentServers(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, prefer := range []bool{false, true} {
+			t.Run(fmt.Sprintf("prefer %v", prefer), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 3)
+				defer close()
+				f.backfiller.PreferRecentServers = prefer
+				ctx := context.Background()
+
+				// The hinted server isn't in the room, but provides the history the first time.
+				hinted := spec.ServerName("hinted")
+				f.fsAPI.AddServer(hinted, backfilltest.NewServer(f.room))
+				req := f.request(10)
+				req.ServerHints = []spec.ServerName{hinted}
+				assert.NoError(t, f.backfiller.PerformBackfill(ctx, req, &api.PerformBackfillResponse{}))
+
+				// Without hints, it is only tried again if we remember that it provided history recently.
+				before := len(f.fsAPI.Requests())
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+				assert.NotEmpty(t, res.Events)
+				requests := f.fsAPI.Requests()[before:]
+				wantServer := spec.ServerName(fixtureRemoteServer)
+				if prefer {
+					wantServer = hinted
+				}
+				if assert.NotEmpty(t, requests) {
+					assert.Equal(t, wantServer, requests[0].Server)
+				}
+			})
+		}
+	})
+}
+
+func TestValidateRoomVersion(t *testing.T) {
+	alice := test.NewUser(t)
+	versions := []gomatrixserverlib.RoomVersion{
+		gomatrixserverlib.RoomVersionV1,  // randomised event IDs
+		gomatrixserverlib.RoomVersionV3,  // base64 reference hashes
+		gomatrixserverlib.RoomVersionV10, // URL-safe base64 reference hashes
+	}
+	for _, version := range versions {
+		room := test.NewRoom(t, alice, test.RoomVersion(version))
+		msg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+		for _, other := range versions {
+			err := validateRoomVersion(msg.PDU, other)
+			if other == version {
+				assert.NoError(t, err, "room version %s", version)
+			} else {
+				assert.Error(t, err, "event from room version %s checked against %s", version, other)
+			}
+		}
+		assert.Len(t, eventsInRoomVersion(context.Background(), version, []gomatrixserverlib.PDU{msg.PDU}), 1)
+		assert.Empty(t, eventsInRoomVersion(context.Background(), gomatrixserverlib.RoomVersionV11, []gomatrixserverlib.PDU{msg.PDU}))
+	}
+}
+
+func TestEventIDHasFormat(t *testing.T) {
+	std := "$" + "abc+def/" + strings.Repeat("A", 35)
+	urlSafe := "$" + "abc-def_" + strings.Repeat("A", 35)
+	for _, tc := range []struct {
+		eventID string
+		format  gomatrixserverlib.EventIDFormat
+		want    bool
+	}{
+		{"$abc:example.com", gomatrixserverlib.EventIDFormatV1, true},
+		{"abc:example.com", gomatrixserverlib.EventIDFormatV1, false},
+		{"$abc", gomatrixserverlib.EventIDFormatV1, false},
+		{"$:example.com", gomatrixserverlib.EventIDFormatV1, false},
+		{std, gomatrixserverlib.EventIDFormatV2, true},
+		{std, gomatrixserverlib.EventIDFormatV3, false},
+		{urlSafe, gomatrixserverlib.EventIDFormatV3, true},
+		{urlSafe, gomatrixserverlib.EventIDFormatV2, false},
+		{"$abc:example.com", gomatrixserverlib.EventIDFormatV3, false},
+		{"$" + strings.Repeat("A", 42), gomatrixserverlib.EventIDFormatV3, false},
+	} {
+		assert.Equal(t, tc.want, eventIDHasFormat(tc.eventID, tc.format), "%s in format %d", tc.eventID, tc.format)
+	}
+}
+
+func TestExportBackfill(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+
+		var buf bytes.Buffer
+		exported, err := f.backfiller.ExportBackfill(context.Background(), f.room.ID, fixtureLocalServer, 10, &buf)
+		assert.NoError(t, err)
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		assert.Equal(t, exported, len(lines))
+
+		// The missing messages are exported oldest first, along with the state before them.
+		positions := make(map[string]int, len(lines))
+		for i, line := range lines {
+			var exportedEvent api.ExportedBackfillEvent
+			assert.NoError(t, json.Unmarshal([]byte(line), &exportedEvent))
+			assert.Equal(t, f.room.Version, exportedEvent.RoomVersion)
+			assert.Equal(t, f.room.ID, gjson.GetBytes(exportedEvent.Event, "room_id").String())
+			if gjson.GetBytes(exportedEvent.Event, "type").String() != spec.MRoomCreate {
+				assert.NotEmpty(t, exportedEvent.StateBeforeIDs)
+			}
+			positions[exportedEvent.EventID] = i
+		}
+		for i, msg := range f.messages[:len(f.messages)-1] {
+			pos, ok := positions[msg.EventID()]
+			assert.True(t, ok, "message %d wasn't exported", i)
+			if i > 0 {
+				assert.Greater(t, pos, positions[f.messages[i-1].EventID()])
+			}
+		}
+
+		// Nothing was persisted.
+		assert.Equal(t, 0, f.db.Calls("StoreEvent"))
+	})
+}
+
+func TestExportBackfillDoesNotClaimInterval(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		f.backfiller.MinInterval = time.Hour
+		ctx := context.Background()
+
+		// An export is a dry run, so a real backfill straight after it still goes ahead.
+		_, err := f.backfiller.ExportBackfill(ctx, f.room.ID, fixtureLocalServer, 10, io.Discard)
+		assert.NoError(t, err)
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+		assert.NotEmpty(t, res.Events)
+	})
+}
+
+func TestBackfillTimeout(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, timedOut := range []bool{false, true} {
+			t.Run(fmt.Sprintf("timed out %v", timedOut), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 3)
+				defer close()
+				f.backfiller.Timeout = time.Minute
+				if timedOut {
+					// The only server in the room is too slow to respond within the timeout.
+					f.backfiller.Timeout = 50 * time.Millisecond
+					srv := backfilltest.NewServer(f.room)
+					srv.Delay = time.Minute
+					f.fsAPI.AddServer(fixtureRemoteServer, srv)
+				}
+
+				var res api.PerformBackfillResponse
+				start := time.Now()
+				assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+				assert.Less(t, time.Since(start), 10*time.Second)
+				assert.Equal(t, timedOut, res.Partial)
+				if timedOut {
+					assert.Empty(t, res.Events)
+					assert.Equal(t, 0, f.db.Calls("StoreEvent"))
+				} else {
+					assert.NotEmpty(t, res.Events)
+				}
+			})
+		}
+	})
+}
+
+func TestBackfillTimeoutDoesNotCoverPersistence(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 1)
+		defer close()
+		ctx := context.Background()
+
+		// A room where alice changes her display name twice. We have the latest message and the state before it,
+		// without the state before her second change, and not her first change, which authorises the second.
+		alice := f.remoteUser
+		bob := test.NewUser(t, test.WithSigningServer(fixtureLocalServer, "ed25519:local", test.PrivateKeyB))
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+		stateEvents := append([]*types.HeaderedEvent(nil), room.Events()...)
+		renamed := room.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{"membership": spec.Join, "displayname": "alice"}, test.WithStateKey(alice.ID))
+		renamedAgain := room.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{"membership": spec.Join, "displayname": "alice again"}, test.WithStateKey(alice.ID))
+		latest := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello", "msgtype": "m.text"})
+		backfilltest.MustStoreEvents(t, f.db, room, fixtureLocalServer, stateEvents)
+		persistEvents(ctx, f.db, f.backfiller.Querier, []gomatrixserverlib.PDU{renamedAgain.PDU}, nil, 1)
+		backfilltest.MustStoreEvents(t, f.db, room, fixtureLocalServer, []*types.HeaderedEvent{latest})
+
+		// The server only returns the second change, and fetching the first, which only happens while persisting
+		// the second, takes longer than the timeout.
+		srv := backfilltest.NewServer(room)
+		srv.BackfillLimit = 1
+		srv.EventDelay = 300 * time.Millisecond
+		f.fsAPI.AddServer(fixtureRemoteServer, srv)
+		f.backfiller.Timeout = 100 * time.Millisecond
+
+		var res api.PerformBackfillResponse
+		start := time.Now()
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, &api.PerformBackfillRequest{
+			RoomID:               room.ID,
+			BackwardsExtremities: map[string][]string{latest.EventID(): latest.PrevEventIDs()},
+			Limit:                1,
+			ServerName:           fixtureLocalServer,
+			VirtualHost:          fixtureLocalServer,
+		}, &res))
+
+		// The event was gathered within the timeout, and persisted in full even though that took longer.
+		assert.False(t, res.Partial)
+		if assert.Len(t, res.Events, 1) {
+			assert.Equal(t, renamedAgain.EventID(), res.Events[0].EventID())
+		}
+		assert.GreaterOrEqual(t, time.Since(start), srv.EventDelay)
+		nids, err := f.db.EventNIDs(ctx, []string{renamed.EventID()})
+		assert.NoError(t, err)
+		assert.Contains(t, nids, renamed.EventID())
+		_, err = f.db.SnapshotNIDFromEventID(ctx, renamedAgain.EventID())
+		assert.NoError(t, err, "the state before the backfilled event should have been persisted")
+	})
+}
+
+func TestBackfillViaRelay(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+		const relay = spec.ServerName("relay")
+		f.backfiller.RelayServer = relay
+
+		// We can't reach the server in the room, but the relay can fetch its events for us.
+		f.fsAPI.AddServer(fixtureRemoteServer, &backfilltest.Server{Unreachable: true})
+		f.fsAPI.AddServer(relay, backfilltest.NewServer(f.room))
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+		assert.NotEmpty(t, res.Events)
+
+		// Every request was meant for the server in the room, and only went to the relay once that failed.
+		requests := f.fsAPI.Requests()
+		assert.NotEmpty(t, requests)
+		var direct []backfilltest.Request
+		for _, req := range requests {
+			if req.Server == relay {
+				assert.Contains(t, direct, backfilltest.Request{Endpoint: req.Endpoint, Server: fixtureRemoteServer, EventID: req.EventID})
+			} else {
+				assert.Equal(t, fixtureRemoteServer, req.Server)
+				direct = append(direct, req)
+			}
+		}
+	})
+}
+
+func TestRelayFederationAPI(t *testing.T) {
+	ctx := context.Background()
+	room := test.NewRoom(t, test.NewUser(t))
+	const relay = spec.ServerName("relay")
+	fsAPI := backfilltest.NewFederationAPI()
+	fsAPI.AddServer("reachable", backfilltest.NewServer(room))
+	fsAPI.AddServer("a", &backfilltest.Server{Unreachable: true})
+	fsAPI.AddServer("b", &backfilltest.Server{Unreachable: true})
+	fsAPI.AddServer(relay, backfilltest.NewServer(room))
+	limiter := newServerLimiter(1)
+	f := (&Backfiller{FSAPI: fsAPI, RelayServer: relay, limiter: limiter}).federation()
+	latest := room.Events()[len(room.Events())-1].EventID()
+
+	// A reachable server is asked directly.
+	_, err := f.Backfill(ctx, fixtureLocalServer, "reachable", room.ID, 10, []string{latest})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, countRequestsTo(fsAPI, relay))
+
+	// The same request meant for two unreachable servers is only sent to the relay once.
+	for _, server := range []spec.ServerName{"a", "b"} {
+		tx, err := f.Backfill(ctx, fixtureLocalServer, server, room.ID, 10, []string{latest})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, tx.PDUs)
+	}
+	assert.Equal(t, 1, countRequestsTo(fsAPI, relay))
+
+	// Requests to the relay wait for the limiter of the relay, not of the server they were meant for.
+	release, err := limiter.acquire(ctx, relay)
+	assert.NoError(t, err)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = f.GetEvent(timeoutCtx, fixtureLocalServer, "a", latest)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, countRequestsTo(fsAPI, relay))
+	release()
+}
+
+// countRequestsTo returns how many requests were made to the given server.
+func countRequestsTo(fsAPI *backfilltest.FederationAPI, server spec.ServerName) int {
+	count := 0
+	for _, req := range fsAPI.Requests() {
+		if req.Server == server {
+			count++
+		}
+	}
+	return count
+}
+
+func TestBackfillStateCalculationsMetric(t *testing.T) {
+	fallbacks := func() float64 {
+		total := 0.0
+		for _, reason := range []string{stateFallbackNoPrevEvent, stateFallbackMultiplePrevEvents, stateFallbackMissingState, stateFallbackCalculationFailed} {
+			total += testutil.ToFloat64(backfillStateCalculations.WithLabelValues("federation", reason))
+		}
+		return total
+	}
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+		// The remote server only returns the messages, so the state before the oldest of them can't be rolled
+		// forwards and has to be requested.
+		srv := backfilltest.NewServer(f.room)
+		for _, ev := range f.room.Events()[:len(f.room.Events())-len(f.messages)] {
+			delete(srv.Events, ev.EventID())
+		}
+		f.fsAPI.AddServer(fixtureRemoteServer, srv)
+		fastPathBefore := testutil.ToFloat64(backfillStateCalculations.WithLabelValues("fast_path", ""))
+		fallbacksBefore := fallbacks()
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+		assert.NotEmpty(t, res.Events)
+
+		// With only one server in the room, every fall back to federation makes exactly one /state_ids request.
+		assert.Greater(t, testutil.ToFloat64(backfillStateCalculations.WithLabelValues("fast_path", "")), fastPathBefore)
+		assert.NotZero(t, f.fsAPI.CountRequests(backfilltest.EndpointStateIDs))
+		assert.Equal(t, float64(f.fsAPI.CountRequests(backfilltest.EndpointStateIDs)), fallbacks()-fallbacksBefore)
+	})
+}
+
+func TestBackfillMultipleRounds(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, maxRounds := range []int{1, 5} {
+			t.Run(fmt.Sprintf("max rounds %d", maxRounds), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 10)
+				defer close()
+				f.backfiller.MaxRounds = maxRounds
+				// The server only returns a few events at a time, so more rounds are needed to get enough events.
+				srv := backfilltest.NewServer(f.room)
+				srv.BackfillLimit = 3
+				f.fsAPI.AddServer(fixtureRemoteServer, srv)
+
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(8), &res))
+				if maxRounds == 1 {
+					assert.Len(t, res.Events, 3)
+					assert.Equal(t, 1, f.fsAPI.CountRequests(backfilltest.EndpointBackfill))
+					return
+				}
+				assert.GreaterOrEqual(t, len(res.Events), 8)
+				assert.Equal(t, 3, f.fsAPI.CountRequests(backfilltest.EndpointBackfill))
+
+				// Each round carried on from where the last one left off, and everything was persisted.
+				seen := make(map[string]bool, len(res.Events))
+				for _, ev := range res.Events {
+					assert.False(t, seen[ev.EventID()], "event %s returned twice", ev.EventID())
+					seen[ev.EventID()] = true
+				}
+				for _, msg := range f.messages[len(f.messages)-9 : len(f.messages)-1] {
+					assert.True(t, seen[msg.EventID()], "message %s wasn't backfilled", msg.EventID())
+				}
+				assert.Equal(t, len(res.Events), f.db.Calls("StoreEvent"))
+			})
+		}
+	})
+}
+
+func TestBackfillEventSources(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		sourcesOf := func(res *api.PerformBackfillResponse, source api.BackfillEventSource) []api.BackfillEventSource {
+			return eventSources(source, len(res.Events))
+		}
+
+		t.Run("federation and cache", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 3)
+			defer close()
+			f.backfiller.ResultCacheTTL = time.Minute
+			f.backfiller.ResultCacheSize = 10
+			ctx := context.Background()
+
+			var res api.PerformBackfillResponse
+			req := f.request(10)
+			req.IncludeEventSources = true
+			assert.NoError(t, f.backfiller.PerformBackfill(ctx, req, &res))
+			assert.NotEmpty(t, res.Events)
+			assert.Equal(t, sourcesOf(&res, api.BackfillEventSourceFederation), res.EventSources)
+
+			var retry api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(ctx, req, &retry))
+			assert.Equal(t, res.Events, retry.Events)
+			assert.Equal(t, sourcesOf(&retry, api.BackfillEventSourceCache), retry.EventSources)
+			// The cached result isn't changed by being served from the cache.
+			assert.Equal(t, sourcesOf(&res, api.BackfillEventSourceFederation), res.EventSources)
+
+			// Sources are only included when asked for.
+			var without api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &without))
+			assert.Nil(t, without.EventSources)
+		})
+
+		t.Run("database", func(t *testing.T) {
+			f, close := newBackfillFixture(t, dbType, 2)
+			defer close()
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), &api.PerformBackfillRequest{
+				RoomID:               f.room.ID,
+				BackwardsExtremities: map[string][]string{"$ignored": {f.messages[1].EventID()}},
+				Limit:                10,
+				ServerName:           fixtureRemoteServer,
+				VirtualHost:          fixtureLocalServer,
+				IncludeEventSources:  true,
+			}, &res))
+			assert.NotEmpty(t, res.Events)
+			assert.Equal(t, sourcesOf(&res, api.BackfillEventSourceDatabase), res.EventSources)
+		})
+	})
+}
+
+func TestBackfillPurgeHorizon(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 5)
+		defer close()
+		ctx := context.Background()
+		// Everything before the third message was purged.
+		assert.NoError(t, f.db.SetPurgeHorizon(ctx, f.room.ID, types.PurgeHorizon{Depth: f.messages[2].Depth()}))
+		before := testutil.ToFloat64(backfillPurgedEvents.WithLabelValues(f.room.ID))
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+		returned := map[string]bool{}
+		for _, ev := range res.Events {
+			returned[ev.EventID()] = true
+		}
+		assert.True(t, returned[f.messages[2].EventID()])
+		assert.True(t, returned[f.messages[3].EventID()])
+		assert.False(t, returned[f.messages[0].EventID()])
+		assert.False(t, returned[f.messages[1].EventID()])
+
+		existing, err := f.db.ExistingEventIDs(ctx, []string{f.messages[0].EventID(), f.messages[1].EventID(), f.messages[2].EventID()})
+		assert.NoError(t, err)
+		assert.False(t, existing[f.messages[0].EventID()], "purged history was persisted")
+		assert.False(t, existing[f.messages[1].EventID()], "purged history was persisted")
+		assert.True(t, existing[f.messages[2].EventID()])
+		assert.GreaterOrEqual(t, testutil.ToFloat64(backfillPurgedEvents.WithLabelValues(f.room.ID))-before, float64(2))
+	})
+}
+
+// futureRoomVersionDatabase reports that every room has a room version which we don't support.
+type futureRoomVersionDatabase struct {
+	*backfilltest.Database
+}
+
+func (d futureRoomVersionDatabase) RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error) {
+	info, err := d.Database.RoomInfo(ctx, roomID)
+	if err != nil || info == nil {
+		return info, err
+	}
+	future := &types.RoomInfo{}
+	future.CopyFrom(info)
+	future.RoomVersion = "org.example.future"
+	return future, nil
+}
+
+func TestBackfillUnsupportedRoomVersion(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		f.backfiller.DB = futureRoomVersionDatabase{f.db}
+
+		var res api.PerformBackfillResponse
+		err := f.backfiller.PerformBackfill(context.Background(), f.request(10), &res)
+		var unsupported api.ErrUnsupportedRoomVersion
+		if assert.ErrorAs(t, err, &unsupported) {
+			assert.Equal(t, f.room.ID, unsupported.RoomID)
+			assert.Equal(t, gomatrixserverlib.RoomVersion("org.example.future"), unsupported.RoomVersion)
+		}
+		assert.Empty(t, res.Events)
+		assert.Empty(t, f.fsAPI.Requests(), "servers were asked for events which can't be loaded")
+		assert.Zero(t, f.db.Calls("StoreEvent"))
+	})
+}
+
+func TestRepairState(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 3)
+		defer close()
+		ctx := context.Background()
+		latest := f.messages[len(f.messages)-1]
+		wantStateIDs := backfilltest.StateIDsBefore(f.room)[latest.EventID()]
+
+		// Break the state before the latest message, as if a server had returned bad /state_ids for it.
+		nids, err := f.db.EventNIDs(ctx, []string{latest.EventID(), f.room.Events()[0].EventID()})
+		assert.NoError(t, err)
+		createEntries, err := f.db.StateEntriesForEventIDs(ctx, []string{f.room.Events()[0].EventID()}, true)
+		assert.NoError(t, err)
+		_, err = f.db.AddAndSetState(ctx, f.info.RoomNID, nids[latest.EventID()].EventNID, nil, createEntries)
+		assert.NoError(t, err)
+		requester := newBackfillRequester(f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName, nil, nil, f.room.Version, 0)
+		broken, err := requester.localStateIDsBeforeEvent(ctx, latest.PDU)
+		assert.NoError(t, err)
+		assert.Len(t, broken, 1)
+
+		repaired, err := f.backfiller.RepairState(ctx, f.room.ID, fixtureLocalServer, []string{latest.EventID()})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{latest.EventID()}, repaired)
+		stateIDs, err := requester.localStateIDsBeforeEvent(ctx, latest.PDU)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, wantStateIDs, stateIDs)
+		assert.Equal(t, 1, f.fsAPI.CountRequests("state_ids"))
+
+		_, err = f.backfiller.RepairState(ctx, f.room.ID, fixtureLocalServer, []string{"$unknown"})
+		assert.Error(t, err)
+	})
+}
+
+func TestBackfillServersCache(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		const cached = spec.ServerName("cached.example")
+		newFixture := func(t *testing.T, refreshConcurrently bool) (*backfillFixture, string, func()) {
+			f, close := newBackfillFixture(t, dbType, 3)
+			f.backfiller.ServersCacheTTL = time.Minute
+			f.backfiller.RefreshServersConcurrently = refreshConcurrently
+			f.fsAPI.AddServer(cached, backfilltest.NewServer(f.room))
+			latest := f.messages[len(f.messages)-1]
+			return f, roomServersCacheKey(f.room.ID, latest.EventID(), fixtureLocalServer, false, false), close
+		}
+		backfilledFrom := func(f *backfillFixture) []spec.ServerName {
+			var servers []spec.ServerName
+			for _, req := range f.fsAPI.Requests() {
+				if req.Endpoint == "backfill" {
+					servers = append(servers, req.Server)
+				}
+			}
+			return servers
+		}
+		t.Run("servers are cached", func(t *testing.T) {
+			f, key, close := newFixture(t, false)
+			defer close()
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+			entry, fresh, ok := f.backfiller.roomServers().get(key)
+			assert.True(t, ok)
+			assert.True(t, fresh)
+			assert.True(t, entry.servers[fixtureRemoteServer])
+		})
+
+		t.Run("cached servers are used", func(t *testing.T) {
+			f, key, close := newFixture(t, false)
+			defer close()
+			f.backfiller.roomServers().put(key, map[spec.ServerName]bool{cached: true}, gomatrixserverlib.HistoryVisibilityShared)
+			var res api.PerformBackfillResponse
+			assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+			assert.NotEmpty(t, res.Events)
+			assert.Equal(t, []spec.ServerName{cached}, backfilledFrom(f))
+		})
+
+		for _, refreshConcurrently := range []bool{false, true} {
+			t.Run(fmt.Sprintf("expired servers refreshed concurrently %v", refreshConcurrently), func(t *testing.T) {
+				f, key, close := newFixture(t, refreshConcurrently)
+				defer close()
+				// Cache servers which expired recently enough to still be used while refreshing them.
+				cache := f.backfiller.roomServers()
+				cache.now = func() time.Time { return time.Now().Add(-time.Minute - time.Second) }
+				cache.put(key, map[spec.ServerName]bool{cached: true}, gomatrixserverlib.HistoryVisibilityShared)
+				cache.now = time.Now
+
+				var res api.PerformBackfillResponse
+				assert.NoError(t, f.backfiller.PerformBackfill(context.Background(), f.request(10), &res))
+				assert.NotEmpty(t, res.Events)
+				if !refreshConcurrently {
+					// The servers were worked out again before backfilling.
+					assert.Equal(t, []spec.ServerName{fixtureRemoteServer}, backfilledFrom(f))
+					return
+				}
+				// The expired servers were used while the servers were worked out again for next time.
+				assert.Equal(t, []spec.ServerName{cached}, backfilledFrom(f))
+				assert.Eventually(t, func() bool {
+					entry, fresh, ok := cache.get(key)
+					return ok && fresh && entry.servers[fixtureRemoteServer]
+				}, 5*time.Second, 10*time.Millisecond)
+			})
+		}
+	})
+}
+
+func TestEventLRU(t *testing.T) {
+	m := newEventLRU[int](3)
+	m.set("$a", 1)
+	m.set("$b", 2)
+	m.set("$c", 3)
+	// using $a makes $b the least recently used
+	_, ok := m.get("$a")
+	assert.True(t, ok)
+	m.set("$d", 4)
+	_, ok = m.get("$b")
+	assert.False(t, ok)
+	assert.Equal(t, 3, m.len())
+
+	// pinned events are kept even when over the limit
+	m.pin("$c")
+	m.pin("$e")
+	m.set("$e", 5)
+	m.set("$f", 6)
+	m.set("$g", 7)
+	for _, eventID := range []string{"$c", "$e"} {
+		_, ok = m.get(eventID)
+		assert.True(t, ok, "pinned event %s was forgotten", eventID)
+	}
+	assert.Equal(t, 3, m.len())
+
+	// once unpinned, they can be forgotten again
+	m.unpinAll()
+	m.set("$h", 8)
+	assert.Equal(t, 3, m.len())
+	value, ok := m.get("$h")
+	assert.True(t, ok)
+	assert.Equal(t, 8, value)
+
+	unlimited := newEventLRU[int](0)
+	for i := 0; i < 100; i++ {
+		unlimited.set(fmt.Sprintf("$%d", i), i)
+	}
+	assert.Equal(t, 100, unlimited.len())
+	assert.Zero(t, unlimited.evicted)
+}
+
+func TestBackfillReloadConfig(t *testing.T) {
+	r := &Backfiller{PreferServers: []spec.ServerName{"a"}}
+	assert.Equal(t, map[spec.ServerName]bool{"a": true}, r.newRequester("!room:a", "local", nil, gomatrixserverlib.RoomVersionV10).preferServer)
+
+	// backfills starting after the configuration was reloaded prefer its key perspective servers, and reading them
+	// doesn't depend on the reloaded configuration staying the same
+	cfg := &config.Dendrite{}
+	cfg.FederationAPI.KeyPerspectives = config.KeyPerspectives{{ServerName: "b"}, {ServerName: "c"}}
+	r.ReloadConfig(cfg)
+	cfg.FederationAPI.KeyPerspectives[0].ServerName = "d"
+	assert.Equal(t, map[spec.ServerName]bool{"b": true, "c": true}, r.newRequester("!room:a", "local", nil, gomatrixserverlib.RoomVersionV10).preferServer)
+
+	// a reloaded configuration without key perspectives leaves backfills preferring no servers
+	r.ReloadConfig(&config.Dendrite{})
+	assert.Empty(t, r.newRequester("!room:a", "local", nil, gomatrixserverlib.RoomVersionV10).preferServer)
+
+	// reloading at the same time as backfills start is safe
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			reloaded := &config.Dendrite{}
+			reloaded.FederationAPI.KeyPerspectives = config.KeyPerspectives{{ServerName: spec.ServerName(fmt.Sprintf("server%d", i))}}
+			r.ReloadConfig(reloaded)
+		}(i)
+		go func() {
+			defer wg.Done()
+			assert.LessOrEqual(t, len(r.newRequester("!room:a", "local", nil, gomatrixserverlib.RoomVersionV10).preferServer), 1)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBackfillLargeRoomWithRememberedEventsLimit(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		const messageCount = 250
+		f, close := newBackfillFixture(t, dbType, messageCount)
+		defer close()
+		f.backfiller.MaxRememberedEvents = 20
+		f.backfiller.MaxRounds = 5
+		ctx := context.Background()
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(messageCount), &res))
+		assert.GreaterOrEqual(t, len(res.Events), messageCount-1)
+
+		// Every message was stored with the right state before it, despite forgetting most of them while walking
+		// the history.
+		wantStateIDs := backfilltest.StateIDsBefore(f.room)
+		requester := newBackfillRequester(f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName, nil, nil, f.room.Version, 0)
+		for i, msg := range f.messages[:messageCount-1] {
+			stateIDs, err := requester.localStateIDsBeforeEvent(ctx, msg.PDU)
+			if !assert.NoError(t, err, "message %d", i) {
+				continue
+			}
+			assert.ElementsMatch(t, wantStateIDs[msg.EventID()], stateIDs, "message %d", i)
+		}
+	})
+}
+
+func TestBackfillReusesStateSnapshots(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 6)
+		defer close()
+		ctx := context.Background()
+
+		var res api.PerformBackfillResponse
+		assert.NoError(t, f.backfiller.PerformBackfill(ctx, f.request(10), &res))
+
+		// The messages all have the same state before them, so they share one snapshot which was only added once.
+		backfilled := f.messages[:len(f.messages)-1]
+		snapshotNID, err := f.db.SnapshotNIDFromEventID(ctx, backfilled[0].EventID())
+		assert.NoError(t, err)
+		assert.NotZero(t, snapshotNID)
+		for i, msg := range backfilled[1:] {
+			nid, err := f.db.SnapshotNIDFromEventID(ctx, msg.EventID())
+			assert.NoError(t, err)
+			assert.Equal(t, snapshotNID, nid, "message %d", i+1)
+		}
+		assert.GreaterOrEqual(t, f.db.Calls("SetState"), len(backfilled)-1)
+
+		// Which is the right state.
+		wantStateIDs := backfilltest.StateIDsBefore(f.room)
+		requester := newBackfillRequester(f.db, f.fsAPI, f.backfiller.Querier, fixtureLocalServer, f.backfiller.IsLocalServerName, nil, nil, f.room.Version, 0)
+		for i, msg := range backfilled {
+			stateIDs, err := requester.localStateIDsBeforeEvent(ctx, msg.PDU)
+			if assert.NoError(t, err, "message %d", i) {
+				assert.ElementsMatch(t, wantStateIDs[msg.EventID()], stateIDs, "message %d", i)
+			}
+		}
+	})
+}
+
+func TestBackfillReadReplica(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		for _, upToDate := range []bool{true, false} {
+			t.Run(fmt.Sprintf("up to date %v", upToDate), func(t *testing.T) {
+				f, close := newBackfillFixture(t, dbType, 5)
+				defer close()
+
+				// The replica has everything the primary had before the backfill, unless it is lagging so far
+				// behind that it has nothing at all, in which case every read has to fall back to the primary.
+				replicaDB, closeReplica := backfilltest.MustCreateDatabase(t, dbType)
+				defer closeReplica()
+				if upToDate {
+					backfilltest.MustStoreEvents(t, replicaDB, f.room, fixtureLocalServer, append(f.room.Events()[:len(f.room.Events())-len(f.messages)], f.messages[len(f.messages)-1]))
+				}
+				replica := backfilltest.NewDatabase(replicaDB)
+				f.backfiller.ReadDB = replica
+
+				var res api.PerformBackfillResponse
+				err := f.backfiller.PerformBackfill(context.Background(), f.request(10), &res)
+				assert.NoError(t, err)
+
+				// Reads went to the replica first, but everything was written to the primary.
+				assert.Greater(t, replica.Calls("EventNIDs"), 0)
+				for _, method := range []string{"StoreEvent", "AddState", "SetState", "AddAndSetState"} {
+					assert.Zero(t, replica.Calls(method), method)
+				}
+				var backfilled []string
+				for _, ev := range f.messages[:len(f.messages)-1] {
+					backfilled = append(backfilled, ev.EventID())
+				}
+				nids, err := f.db.EventNIDs(context.Background(), backfilled)
+				assert.NoError(t, err)
+				assert.Len(t, nids, len(backfilled))
+				nids, err = replicaDB.EventNIDs(context.Background(), backfilled)
+				assert.NoError(t, err)
+				assert.Empty(t, nids)
+			})
+		}
+	})
+}
+
+func TestReplicaDatabaseDuplicateEventIDs(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		f, close := newBackfillFixture(t, dbType, 1)
+		defer close()
+		replicaDB, closeReplica := backfilltest.MustCreateDatabase(t, dbType)
+		defer closeReplica()
+		stateEvents := f.room.Events()[:len(f.room.Events())-len(f.messages)]
+		backfilltest.MustStoreEvents(t, replicaDB, f.room, fixtureLocalServer, stateEvents)
+		db := replicaDatabase{Database: f.db, replica: backfilltest.NewDatabase(replicaDB)}
+
+		// asking for the same event more than once is still served by the replica when it has them all
+		ids := []string{stateEvents[0].EventID(), stateEvents[1].EventID(), stateEvents[0].EventID()}
+		nids, err := db.EventNIDs(context.Background(), ids)
+		assert.NoError(t, err)
+		assert.Len(t, nids, 2)
+		entries, err := db.StateEntriesForEventIDs(context.Background(), ids, true)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.Zero(t, f.db.Calls("EventNIDs"))
+		assert.Zero(t, f.db.Calls("StateEntriesForEventIDs"))
+
+		// but not when it is missing any of them
+		_, err = db.EventNIDs(context.Background(), append(ids, f.messages[0].EventID()))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, f.db.Calls("EventNIDs"))
+	})
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// maxWarmedRooms is how many rooms backfillWarmState holds warmed state for.
+const maxWarmedRooms = 1000
+
+// warmedRoomTTL is how long warmed state is held for if no backfill of the room takes it.
+const warmedRoomTTL = 10 * time.Minute
+
+// backfillWarmState holds the events and the state before them which were loaded by WarmBackfillState for
+// each room, until the next backfill of the room takes them or they expire. The zero value is ready to use,
+// and it is safe for concurrent use.
+type backfillWarmState struct {
+	mu    sync.Mutex
+	rooms map[string]*warmedRoom
+	now   func() time.Time
+}
+
+type warmedRoom struct {
+	events         map[string]gomatrixserverlib.PDU
+	beforeStateIDs map[string][]string
+	warmed         time.Time
+}
+
+func (w *backfillWarmState) timeNow() time.Time {
+	if w.now != nil {
+		return w.now()
+	}
+	return time.Now()
+}
+
+func (room *warmedRoom) expired(now time.Time) bool {
+	return !now.Before(room.warmed.Add(warmedRoomTTL))
+}
+
+// add merges the given events and state before events into what has been warmed for the room already, unless
+// that has expired. If too many rooms are warmed already, another room is forgotten.
+func (w *backfillWarmState) add(roomID string, events map[string]gomatrixserverlib.PDU, beforeStateIDs map[string][]string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.timeNow()
+	if w.rooms == nil {
+		w.rooms = make(map[string]*warmedRoom)
+	}
+	room, ok := w.rooms[roomID]
+	if ok && room.expired(now) {
+		delete(w.rooms, roomID)
+		ok = false
+	}
+	if !ok && len(w.rooms) >= maxWarmedRooms {
+		// Expired rooms would never be used, and if there are none then forget any room.
+		for forget, warmed := range w.rooms {
+			if warmed.expired(now) {
+				delete(w.rooms, forget)
+			}
+		}
+		for forget := range w.rooms {
+			if len(w.rooms) < maxWarmedRooms {
+				break
+			}
+			delete(w.rooms, forget)
+		}
+	}
+	if !ok {
+		room = &warmedRoom{
+			events:         make(map[string]gomatrixserverlib.PDU, len(events)),
+			beforeStateIDs: make(map[string][]string, len(beforeStateIDs)),
+		}
+		w.rooms[roomID] = room
+	}
+	room.warmed = now
+	for eventID, ev := range events {
+		room.events[eventID] = ev
+	}
+	for eventID, stateIDs := range beforeStateIDs {
+		room.beforeStateIDs[eventID] = stateIDs
+	}
+}
+
+// take removes and returns what has been warmed for the room, or nil if nothing has or it has expired.
+func (w *backfillWarmState) take(roomID string) *warmedRoom {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	room, ok := w.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	delete(w.rooms, roomID)
+	if room.expired(w.timeNow()) {
+		return nil
+	}
+	return room
+}
+
+// seed copies what has been warmed for the requester's room into the requester, so that the state before
+// events next to the warmed ones can be calculated without asking other servers.
+func (w *backfillWarmState) seed(b *backfillRequester) {
+	room := w.take(b.roomID)
+	if room == nil {
+		return
+	}
+	for eventID, ev := range room.events {
+		b.eventIDMap.set(eventID, ev)
+	}
+	for eventID, stateIDs := range room.beforeStateIDs {
+		// Each requester may append to the state IDs, so it needs its own copy.
+		b.eventIDToBeforeStateIDs.set(eventID, append([]string(nil), stateIDs...))
+	}
+}
+
+// WarmBackfillState loads the given events of the room and the state before them from the database, ready for
+// the next backfill of the room, so that it can work out the state before the events it backfills next to them
+// without /state_ids requests. This is useful before a large backfill into history which we partly hold already.
+// Events which we don't have are ignored. Returns how many of the events were warmed.
+func (r *Backfiller) WarmBackfillState(ctx context.Context, roomID string, fromEventIDs []string) (int, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return 0, err
+	}
+	if info == nil || info.IsStub() {
+		return 0, fmt.Errorf("WarmBackfillState: missing room info for room %s", roomID)
+	}
+	nids, err := r.DB.EventNIDs(ctx, fromEventIDs)
+	if err != nil {
+		return 0, fmt.Errorf("WarmBackfillState: failed to get event NIDs: %w", err)
+	}
+
+	// Load the events along with the state events before them, which are needed to roll the state forwards.
+	beforeStateNIDs := make(map[string][]types.EventNID, len(nids))
+	var loadNIDs []types.EventNID
+	for eventID, nid := range nids {
+		if nid.RoomNID != info.RoomNID {
+			continue
+		}
+		stateEntries, err := helpers.StateBeforeEvent(ctx, r.DB, info, nid.EventNID, r.Querier)
+		if err != nil {
+			return 0, fmt.Errorf("WarmBackfillState: failed to get the state before event %s: %w", eventID, err)
+		}
+		stateNIDs := make([]types.EventNID, len(stateEntries))
+		for i := range stateEntries {
+			stateNIDs[i] = stateEntries[i].EventNID
+		}
+		beforeStateNIDs[eventID] = stateNIDs
+		loadNIDs = append(loadNIDs, nid.EventNID)
+		loadNIDs = append(loadNIDs, stateNIDs...)
+	}
+	if len(beforeStateNIDs) == 0 {
+		return 0, nil
+	}
+	loaded, err := r.DB.Events(ctx, info.RoomVersion, loadNIDs)
+	if err != nil {
+		return 0, fmt.Errorf("WarmBackfillState: failed to load events: %w", err)
+	}
+	events := make(map[string]gomatrixserverlib.PDU, len(loaded))
+	eventIDs := make(map[types.EventNID]string, len(loaded))
+	for _, ev := range loaded {
+		events[ev.EventID()] = ev.PDU
+		eventIDs[ev.EventNID] = ev.EventID()
+	}
+	beforeStateIDs := make(map[string][]string, len(beforeStateNIDs))
+NextEvent:
+	for eventID, stateNIDs := range beforeStateNIDs {
+		stateIDs := make([]string, 0, len(stateNIDs))
+		for _, nid := range stateNIDs {
+			id, ok := eventIDs[nid]
+			if !ok {
+				// Incomplete state is worse than none, as it would be rolled forwards as if it were complete.
+				continue NextEvent
+			}
+			stateIDs = append(stateIDs, id)
+		}
+		beforeStateIDs[eventID] = stateIDs
+	}
+	r.warm.add(roomID, events, beforeStateIDs)
+	return len(beforeStateIDs), nil
+}
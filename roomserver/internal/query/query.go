@@ -812,6 +812,18 @@ func (r *Queryer) QueryRoomVersionForRoom(ctx context.Context, roomID string) (g
 	return info.RoomVersion, nil
 }
 
+// QueryBackwardExtremities implements api.ClientRoomserverAPI
+func (r *Queryer) QueryBackwardExtremities(ctx context.Context, roomID string) (map[string][]string, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("QueryBackwardExtremities: missing room info for room %s", roomID)
+	}
+	return r.DB.BackwardExtremitiesForRoom(ctx, info.RoomNID)
+}
+
 func (r *Queryer) QueryPublishedRooms(
 	ctx context.Context,
 	req *api.QueryPublishedRoomsRequest,
@@ -22,12 +22,14 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/internal/backfilltest"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
 )
 
 // used to implement RoomserverInternalAPIEventDB to test getAuthChain
@@ -186,3 +188,56 @@ func TestCurrentEventIsNil(t *testing.T) {
 		}
 	})
 }
+
+func TestQueryBackwardExtremities(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	stateEvents := room.Events()
+	var messages []*types.HeaderedEvent
+	for i := 0; i < 3; i++ {
+		messages = append(messages, room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"}))
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		querier := Queryer{
+			DB: db,
+		}
+		ctx := context.Background()
+
+		_, err := querier.QueryBackwardExtremities(ctx, "!unknown:server")
+		assert.Error(t, err)
+
+		// We only have the state and the latest message, so it's missing its prev_event.
+		stored := append(append([]*types.HeaderedEvent{}, stateEvents...), messages[2])
+		info := backfilltest.MustStoreEvents(t, db, room, "test", stored)
+		var pdus []gomatrixserverlib.PDU
+		for _, ev := range stored {
+			pdus = append(pdus, ev.PDU)
+		}
+		assert.NoError(t, db.UpdateBackwardExtremities(ctx, info.RoomNID, pdus))
+
+		bwExtrems, err := querier.QueryBackwardExtremities(ctx, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{messages[2].EventID(): {messages[1].EventID()}}, bwExtrems)
+
+		// Getting the missing event moves the extremity further back.
+		backfilltest.MustStoreEvents(t, db, room, "test", []*types.HeaderedEvent{messages[1]})
+		assert.NoError(t, db.UpdateBackwardExtremities(ctx, info.RoomNID, []gomatrixserverlib.PDU{messages[1].PDU}))
+
+		bwExtrems, err = querier.QueryBackwardExtremities(ctx, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{messages[1].EventID(): {messages[0].EventID()}}, bwExtrems)
+
+		// Storing the last missing event along with its extremities closes the gap.
+		eventTypeNID, err := db.GetOrCreateEventTypeNID(ctx, messages[0].Type())
+		assert.NoError(t, err)
+		_, _, err = db.StoreEventAndUpdateBackwardExtremities(ctx, messages[0].PDU, info, eventTypeNID, 0, nil, false)
+		assert.NoError(t, err)
+
+		bwExtrems, err = querier.QueryBackwardExtremities(ctx, room.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, bwExtrems)
+	})
+}
@@ -46,7 +46,16 @@ func NewInternalAPI(
 
 	js, nc := natsInstance.Prepare(processContext, &cfg.Global.JetStream)
 
-	return internal.NewRoomserverAPI(
+	rsAPI := internal.NewRoomserverAPI(
 		processContext, cfg, roomserverDB, js, nc, caches, enableMetrics,
 	)
+	if replica := &cfg.RoomServer.Backfill.ReadReplicaDatabase; replica.ConnectionString != "" {
+		// The replica can lag behind, so it has its own cache to stop stale reads ending up in the shared one.
+		replicaCaches := caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize/4, cfg.Global.Cache.MaxAge, caching.DisableMetrics)
+		rsAPI.BackfillReadDB, err = storage.OpenReadReplica(processContext.Context(), cm, replica, replicaCaches)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to connect to room server read replica db")
+		}
+	}
+	return rsAPI
 }
@@ -388,6 +388,18 @@ func TestPurgeRoom(t *testing.T) {
 			t.Fatalf("expected there to be only %d invite events, got %d", wantInviteCount, inviteCount)
 		}
 
+		// backfill shouldn't bring the purged history back
+		horizon, err := db.PurgeHorizon(ctx, room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if horizon == nil {
+			t.Fatalf("expected a purge horizon to be recorded")
+		}
+		if lastDepth := room.Events()[len(room.Events())-1].Depth(); horizon.Depth <= lastDepth {
+			t.Fatalf("expected the purge horizon to be after depth %d, got %d", lastDepth, horizon.Depth)
+		}
+
 		// aliases should be deleted
 		aliases, err := db.GetAliasesForRoomID(ctx, room.ID)
 		if err != nil {
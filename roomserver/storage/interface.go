@@ -83,6 +83,9 @@ type Database interface {
 	BulkSelectSnapshotsFromEventIDs(ctx context.Context, eventIDs []string) (map[types.StateSnapshotNID][]string, error)
 	// Stores a matrix room event in the database. Returns the room NID, the state snapshot or an error.
 	StoreEvent(ctx context.Context, event gomatrixserverlib.PDU, roomInfo *types.RoomInfo, eventTypeNID types.EventTypeNID, eventStateKeyNID types.EventStateKeyNID, authEventNIDs []types.EventNID, isRejected bool) (types.EventNID, types.StateAtEvent, error)
+	// StoreEventAndUpdateBackwardExtremities stores the event as StoreEvent does, and updates the backward extremities
+	// of the room in the same transaction. This shouldn't be used for outliers.
+	StoreEventAndUpdateBackwardExtremities(ctx context.Context, event gomatrixserverlib.PDU, roomInfo *types.RoomInfo, eventTypeNID types.EventTypeNID, eventStateKeyNID types.EventStateKeyNID, authEventNIDs []types.EventNID, isRejected bool) (types.EventNID, types.StateAtEvent, error)
 	// Look up the state entries for a list of string event IDs
 	// Returns an error if the there is an error talking to the database
 	// Returns a types.MissingEventError if the event IDs aren't in the database.
@@ -93,8 +96,19 @@ type Database interface {
 	// Look up the numeric IDs for a list of events.
 	// Returns an error if there was a problem talking to the database.
 	EventNIDs(ctx context.Context, eventIDs []string) (map[string]types.EventMetadata, error)
+	// ExistingEventIDs returns which of the events we have, keyed by event ID. It is cheaper than EventNIDs
+	// when only whether we have the events matters.
+	ExistingEventIDs(ctx context.Context, eventIDs []string) (map[string]bool, error)
 	// Set the state at an event. FIXME TODO: "at"
 	SetState(ctx context.Context, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
+	// Store the room state before an event and set it as the state at the event in one transaction.
+	AddAndSetState(
+		ctx context.Context,
+		roomNID types.RoomNID,
+		eventNID types.EventNID,
+		stateBlockNIDs []types.StateBlockNID,
+		state []types.StateEntry,
+	) (types.StateSnapshotNID, error)
 	// Lookup the event IDs for a batch of event numeric IDs.
 	// Returns an error if the retrieval went wrong.
 	EventIDs(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]string, error)
@@ -169,6 +183,30 @@ type Database interface {
 	GetLocalServerInRoom(ctx context.Context, roomNID types.RoomNID) (bool, error)
 	// GetServerInRoom returns true if we think a server is in a given room or false otherwise.
 	GetServerInRoom(ctx context.Context, roomNID types.RoomNID, serverName spec.ServerName) (bool, error)
+	// GetJoinedServerNamesInRoom returns the distinct server names of the users currently joined to the room.
+	GetJoinedServerNamesInRoom(ctx context.Context, roomNID types.RoomNID) ([]spec.ServerName, error)
+	// BackwardExtremitiesForRoom returns the backward extremities of the room, as a map of event ID to the prev_event IDs we don't have.
+	BackwardExtremitiesForRoom(ctx context.Context, roomNID types.RoomNID) (map[string][]string, error)
+	// UpdateBackwardExtremities updates the backward extremities of the room now that we have the given events.
+	UpdateBackwardExtremities(ctx context.Context, roomNID types.RoomNID, events []gomatrixserverlib.PDU) error
+	// RecordEventVirtualHost records that the given events were backfilled for the given virtual host.
+	RecordEventVirtualHost(ctx context.Context, virtualHost spec.ServerName, eventNIDs []types.EventNID) error
+	// EventVirtualHost returns the virtual host the event was backfilled for, or an empty server name if it wasn't recorded.
+	EventVirtualHost(ctx context.Context, eventNID types.EventNID) (spec.ServerName, error)
+	// SetBackfillCheckpoint records that the given backfilled event and everything after it has been persisted.
+	SetBackfillCheckpoint(ctx context.Context, roomNID types.RoomNID, eventID string) error
+	// BackfillCheckpoint returns the checkpoint recorded by the last backfill of the room, or an empty string if there isn't one.
+	BackfillCheckpoint(ctx context.Context, roomNID types.RoomNID) (string, error)
+	// PurgeHorizon returns how far back the history of the room was purged, or nil if it was never purged.
+	PurgeHorizon(ctx context.Context, roomID string) (*types.PurgeHorizon, error)
+	// SetPurgeHorizon records how far back the history of the room was purged, replacing any earlier horizon.
+	SetPurgeHorizon(ctx context.Context, roomID string, horizon types.PurgeHorizon) error
+	// QuarantineEvent stores an event which failed auth checks during backfill, replacing any earlier quarantine of it.
+	QuarantineEvent(ctx context.Context, event *types.QuarantinedEvent) error
+	// QuarantinedEvents returns the quarantined events of the room, oldest first.
+	QuarantinedEvents(ctx context.Context, roomID string) ([]types.QuarantinedEvent, error)
+	// QuarantinedEvent returns the quarantined event, or nil if it isn't quarantined.
+	QuarantinedEvent(ctx context.Context, eventID string) (*types.QuarantinedEvent, error)
 	// GetKnownUsers searches all users that userID knows about.
 	GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error)
 	// ForgetRoom sets a flag in the membership table, that the user wishes to forget a specific room
@@ -230,6 +268,9 @@ type RoomDatabase interface {
 	UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error
 	GetRoomUpdater(ctx context.Context, roomInfo *types.RoomInfo) (*shared.RoomUpdater, error)
 	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool, localOnly bool) ([]types.EventNID, error)
+	GetJoinedServerNamesInRoom(ctx context.Context, roomNID types.RoomNID) ([]spec.ServerName, error)
+	UpdateBackwardExtremities(ctx context.Context, roomNID types.RoomNID, events []gomatrixserverlib.PDU) error
+	StoreEventAndUpdateBackwardExtremities(ctx context.Context, event gomatrixserverlib.PDU, roomInfo *types.RoomInfo, eventTypeNID types.EventTypeNID, eventStateKeyNID types.EventStateKeyNID, authEventNIDs []types.EventNID, isRejected bool) (types.EventNID, types.StateAtEvent, error)
 	StateBlockNIDs(ctx context.Context, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error)
 	StateEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID) ([]types.StateEntryList, error)
 	BulkSelectSnapshotsFromEventIDs(ctx context.Context, eventIDs []string) (map[types.StateSnapshotNID][]string, error)
@@ -0,0 +1,104 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const backwardExtremitiesSchema = `
+-- Stores the backward extremities of rooms, i.e. the events whose prev_events we don't have.
+CREATE TABLE IF NOT EXISTS roomserver_backward_extremities (
+	-- The room NID the event is in.
+	room_nid BIGINT NOT NULL,
+	-- The event ID of the event which we have. This is the backward extremity.
+	event_id TEXT NOT NULL,
+	-- A prev_event of the event which we don't have.
+	prev_event_id TEXT NOT NULL,
+	PRIMARY KEY(room_nid, event_id, prev_event_id)
+);
+`
+
+const insertBackwardExtremitySQL = "" +
+	"INSERT INTO roomserver_backward_extremities (room_nid, event_id, prev_event_id)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectBackwardExtremitiesForRoomSQL = "" +
+	"SELECT event_id, prev_event_id FROM roomserver_backward_extremities WHERE room_nid = $1"
+
+const deleteBackwardExtremitySQL = "" +
+	"DELETE FROM roomserver_backward_extremities WHERE room_nid = $1 AND prev_event_id = $2"
+
+type backwardExtremitiesStatements struct {
+	insertBackwardExtremityStmt          *sql.Stmt
+	selectBackwardExtremitiesForRoomStmt *sql.Stmt
+	deleteBackwardExtremityStmt          *sql.Stmt
+}
+
+func CreateBackwardExtremitiesTable(db *sql.DB) error {
+	_, err := db.Exec(backwardExtremitiesSchema)
+	return err
+}
+
+func PrepareBackwardExtremitiesTable(db *sql.DB) (tables.BackwardExtremities, error) {
+	s := &backwardExtremitiesStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertBackwardExtremityStmt, insertBackwardExtremitySQL},
+		{&s.selectBackwardExtremitiesForRoomStmt, selectBackwardExtremitiesForRoomSQL},
+		{&s.deleteBackwardExtremityStmt, deleteBackwardExtremitySQL},
+	}.Prepare(db)
+}
+
+func (s *backwardExtremitiesStatements) InsertBackwardExtremity(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID, prevEventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertBackwardExtremityStmt).ExecContext(ctx, roomNID, eventID, prevEventID)
+	return err
+}
+
+func (s *backwardExtremitiesStatements) SelectBackwardExtremitiesForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (map[string][]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectBackwardExtremitiesForRoomStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectBackwardExtremitiesForRoom: rows.close() failed")
+
+	bwExtrems := make(map[string][]string)
+	var eventID, prevEventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID, &prevEventID); err != nil {
+			return nil, err
+		}
+		bwExtrems[eventID] = append(bwExtrems[eventID], prevEventID)
+	}
+	return bwExtrems, rows.Err()
+}
+
+func (s *backwardExtremitiesStatements) DeleteBackwardExtremity(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, prevEventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteBackwardExtremityStmt).ExecContext(ctx, roomNID, prevEventID)
+	return err
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/internal"
+)
+
+type backwardExtremity struct {
+	eventID     string
+	prevEventID string
+}
+
+// UpPopulateBackwardExtremities computes the backward extremities of the rooms we already have, as they are
+// otherwise only tracked for events received after the roomserver_backward_extremities table was created.
+// As with UpdateBackwardExtremities, outliers are ignored as they don't form part of the room DAG.
+func UpPopulateBackwardExtremities(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `SELECT room_nid FROM roomserver_rooms`)
+	if err != nil {
+		return fmt.Errorf("failed to query rooms: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "UpPopulateBackwardExtremities: rows.close() failed")
+	var roomNIDs []int64
+	for rows.Next() {
+		var roomNID int64
+		if err = rows.Scan(&roomNID); err != nil {
+			return err
+		}
+		roomNIDs = append(roomNIDs, roomNID)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, roomNID := range roomNIDs {
+		bwExtrems, err := backwardExtremitiesForRoom(ctx, tx, roomNID)
+		if err != nil {
+			return fmt.Errorf("failed to compute backward extremities for room %d: %w", roomNID, err)
+		}
+		for _, bwExtrem := range bwExtrems {
+			if _, err = tx.ExecContext(ctx, `INSERT INTO roomserver_backward_extremities (room_nid, event_id, prev_event_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, roomNID, bwExtrem.eventID, bwExtrem.prevEventID); err != nil {
+				return fmt.Errorf("failed to insert backward extremity: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func backwardExtremitiesForRoom(ctx context.Context, tx *sql.Tx, roomNID int64) ([]backwardExtremity, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT e.event_id, e.state_snapshot_nid, j.event_json FROM roomserver_events e
+	JOIN roomserver_event_json j ON e.event_nid = j.event_nid WHERE e.room_nid = $1`, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "backwardExtremitiesForRoom: rows.close() failed")
+	known := make(map[string]struct{})
+	prevEvents := make(map[string][]string)
+	for rows.Next() {
+		var eventID, eventJSON string
+		var stateSnapshotNID int64
+		if err = rows.Scan(&eventID, &stateSnapshotNID, &eventJSON); err != nil {
+			return nil, err
+		}
+		known[eventID] = struct{}{}
+		if stateSnapshotNID == 0 {
+			continue
+		}
+		// Room versions 1 and 2 use [event_id, hashes] pairs rather than plain event IDs.
+		for _, prev := range gjson.Get(eventJSON, "prev_events").Array() {
+			if prev.IsArray() {
+				prev = prev.Get("0")
+			}
+			prevEvents[eventID] = append(prevEvents[eventID], prev.String())
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	var bwExtrems []backwardExtremity
+	for eventID, prevEventIDs := range prevEvents {
+		for _, prevEventID := range prevEventIDs {
+			if _, ok := known[prevEventID]; !ok {
+				bwExtrems = append(bwExtrems, backwardExtremity{eventID: eventID, prevEventID: prevEventID})
+			}
+		}
+	}
+	return bwExtrems, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const eventVirtualHostsSchema = `
+-- Stores which of our virtual hosts fetched an event, for events which were backfilled.
+CREATE TABLE IF NOT EXISTS roomserver_event_virtual_hosts (
+	-- The event NID of the backfilled event.
+	event_nid BIGINT PRIMARY KEY,
+	-- The local virtual host the event was fetched for.
+	virtual_host TEXT NOT NULL
+);
+`
+
+const insertEventVirtualHostSQL = "" +
+	"INSERT INTO roomserver_event_virtual_hosts (event_nid, virtual_host)" +
+	" VALUES ($1, $2)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectEventVirtualHostSQL = "" +
+	"SELECT virtual_host FROM roomserver_event_virtual_hosts WHERE event_nid = $1"
+
+type eventVirtualHostsStatements struct {
+	insertEventVirtualHostStmt *sql.Stmt
+	selectEventVirtualHostStmt *sql.Stmt
+}
+
+func CreateEventVirtualHostsTable(db *sql.DB) error {
+	_, err := db.Exec(eventVirtualHostsSchema)
+	return err
+}
+
+func PrepareEventVirtualHostsTable(db *sql.DB) (tables.EventVirtualHosts, error) {
+	s := &eventVirtualHostsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertEventVirtualHostStmt, insertEventVirtualHostSQL},
+		{&s.selectEventVirtualHostStmt, selectEventVirtualHostSQL},
+	}.Prepare(db)
+}
+
+func (s *eventVirtualHostsStatements) InsertEventVirtualHost(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, virtualHost spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertEventVirtualHostStmt).ExecContext(ctx, int64(eventNID), string(virtualHost))
+	return err
+}
+
+func (s *eventVirtualHostsStatements) SelectEventVirtualHost(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
+) (spec.ServerName, error) {
+	var virtualHost string
+	err := sqlutil.TxStmt(txn, s.selectEventVirtualHostStmt).QueryRowContext(ctx, int64(eventNID)).Scan(&virtualHost)
+	return spec.ServerName(virtualHost), err
+}
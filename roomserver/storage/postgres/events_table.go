@@ -142,6 +142,9 @@ const bulkSelectEventNIDSQL = "" +
 const bulkSelectUnsentEventNIDSQL = "" +
 	"SELECT event_id, event_nid, room_nid FROM roomserver_events WHERE event_id = ANY($1) AND sent_to_output = FALSE"
 
+const bulkSelectExistingEventIDSQL = "" +
+	"SELECT event_id FROM roomserver_events WHERE event_id = ANY($1)"
+
 const selectMaxEventDepthSQL = "" +
 	"SELECT COALESCE(MAX(depth) + 1, 0) FROM roomserver_events WHERE event_nid = ANY($1)"
 
@@ -169,6 +172,7 @@ type eventStatements struct {
 	bulkSelectEventIDStmt                         *sql.Stmt
 	bulkSelectEventNIDStmt                        *sql.Stmt
 	bulkSelectUnsentEventNIDStmt                  *sql.Stmt
+	bulkSelectExistingEventIDStmt                 *sql.Stmt
 	selectMaxEventDepthStmt                       *sql.Stmt
 	selectRoomNIDsForEventNIDsStmt                *sql.Stmt
 	selectEventRejectedStmt                       *sql.Stmt
@@ -210,6 +214,7 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.bulkSelectUnsentEventNIDStmt, bulkSelectUnsentEventNIDSQL},
+		{&s.bulkSelectExistingEventIDStmt, bulkSelectExistingEventIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
 		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
@@ -544,6 +549,25 @@ func (s *eventStatements) bulkSelectEventNID(ctx context.Context, txn *sql.Tx, e
 	return results, rows.Err()
 }
 
+// BulkSelectExistingEventID returns which of the given event IDs are in the database.
+func (s *eventStatements) BulkSelectExistingEventID(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.bulkSelectExistingEventIDStmt)
+	rows, err := stmt.QueryContext(ctx, pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectExistingEventID: rows.close() failed")
+	results := make([]string, 0, len(eventIDs))
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		results = append(results, eventID)
+	}
+	return results, rows.Err()
+}
+
 func (s *eventStatements) SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error) {
 	var result int64
 	stmt := s.selectMaxEventDepthStmt
@@ -158,6 +158,14 @@ const selectServerInRoomSQL = "" +
 	" JOIN roomserver_event_state_keys ON roomserver_membership.target_nid = roomserver_event_state_keys.event_state_key_nid" +
 	" WHERE membership_nid = $1 AND room_nid = $2 AND event_state_key LIKE '%:' || $3 LIMIT 1"
 
+// selectJoinedServerNamesInRoomSQL returns the distinct server names of all users joined to
+// the room. Like selectServerInRoomSQL this avoids loading the membership events themselves,
+// which matters for very large rooms where only the set of servers is needed.
+const selectJoinedServerNamesInRoomSQL = "" +
+	"SELECT DISTINCT SUBSTRING(event_state_key FROM POSITION(':' IN event_state_key) + 1) FROM roomserver_membership" +
+	" JOIN roomserver_event_state_keys ON roomserver_membership.target_nid = roomserver_event_state_keys.event_state_key_nid" +
+	" WHERE membership_nid = $1 AND room_nid = $2"
+
 const selectJoinedUsersSQL = `
 SELECT DISTINCT target_nid
 FROM roomserver_membership m
@@ -180,6 +188,7 @@ type membershipStatements struct {
 	updateMembershipForgetRoomStmt                  *sql.Stmt
 	selectLocalServerInRoomStmt                     *sql.Stmt
 	selectServerInRoomStmt                          *sql.Stmt
+	selectJoinedServerNamesInRoomStmt               *sql.Stmt
 	deleteMembershipStmt                            *sql.Stmt
 	selectJoinedUsersStmt                           *sql.Stmt
 }
@@ -216,6 +225,7 @@ func PrepareMembershipTable(db *sql.DB) (tables.Membership, error) {
 		{&s.updateMembershipForgetRoomStmt, updateMembershipForgetRoom},
 		{&s.selectLocalServerInRoomStmt, selectLocalServerInRoomSQL},
 		{&s.selectServerInRoomStmt, selectServerInRoomSQL},
+		{&s.selectJoinedServerNamesInRoomStmt, selectJoinedServerNamesInRoomSQL},
 		{&s.deleteMembershipStmt, deleteMembershipSQL},
 		{&s.selectJoinedUsersStmt, selectJoinedUsersSQL},
 	}.Prepare(db)
@@ -464,6 +474,27 @@ func (s *membershipStatements) SelectServerInRoom(
 	return roomNID == nid, nil
 }
 
+func (s *membershipStatements) SelectJoinedServerNamesInRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]spec.ServerName, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectJoinedServerNamesInRoomStmt)
+	rows, err := stmt.QueryContext(ctx, tables.MembershipStateJoin, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectJoinedServerNamesInRoom: rows.close() failed")
+
+	var serverName spec.ServerName
+	var result []spec.ServerName
+	for rows.Next() {
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		result = append(result, serverName)
+	}
+	return result, rows.Err()
+}
+
 func (s *membershipStatements) DeleteMembership(
 	ctx context.Context, txn *sql.Tx,
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
@@ -27,6 +27,20 @@ const purgeEventJSONSQL = "" +
 	"	SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
 	")"
 
+const purgeBackwardExtremitiesSQL = "" +
+	"DELETE FROM roomserver_backward_extremities WHERE room_nid = $1"
+
+const purgeEventVirtualHostsSQL = "" +
+	"DELETE FROM roomserver_event_virtual_hosts WHERE event_nid IN (" +
+	"	SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeBackfillCheckpointsSQL = "" +
+	"DELETE FROM roomserver_backfill_checkpoints WHERE room_nid = $1"
+
+const purgeBackfillQuarantineSQL = "" +
+	"DELETE FROM roomserver_backfill_quarantine WHERE room_id = $1"
+
 const purgeEventsSQL = "" +
 	"DELETE FROM roomserver_events WHERE room_nid = $1"
 
@@ -64,7 +78,11 @@ const purgeStateSnapshotEntriesSQL = "" +
 	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
 
 type purgeStatements struct {
+	purgeBackwardExtremitiesStmt  *sql.Stmt
+	purgeBackfillCheckpointsStmt  *sql.Stmt
+	purgeBackfillQuarantineStmt   *sql.Stmt
 	purgeEventJSONStmt            *sql.Stmt
+	purgeEventVirtualHostsStmt    *sql.Stmt
 	purgeEventsStmt               *sql.Stmt
 	purgeInvitesStmt              *sql.Stmt
 	purgeMembershipsStmt          *sql.Stmt
@@ -81,7 +99,11 @@ func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
 	s := &purgeStatements{}
 
 	return s, sqlutil.StatementList{
+		{&s.purgeBackwardExtremitiesStmt, purgeBackwardExtremitiesSQL},
+		{&s.purgeBackfillCheckpointsStmt, purgeBackfillCheckpointsSQL},
+		{&s.purgeBackfillQuarantineStmt, purgeBackfillQuarantineSQL},
 		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
+		{&s.purgeEventVirtualHostsStmt, purgeEventVirtualHostsSQL},
 		{&s.purgeEventsStmt, purgeEventsSQL},
 		{&s.purgeInvitesStmt, purgeInvitesSQL},
 		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
@@ -103,6 +125,7 @@ func (s *purgeStatements) PurgeRoom(
 	purgeByRoomID := []*sql.Stmt{
 		s.purgeRoomAliasesStmt,
 		s.purgePublishedStmt,
+		s.purgeBackfillQuarantineStmt,
 	}
 	for _, stmt := range purgeByRoomID {
 		_, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, roomID)
@@ -119,7 +142,10 @@ func (s *purgeStatements) PurgeRoom(
 		s.purgeMembershipsStmt,
 		s.purgePreviousEventsStmt,
 		s.purgeEventJSONStmt,
+		s.purgeEventVirtualHostsStmt,
 		s.purgeRedactionStmt,
+		s.purgeBackwardExtremitiesStmt,
+		s.purgeBackfillCheckpointsStmt,
 		s.purgeEventsStmt,
 		s.purgeRoomStmt,
 	}
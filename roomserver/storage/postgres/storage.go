@@ -55,6 +55,9 @@ func Open(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config
 	if err = executeMigration(ctx, db); err != nil {
 		return nil, err
 	}
+	if err = executeBackwardExtremitiesMigration(ctx, db); err != nil {
+		return nil, err
+	}
 
 	// Then prepare the statements. Now that the migrations have run, any columns referred
 	// to in the database code should now exist.
@@ -65,6 +68,20 @@ func Open(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config
 	return &d, nil
 }
 
+// OpenReadReplica opens a read replica of a postgres database. The tables aren't created or migrated, as the
+// replica can't be written to, so the primary must have done that already.
+func OpenReadReplica(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (*Database, error) {
+	var d Database
+	db, writer, err := conMan.Connection(dbProperties)
+	if err != nil {
+		return nil, fmt.Errorf("sqlutil.Open: %w", err)
+	}
+	if err = d.prepare(db, writer, cache); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
 func executeMigration(ctx context.Context, db *sql.DB) error {
 	// TODO: Remove when we are sure we are not having goose artefacts in the db
 	// This forces an error, which indicates the migration is already applied, since the
@@ -91,6 +108,17 @@ func executeMigration(ctx context.Context, db *sql.DB) error {
 	return m.Up(ctx)
 }
 
+// executeBackwardExtremitiesMigration works out the backward extremities of the rooms which we had before they were
+// tracked. This needs the events tables as well as the backward extremities table, so also runs once they're created.
+func executeBackwardExtremitiesMigration(ctx context.Context, db *sql.DB) error {
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "roomserver: populate backward extremities",
+		Up:      deltas.UpPopulateBackwardExtremities,
+	})
+	return m.Up(ctx)
+}
+
 func (d *Database) create(db *sql.DB) error {
 	if err := CreateEventStateKeysTable(db); err != nil {
 		return err
@@ -137,6 +165,21 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreateReportedEventsTable(db); err != nil {
 		return err
 	}
+	if err := CreateBackwardExtremitiesTable(db); err != nil {
+		return err
+	}
+	if err := CreateEventVirtualHostsTable(db); err != nil {
+		return err
+	}
+	if err := CreateBackfillCheckpointsTable(db); err != nil {
+		return err
+	}
+	if err := CreatePurgeHorizonsTable(db); err != nil {
+		return err
+	}
+	if err := CreateBackfillQuarantineTable(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -206,6 +249,26 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	backwardExtremities, err := PrepareBackwardExtremitiesTable(db)
+	if err != nil {
+		return err
+	}
+	eventVirtualHosts, err := PrepareEventVirtualHostsTable(db)
+	if err != nil {
+		return err
+	}
+	backfillCheckpoints, err := PrepareBackfillCheckpointsTable(db)
+	if err != nil {
+		return err
+	}
+	purgeHorizons, err := PreparePurgeHorizonsTable(db)
+	if err != nil {
+		return err
+	}
+	backfillQuarantine, err := PrepareBackfillQuarantineTable(db)
+	if err != nil {
+		return err
+	}
 
 	d.Database = shared.Database{
 		DB: db,
@@ -221,17 +284,22 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 			RedactionsTable:     redactions,
 			ReportedEventsTable: reportedEvents,
 		},
-		Cache:              cache,
-		Writer:             writer,
-		RoomsTable:         rooms,
-		StateBlockTable:    stateBlock,
-		StateSnapshotTable: stateSnapshot,
-		RoomAliasesTable:   roomAliases,
-		InvitesTable:       invites,
-		MembershipTable:    membership,
-		PublishedTable:     published,
-		Purge:              purge,
-		UserRoomKeyTable:   userRoomKeys,
+		Cache:                    cache,
+		Writer:                   writer,
+		RoomsTable:               rooms,
+		StateBlockTable:          stateBlock,
+		StateSnapshotTable:       stateSnapshot,
+		RoomAliasesTable:         roomAliases,
+		InvitesTable:             invites,
+		MembershipTable:          membership,
+		PublishedTable:           published,
+		Purge:                    purge,
+		UserRoomKeyTable:         userRoomKeys,
+		BackwardExtremitiesTable: backwardExtremities,
+		EventVirtualHostsTable:   eventVirtualHosts,
+		BackfillCheckpointsTable: backfillCheckpoints,
+		PurgeHorizonsTable:       purgeHorizons,
+		BackfillQuarantineTable:  backfillQuarantine,
 	}
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -47,7 +48,17 @@ type Database struct {
 	PublishedTable     tables.Published
 	Purge              tables.Purge
 	UserRoomKeyTable   tables.UserRoomKeys
-	GetRoomUpdaterFn   func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
+	// BackwardExtremitiesTable tracks the events in each room whose prev_events we don't have.
+	BackwardExtremitiesTable tables.BackwardExtremities
+	// EventVirtualHostsTable records which of our virtual hosts backfilled an event.
+	EventVirtualHostsTable tables.EventVirtualHosts
+	// BackfillCheckpointsTable records how far the last backfill of each room got.
+	BackfillCheckpointsTable tables.BackfillCheckpoints
+	// PurgeHorizonsTable records how far back the history of each room was purged.
+	PurgeHorizonsTable tables.PurgeHorizons
+	// BackfillQuarantineTable keeps events which failed auth checks during backfill, if enabled.
+	BackfillQuarantineTable tables.BackfillQuarantine
+	GetRoomUpdaterFn        func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
 }
 
 // EventDatabase contains all tables needed to work with events
@@ -271,45 +282,40 @@ func (d *Database) addState(
 	stateBlockNIDs []types.StateBlockNID,
 	state []types.StateEntry,
 ) (stateNID types.StateSnapshotNID, err error) {
-	if len(stateBlockNIDs) > 0 && len(state) > 0 {
-		// Check to see if the event already appears in any of the existing state
-		// blocks. If it does then we should not add it again, as this will just
-		// result in excess state blocks and snapshots.
-		// TODO: Investigate why this is happening - probably input_events.go!
-		blocks, berr := d.StateBlockTable.BulkSelectStateBlockEntries(ctx, txn, stateBlockNIDs)
-		if berr != nil {
-			return 0, fmt.Errorf("d.StateBlockTable.BulkSelectStateBlockEntries: %w", berr)
-		}
-		var found bool
-		for i := len(state) - 1; i >= 0; i-- {
-			found = false
-		blocksLoop:
-			for _, events := range blocks {
-				for _, event := range events {
-					if state[i].EventNID == event {
-						found = true
-						break blocksLoop
-					}
-				}
-			}
-			if found {
-				state = append(state[:i], state[i+1:]...)
-			}
-		}
+	state, err = d.withoutExistingStateEntries(ctx, txn, stateBlockNIDs, state)
+	if err != nil {
+		return 0, err
 	}
 	err = d.Writer.Do(d.DB, txn, func(txn *sql.Tx) error {
-		if len(state) > 0 {
-			// If there's any state left to add then let's add new blocks.
-			var stateBlockNID types.StateBlockNID
-			stateBlockNID, err = d.StateBlockTable.BulkInsertStateData(ctx, txn, state)
-			if err != nil {
-				return fmt.Errorf("d.StateBlockTable.BulkInsertStateData: %w", err)
-			}
-			stateBlockNIDs = append(stateBlockNIDs[:len(stateBlockNIDs):len(stateBlockNIDs)], stateBlockNID)
+		stateNID, err = d.insertState(ctx, txn, roomNID, stateBlockNIDs, state)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("d.Writer.Do: %w", err)
+	}
+	return
+}
+
+// AddAndSetState stores the given state and sets it as the state before the given event in a single
+// transaction, so that a failure can never leave behind a state snapshot which no event refers to.
+func (d *Database) AddAndSetState(
+	ctx context.Context,
+	roomNID types.RoomNID,
+	eventNID types.EventNID,
+	stateBlockNIDs []types.StateBlockNID,
+	state []types.StateEntry,
+) (stateNID types.StateSnapshotNID, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		state, err = d.withoutExistingStateEntries(ctx, txn, stateBlockNIDs, state)
+		if err != nil {
+			return err
 		}
-		stateNID, err = d.StateSnapshotTable.InsertState(ctx, txn, roomNID, stateBlockNIDs)
+		stateNID, err = d.insertState(ctx, txn, roomNID, stateBlockNIDs, state)
 		if err != nil {
-			return fmt.Errorf("d.StateSnapshotTable.InsertState: %w", err)
+			return err
+		}
+		if err = d.EventsTable.UpdateEventState(ctx, txn, eventNID, stateNID); err != nil {
+			return fmt.Errorf("d.EventsTable.UpdateEventState: %w", err)
 		}
 		return nil
 	})
@@ -319,12 +325,84 @@ func (d *Database) addState(
 	return
 }
 
+// withoutExistingStateEntries removes the state entries which already appear in the given state blocks.
+func (d *Database) withoutExistingStateEntries(
+	ctx context.Context, txn *sql.Tx,
+	stateBlockNIDs []types.StateBlockNID,
+	state []types.StateEntry,
+) ([]types.StateEntry, error) {
+	if len(stateBlockNIDs) == 0 || len(state) == 0 {
+		return state, nil
+	}
+	// Check to see if the event already appears in any of the existing state
+	// blocks. If it does then we should not add it again, as this will just
+	// result in excess state blocks and snapshots.
+	// TODO: Investigate why this is happening - probably input_events.go!
+	blocks, err := d.StateBlockTable.BulkSelectStateBlockEntries(ctx, txn, stateBlockNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("d.StateBlockTable.BulkSelectStateBlockEntries: %w", err)
+	}
+	var found bool
+	for i := len(state) - 1; i >= 0; i-- {
+		found = false
+	blocksLoop:
+		for _, events := range blocks {
+			for _, event := range events {
+				if state[i].EventNID == event {
+					found = true
+					break blocksLoop
+				}
+			}
+		}
+		if found {
+			state = append(state[:i], state[i+1:]...)
+		}
+	}
+	return state, nil
+}
+
+// insertState stores any new state entries as a state block and then stores the state snapshot.
+// The txn must already be held by the writer.
+func (d *Database) insertState(
+	ctx context.Context, txn *sql.Tx,
+	roomNID types.RoomNID,
+	stateBlockNIDs []types.StateBlockNID,
+	state []types.StateEntry,
+) (types.StateSnapshotNID, error) {
+	if len(state) > 0 {
+		// If there's any state left to add then let's add new blocks.
+		stateBlockNID, err := d.StateBlockTable.BulkInsertStateData(ctx, txn, state)
+		if err != nil {
+			return 0, fmt.Errorf("d.StateBlockTable.BulkInsertStateData: %w", err)
+		}
+		stateBlockNIDs = append(stateBlockNIDs[:len(stateBlockNIDs):len(stateBlockNIDs)], stateBlockNID)
+	}
+	stateNID, err := d.StateSnapshotTable.InsertState(ctx, txn, roomNID, stateBlockNIDs)
+	if err != nil {
+		return 0, fmt.Errorf("d.StateSnapshotTable.InsertState: %w", err)
+	}
+	return stateNID, nil
+}
+
 func (d *EventDatabase) EventNIDs(
 	ctx context.Context, eventIDs []string,
 ) (map[string]types.EventMetadata, error) {
 	return d.eventNIDs(ctx, nil, eventIDs, NoFilter)
 }
 
+// ExistingEventIDs returns which of the given events we have, without looking up their NIDs.
+func (d *EventDatabase) ExistingEventIDs(ctx context.Context, eventIDs []string) (map[string]bool, error) {
+	existing, err := d.EventsTable.BulkSelectExistingEventID(ctx, nil, eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]bool, len(existing))
+	for _, eventID := range existing {
+		result[eventID] = true
+	}
+	return result, nil
+}
+
 type UnsentFilter bool
 
 const (
@@ -771,6 +849,27 @@ func (d *EventDatabase) StoreEvent(
 	ctx context.Context, event gomatrixserverlib.PDU,
 	roomInfo *types.RoomInfo, eventTypeNID types.EventTypeNID, eventStateKeyNID types.EventStateKeyNID,
 	authEventNIDs []types.EventNID, isRejected bool,
+) (types.EventNID, types.StateAtEvent, error) {
+	return d.storeEvent(ctx, event, roomInfo, eventTypeNID, eventStateKeyNID, authEventNIDs, isRejected, nil)
+}
+
+// StoreEventAndUpdateBackwardExtremities stores the event as StoreEvent does, and updates the backward extremities
+// of the room in the same transaction. This shouldn't be used for outliers, as they aren't part of the room DAG.
+func (d *Database) StoreEventAndUpdateBackwardExtremities(
+	ctx context.Context, event gomatrixserverlib.PDU,
+	roomInfo *types.RoomInfo, eventTypeNID types.EventTypeNID, eventStateKeyNID types.EventStateKeyNID,
+	authEventNIDs []types.EventNID, isRejected bool,
+) (types.EventNID, types.StateAtEvent, error) {
+	return d.storeEvent(ctx, event, roomInfo, eventTypeNID, eventStateKeyNID, authEventNIDs, isRejected, func(txn *sql.Tx) error {
+		return d.updateBackwardExtremities(ctx, txn, roomInfo.RoomNID, []gomatrixserverlib.PDU{event})
+	})
+}
+
+// storeEvent stores the event, calling andThen, if set, in the same transaction once the event has been stored.
+func (d *EventDatabase) storeEvent(
+	ctx context.Context, event gomatrixserverlib.PDU,
+	roomInfo *types.RoomInfo, eventTypeNID types.EventTypeNID, eventStateKeyNID types.EventStateKeyNID,
+	authEventNIDs []types.EventNID, isRejected bool, andThen func(txn *sql.Tx) error,
 ) (types.EventNID, types.StateAtEvent, error) {
 	var (
 		eventNID types.EventNID
@@ -820,6 +919,9 @@ func (d *EventDatabase) StoreEvent(
 			}
 		}
 
+		if andThen != nil {
+			return andThen(txn)
+		}
 		return nil
 	})
 	if err != nil {
@@ -1617,6 +1719,140 @@ func (d *Database) GetServerInRoom(ctx context.Context, roomNID types.RoomNID, s
 	return d.MembershipTable.SelectServerInRoom(ctx, nil, roomNID, serverName)
 }
 
+// GetJoinedServerNamesInRoom returns the distinct server names of the users currently joined to the room.
+func (d *Database) GetJoinedServerNamesInRoom(ctx context.Context, roomNID types.RoomNID) ([]spec.ServerName, error) {
+	return d.MembershipTable.SelectJoinedServerNamesInRoom(ctx, nil, roomNID)
+}
+
+// BackwardExtremitiesForRoom returns the backward extremities of the room, as a map of event ID to the prev_event IDs we don't have.
+func (d *Database) BackwardExtremitiesForRoom(ctx context.Context, roomNID types.RoomNID) (map[string][]string, error) {
+	return d.BackwardExtremitiesTable.SelectBackwardExtremitiesForRoom(ctx, nil, roomNID)
+}
+
+// UpdateBackwardExtremities updates the backward extremities of the room now that we have the given events. Any
+// extremities which were waiting on one of the events are removed, and the events themselves become backward
+// extremities if we don't have all of their prev_events.
+func (d *Database) UpdateBackwardExtremities(ctx context.Context, roomNID types.RoomNID, events []gomatrixserverlib.PDU) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.updateBackwardExtremities(ctx, txn, roomNID, events)
+	})
+}
+
+func (d *Database) updateBackwardExtremities(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, events []gomatrixserverlib.PDU) error {
+	eventIDs := make(map[string]struct{}, len(events))
+	var prevEventIDs []string
+	for _, ev := range events {
+		eventIDs[ev.EventID()] = struct{}{}
+		prevEventIDs = append(prevEventIDs, ev.PrevEventIDs()...)
+		if err := d.BackwardExtremitiesTable.DeleteBackwardExtremity(ctx, txn, roomNID, ev.EventID()); err != nil {
+			return fmt.Errorf("d.BackwardExtremitiesTable.DeleteBackwardExtremity: %w", err)
+		}
+	}
+	if len(prevEventIDs) == 0 {
+		return nil
+	}
+	known, err := d.EventsTable.BulkSelectEventNID(ctx, txn, prevEventIDs)
+	if err != nil {
+		return fmt.Errorf("d.EventsTable.BulkSelectEventNID: %w", err)
+	}
+	for _, ev := range events {
+		for _, prevEventID := range ev.PrevEventIDs() {
+			if _, ok := known[prevEventID]; ok {
+				continue
+			}
+			if _, ok := eventIDs[prevEventID]; ok {
+				continue
+			}
+			if err = d.BackwardExtremitiesTable.InsertBackwardExtremity(ctx, txn, roomNID, ev.EventID(), prevEventID); err != nil {
+				return fmt.Errorf("d.BackwardExtremitiesTable.InsertBackwardExtremity: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// RecordEventVirtualHost records that the given events were backfilled for the given virtual host. Events which
+// already have a virtual host recorded keep it.
+func (d *Database) RecordEventVirtualHost(ctx context.Context, virtualHost spec.ServerName, eventNIDs []types.EventNID) error {
+	if len(eventNIDs) == 0 {
+		return nil
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, eventNID := range eventNIDs {
+			if err := d.EventVirtualHostsTable.InsertEventVirtualHost(ctx, txn, eventNID, virtualHost); err != nil {
+				return fmt.Errorf("d.EventVirtualHostsTable.InsertEventVirtualHost: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// EventVirtualHost returns the virtual host the event was backfilled for, or an empty server name if it
+// wasn't backfilled or the virtual host wasn't recorded.
+func (d *Database) EventVirtualHost(ctx context.Context, eventNID types.EventNID) (spec.ServerName, error) {
+	virtualHost, err := d.EventVirtualHostsTable.SelectEventVirtualHost(ctx, nil, eventNID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return virtualHost, err
+}
+
+// SetBackfillCheckpoint records that the given backfilled event and everything after it has been persisted.
+func (d *Database) SetBackfillCheckpoint(ctx context.Context, roomNID types.RoomNID, eventID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BackfillCheckpointsTable.UpsertBackfillCheckpoint(ctx, txn, roomNID, eventID)
+	})
+}
+
+// BackfillCheckpoint returns the checkpoint recorded by the last backfill of the room, or an empty string if there isn't one.
+func (d *Database) BackfillCheckpoint(ctx context.Context, roomNID types.RoomNID) (string, error) {
+	eventID, err := d.BackfillCheckpointsTable.SelectBackfillCheckpoint(ctx, nil, roomNID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return eventID, err
+}
+
+// PurgeHorizon returns how far back the history of the room was purged, or nil if it was never purged.
+func (d *Database) PurgeHorizon(ctx context.Context, roomID string) (*types.PurgeHorizon, error) {
+	horizon, err := d.PurgeHorizonsTable.SelectPurgeHorizon(ctx, nil, roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return horizon, err
+}
+
+// SetPurgeHorizon records how far back the history of the room was purged, replacing any earlier horizon.
+func (d *Database) SetPurgeHorizon(ctx context.Context, roomID string, horizon types.PurgeHorizon) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PurgeHorizonsTable.UpsertPurgeHorizon(ctx, txn, roomID, horizon)
+	})
+}
+
+// QuarantineEvent stores an event which failed auth checks during backfill, replacing any earlier quarantine of it.
+func (d *Database) QuarantineEvent(ctx context.Context, event *types.QuarantinedEvent) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BackfillQuarantineTable.InsertQuarantinedEvent(ctx, txn, event)
+	})
+}
+
+// QuarantinedEvents returns the quarantined events of the room, oldest first.
+func (d *Database) QuarantinedEvents(ctx context.Context, roomID string) ([]types.QuarantinedEvent, error) {
+	return d.BackfillQuarantineTable.SelectQuarantinedEvents(ctx, nil, roomID)
+}
+
+// QuarantinedEvent returns the quarantined event, or nil if it isn't quarantined.
+func (d *Database) QuarantinedEvent(ctx context.Context, eventID string) (*types.QuarantinedEvent, error) {
+	event, err := d.BackfillQuarantineTable.SelectQuarantinedEvent(ctx, nil, eventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return event, err
+}
+
 // GetKnownUsers searches all users that userID knows about.
 func (d *Database) GetKnownUsers(ctx context.Context, userID, searchString string, limit int) ([]string, error) {
 	stateKeyNID, err := d.EventStateKeysTable.SelectEventStateKeyNID(ctx, nil, userID)
@@ -1676,6 +1912,19 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 			}
 			return fmt.Errorf("failed to lock the room: %w", err)
 		}
+		// Everything up to now is purged, so make sure that backfill doesn't bring any of it back.
+		latestNIDs, _, err := d.RoomsTable.SelectLatestEventNIDs(ctx, txn, roomNID)
+		if err != nil {
+			return fmt.Errorf("failed to get the latest events: %w", err)
+		}
+		depth, err := d.EventsTable.SelectMaxEventDepth(ctx, txn, latestNIDs)
+		if err != nil {
+			return fmt.Errorf("failed to get the depth of the latest events: %w", err)
+		}
+		horizon := types.PurgeHorizon{Depth: depth, Timestamp: spec.AsTimestamp(time.Now())}
+		if err = d.PurgeHorizonsTable.UpsertPurgeHorizon(ctx, txn, roomID, horizon); err != nil {
+			return fmt.Errorf("failed to set the purge horizon: %w", err)
+		}
 		return d.Purge.PurgeRoom(ctx, txn, roomNID, roomID)
 	})
 }
@@ -3,6 +3,8 @@ package shared_test
 import (
 	"context"
 	"crypto/ed25519"
+	"database/sql"
+	"errors"
 	"testing"
 	"time"
 
@@ -226,3 +228,52 @@ func TestAssignRoomNID(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+// failingEventsTable fails every attempt to set the state at an event.
+type failingEventsTable struct {
+	tables.Events
+}
+
+func (t *failingEventsTable) UpdateEventState(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID) error {
+	return errors.New("failed to update event state")
+}
+
+func TestAddAndSetStateLeavesNoOrphanedSnapshot(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateRoomserverDatabase(t, dbType)
+		defer close()
+
+		var err error
+		var stateBlockTable tables.StateBlock
+		var stateSnapshotTable tables.StateSnapshot
+		switch dbType {
+		case test.DBTypePostgres:
+			assert.NoError(t, postgres.CreateStateBlockTable(db.DB))
+			assert.NoError(t, postgres.CreateStateSnapshotTable(db.DB))
+			stateBlockTable, err = postgres.PrepareStateBlockTable(db.DB)
+			assert.NoError(t, err)
+			stateSnapshotTable, err = postgres.PrepareStateSnapshotTable(db.DB)
+		case test.DBTypeSQLite:
+			assert.NoError(t, sqlite3.CreateStateBlockTable(db.DB))
+			assert.NoError(t, sqlite3.CreateStateSnapshotTable(db.DB))
+			stateBlockTable, err = sqlite3.PrepareStateBlockTable(db.DB)
+			assert.NoError(t, err)
+			stateSnapshotTable, err = sqlite3.PrepareStateSnapshotTable(db.DB)
+		}
+		assert.NoError(t, err)
+		db.StateBlockTable = stateBlockTable
+		db.StateSnapshotTable = stateSnapshotTable
+		db.EventsTable = &failingEventsTable{}
+
+		state := []types.StateEntry{{StateKeyTuple: types.StateKeyTuple{EventTypeNID: 1, EventStateKeyNID: 1}, EventNID: 1}}
+		_, err = db.AddAndSetState(context.Background(), 1, 1, nil, state)
+		assert.Error(t, err)
+
+		// Setting the state failed, so the snapshot and its state block must have been rolled back.
+		var count int
+		assert.NoError(t, db.DB.QueryRow("SELECT COUNT(*) FROM roomserver_state_snapshots").Scan(&count))
+		assert.Equal(t, 0, count)
+		assert.NoError(t, db.DB.QueryRow("SELECT COUNT(*) FROM roomserver_state_block").Scan(&count))
+		assert.Equal(t, 0, count)
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const backfillCheckpointsSchema = `
+-- Stores how far a backfill of each room got, so that a backfill which was interrupted can be resumed.
+CREATE TABLE IF NOT EXISTS roomserver_backfill_checkpoints (
+	-- The room NID the backfill was for.
+	room_nid INTEGER PRIMARY KEY,
+	-- The oldest backfilled event which was persisted along with its state. Backfilling
+	-- can carry on from the prev_events of this event.
+	event_id TEXT NOT NULL
+);
+`
+
+const upsertBackfillCheckpointSQL = "" +
+	"INSERT INTO roomserver_backfill_checkpoints (room_nid, event_id)" +
+	" VALUES ($1, $2)" +
+	" ON CONFLICT (room_nid) DO UPDATE SET event_id = $2"
+
+const selectBackfillCheckpointSQL = "" +
+	"SELECT event_id FROM roomserver_backfill_checkpoints WHERE room_nid = $1"
+
+type backfillCheckpointsStatements struct {
+	upsertBackfillCheckpointStmt *sql.Stmt
+	selectBackfillCheckpointStmt *sql.Stmt
+}
+
+func CreateBackfillCheckpointsTable(db *sql.DB) error {
+	_, err := db.Exec(backfillCheckpointsSchema)
+	return err
+}
+
+func PrepareBackfillCheckpointsTable(db *sql.DB) (tables.BackfillCheckpoints, error) {
+	s := &backfillCheckpointsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertBackfillCheckpointStmt, upsertBackfillCheckpointSQL},
+		{&s.selectBackfillCheckpointStmt, selectBackfillCheckpointSQL},
+	}.Prepare(db)
+}
+
+func (s *backfillCheckpointsStatements) UpsertBackfillCheckpoint(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertBackfillCheckpointStmt).ExecContext(ctx, int64(roomNID), eventID)
+	return err
+}
+
+func (s *backfillCheckpointsStatements) SelectBackfillCheckpoint(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (string, error) {
+	var eventID string
+	err := sqlutil.TxStmt(txn, s.selectBackfillCheckpointStmt).QueryRowContext(ctx, int64(roomNID)).Scan(&eventID)
+	return eventID, err
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const backfillQuarantineSchema = `
+-- Stores events which failed auth checks while fetching missing events during backfill,
+-- so that they can be inspected instead of being silently dropped.
+CREATE TABLE IF NOT EXISTS roomserver_backfill_quarantine (
+	-- The ID of the quarantined event.
+	event_id TEXT PRIMARY KEY,
+	-- The room the event was fetched for.
+	room_id TEXT NOT NULL,
+	-- The server the event was fetched from.
+	origin TEXT NOT NULL,
+	-- Why the event was quarantined.
+	reason TEXT NOT NULL,
+	-- The JSON of the event.
+	event_json TEXT NOT NULL,
+	-- When the event was quarantined.
+	quarantined_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_backfill_quarantine_room_id_idx ON roomserver_backfill_quarantine(room_id);
+`
+
+const insertQuarantinedEventSQL = "" +
+	"INSERT INTO roomserver_backfill_quarantine (event_id, room_id, origin, reason, event_json, quarantined_at)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (event_id) DO UPDATE SET origin = $3, reason = $4, quarantined_at = $6"
+
+const selectQuarantinedEventsSQL = "" +
+	"SELECT event_id, room_id, origin, reason, event_json, quarantined_at FROM roomserver_backfill_quarantine" +
+	" WHERE room_id = $1 ORDER BY quarantined_at, event_id"
+
+const selectQuarantinedEventSQL = "" +
+	"SELECT event_id, room_id, origin, reason, event_json, quarantined_at FROM roomserver_backfill_quarantine" +
+	" WHERE event_id = $1"
+
+type backfillQuarantineStatements struct {
+	insertQuarantinedEventStmt  *sql.Stmt
+	selectQuarantinedEventsStmt *sql.Stmt
+	selectQuarantinedEventStmt  *sql.Stmt
+}
+
+func CreateBackfillQuarantineTable(db *sql.DB) error {
+	_, err := db.Exec(backfillQuarantineSchema)
+	return err
+}
+
+func PrepareBackfillQuarantineTable(db *sql.DB) (tables.BackfillQuarantine, error) {
+	s := &backfillQuarantineStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertQuarantinedEventStmt, insertQuarantinedEventSQL},
+		{&s.selectQuarantinedEventsStmt, selectQuarantinedEventsSQL},
+		{&s.selectQuarantinedEventStmt, selectQuarantinedEventSQL},
+	}.Prepare(db)
+}
+
+func (s *backfillQuarantineStatements) InsertQuarantinedEvent(
+	ctx context.Context, txn *sql.Tx, event *types.QuarantinedEvent,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertQuarantinedEventStmt).ExecContext(
+		ctx, event.EventID, event.RoomID, string(event.Origin), event.Reason, string(event.EventJSON), int64(event.QuarantinedAt),
+	)
+	return err
+}
+
+func (s *backfillQuarantineStatements) SelectQuarantinedEvents(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) ([]types.QuarantinedEvent, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectQuarantinedEventsStmt).QueryContext(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQuarantinedEventsStmt: rows.close() failed")
+
+	var events []types.QuarantinedEvent
+	for rows.Next() {
+		event, err := scanQuarantinedEvent(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	return events, rows.Err()
+}
+
+func (s *backfillQuarantineStatements) SelectQuarantinedEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (*types.QuarantinedEvent, error) {
+	return scanQuarantinedEvent(sqlutil.TxStmt(txn, s.selectQuarantinedEventStmt).QueryRowContext(ctx, eventID).Scan)
+}
+
+func scanQuarantinedEvent(scan func(dest ...interface{}) error) (*types.QuarantinedEvent, error) {
+	var event types.QuarantinedEvent
+	var origin, eventJSON string
+	var quarantinedAt int64
+	if err := scan(&event.EventID, &event.RoomID, &origin, &event.Reason, &eventJSON, &quarantinedAt); err != nil {
+		return nil, err
+	}
+	event.Origin = spec.ServerName(origin)
+	event.EventJSON = []byte(eventJSON)
+	event.QuarantinedAt = spec.Timestamp(quarantinedAt)
+	return &event, nil
+}
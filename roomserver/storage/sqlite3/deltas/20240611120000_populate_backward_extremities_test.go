@@ -0,0 +1,61 @@
+package deltas
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpPopulateBackwardExtremities(t *testing.T) {
+	cfg, ctx, close := testrig.CreateConfig(t, test.DBTypeSQLite)
+	defer close()
+
+	db, err := sqlutil.Open(&cfg.RoomServer.Database, sqlutil.NewExclusiveWriter())
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer db.Close()
+
+	// create slimmed down tables with the columns the migration needs
+	_, err = db.ExecContext(ctx.Context(), `
+CREATE TABLE roomserver_rooms (room_nid BIGINT NOT NULL);
+CREATE TABLE roomserver_events (event_nid BIGINT NOT NULL, room_nid BIGINT NOT NULL, event_id TEXT NOT NULL, state_snapshot_nid BIGINT NOT NULL);
+CREATE TABLE roomserver_event_json (event_nid BIGINT NOT NULL, event_json TEXT NOT NULL);
+CREATE TABLE roomserver_backward_extremities (room_nid BIGINT NOT NULL, event_id TEXT NOT NULL, prev_event_id TEXT NOT NULL, PRIMARY KEY(room_nid, event_id, prev_event_id));
+
+INSERT INTO roomserver_rooms (room_nid) VALUES (1), (2);
+INSERT INTO roomserver_events (event_nid, room_nid, event_id, state_snapshot_nid) VALUES
+	(1, 1, '$b', 1), (2, 1, '$c', 2), (3, 1, '$outlier', 0), (4, 2, '$v1', 3);
+INSERT INTO roomserver_event_json (event_nid, event_json) VALUES
+	(1, '{"prev_events":["$a"]}'),
+	(2, '{"prev_events":["$b","$x"]}'),
+	(3, '{"prev_events":["$y"]}'),
+	(4, '{"prev_events":[["$v0",{"sha256":"abc"}]]}');
+`)
+	assert.Nil(t, err)
+
+	// execute the migration
+	txn, err := db.Begin()
+	assert.Nil(t, err)
+	assert.NotNil(t, txn)
+	defer txn.Rollback()
+	err = UpPopulateBackwardExtremities(ctx.Context(), txn)
+	assert.NoError(t, err)
+
+	rows, err := txn.QueryContext(ctx.Context(), `SELECT room_nid, event_id, prev_event_id FROM roomserver_backward_extremities`)
+	assert.NoError(t, err)
+	defer rows.Close() // nolint: errcheck
+	var got []string
+	for rows.Next() {
+		var roomNID int64
+		var eventID, prevEventID string
+		assert.NoError(t, rows.Scan(&roomNID, &eventID, &prevEventID))
+		got = append(got, fmt.Sprintf("%d %s %s", roomNID, eventID, prevEventID))
+	}
+	assert.NoError(t, rows.Err())
+	// outliers aren't part of the DAG, so don't become backward extremities
+	assert.ElementsMatch(t, []string{"1 $b $a", "1 $c $x", "2 $v1 $v0"}, got)
+}
@@ -116,6 +116,9 @@ const bulkSelectEventIDSQL = "" +
 const bulkSelectEventNIDSQL = "" +
 	"SELECT event_id, event_nid, room_nid FROM roomserver_events WHERE event_id IN ($1)"
 
+const bulkSelectExistingEventIDSQL = "" +
+	"SELECT event_id FROM roomserver_events WHERE event_id IN ($1)"
+
 const bulkSelectUnsentEventNIDSQL = "" +
 	"SELECT event_id, event_nid, room_nid FROM roomserver_events WHERE sent_to_output = 0 AND event_id IN ($1)"
 
@@ -629,6 +632,35 @@ func (s *eventStatements) bulkSelectEventNID(ctx context.Context, txn *sql.Tx, e
 	return results, rows.Err()
 }
 
+// BulkSelectExistingEventID returns which of the given event IDs are in the database.
+func (s *eventStatements) BulkSelectExistingEventID(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]string, error) {
+	iEventIDs := make([]interface{}, len(eventIDs))
+	for k, v := range eventIDs {
+		iEventIDs[k] = v
+	}
+	selectOrig := strings.Replace(bulkSelectExistingEventIDSQL, "($1)", sqlutil.QueryVariadic(len(iEventIDs)), 1)
+	selectPrep, err := s.db.Prepare(selectOrig)
+	if err != nil {
+		return nil, err
+	}
+	defer selectPrep.Close() // nolint:errcheck
+	selectStmt := sqlutil.TxStmt(txn, selectPrep)
+	rows, err := selectStmt.QueryContext(ctx, iEventIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectExistingEventID: rows.close() failed")
+	results := make([]string, 0, len(eventIDs))
+	var eventID string
+	for rows.Next() {
+		if err = rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		results = append(results, eventID)
+	}
+	return results, rows.Err()
+}
+
 func (s *eventStatements) SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error) {
 	var result int64
 	iEventIDs := make([]interface{}, len(eventNIDs))
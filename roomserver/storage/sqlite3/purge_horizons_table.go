@@ -0,0 +1,83 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+const purgeHorizonsSchema = `
+-- Stores how far back the history of each room was purged, so that backfill doesn't bring the history back.
+-- This is keyed by room ID rather than room NID so that it outlives the room being purged entirely.
+CREATE TABLE IF NOT EXISTS roomserver_purge_horizons (
+	-- The room ID which was purged.
+	room_id TEXT PRIMARY KEY,
+	-- Backfilled events with a lower depth than this are dropped.
+	depth INTEGER NOT NULL,
+	-- Backfilled events sent before this time, in milliseconds, are dropped.
+	origin_server_ts INTEGER NOT NULL
+);
+`
+
+const upsertPurgeHorizonSQL = "" +
+	"INSERT INTO roomserver_purge_horizons (room_id, depth, origin_server_ts)" +
+	" VALUES ($1, $2, $3)" +
+	" ON CONFLICT (room_id) DO UPDATE SET depth = $2, origin_server_ts = $3"
+
+const selectPurgeHorizonSQL = "" +
+	"SELECT depth, origin_server_ts FROM roomserver_purge_horizons WHERE room_id = $1"
+
+type purgeHorizonsStatements struct {
+	upsertPurgeHorizonStmt *sql.Stmt
+	selectPurgeHorizonStmt *sql.Stmt
+}
+
+func CreatePurgeHorizonsTable(db *sql.DB) error {
+	_, err := db.Exec(purgeHorizonsSchema)
+	return err
+}
+
+func PreparePurgeHorizonsTable(db *sql.DB) (tables.PurgeHorizons, error) {
+	s := &purgeHorizonsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertPurgeHorizonStmt, upsertPurgeHorizonSQL},
+		{&s.selectPurgeHorizonStmt, selectPurgeHorizonSQL},
+	}.Prepare(db)
+}
+
+func (s *purgeHorizonsStatements) UpsertPurgeHorizon(
+	ctx context.Context, txn *sql.Tx, roomID string, horizon types.PurgeHorizon,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertPurgeHorizonStmt).ExecContext(ctx, roomID, horizon.Depth, int64(horizon.Timestamp))
+	return err
+}
+
+func (s *purgeHorizonsStatements) SelectPurgeHorizon(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (*types.PurgeHorizon, error) {
+	var depth, ts int64
+	if err := sqlutil.TxStmt(txn, s.selectPurgeHorizonStmt).QueryRowContext(ctx, roomID).Scan(&depth, &ts); err != nil {
+		return nil, err
+	}
+	return &types.PurgeHorizon{Depth: depth, Timestamp: spec.Timestamp(ts)}, nil
+}
@@ -63,6 +63,9 @@ func Open(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config
 	if err = executeMigration(ctx, db); err != nil {
 		return nil, err
 	}
+	if err = executeBackwardExtremitiesMigration(ctx, db); err != nil {
+		return nil, err
+	}
 
 	// Then prepare the statements. Now that the migrations have run, any columns referred
 	// to in the database code should now exist.
@@ -98,6 +101,17 @@ func executeMigration(ctx context.Context, db *sql.DB) error {
 	return m.Up(ctx)
 }
 
+// executeBackwardExtremitiesMigration works out the backward extremities of the rooms which we had before they were
+// tracked. This needs the events tables as well as the backward extremities table, so also runs once they're created.
+func executeBackwardExtremitiesMigration(ctx context.Context, db *sql.DB) error {
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "roomserver: populate backward extremities",
+		Up:      deltas.UpPopulateBackwardExtremities,
+	})
+	return m.Up(ctx)
+}
+
 func (d *Database) create(db *sql.DB) error {
 	if err := CreateEventStateKeysTable(db); err != nil {
 		return err
@@ -144,6 +158,21 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreateReportedEventsTable(db); err != nil {
 		return err
 	}
+	if err := CreateBackwardExtremitiesTable(db); err != nil {
+		return err
+	}
+	if err := CreateEventVirtualHostsTable(db); err != nil {
+		return err
+	}
+	if err := CreateBackfillCheckpointsTable(db); err != nil {
+		return err
+	}
+	if err := CreatePurgeHorizonsTable(db); err != nil {
+		return err
+	}
+	if err := CreateBackfillQuarantineTable(db); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -212,6 +241,26 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	backwardExtremities, err := PrepareBackwardExtremitiesTable(db)
+	if err != nil {
+		return err
+	}
+	eventVirtualHosts, err := PrepareEventVirtualHostsTable(db)
+	if err != nil {
+		return err
+	}
+	backfillCheckpoints, err := PrepareBackfillCheckpointsTable(db)
+	if err != nil {
+		return err
+	}
+	purgeHorizons, err := PreparePurgeHorizonsTable(db)
+	if err != nil {
+		return err
+	}
+	backfillQuarantine, err := PrepareBackfillQuarantineTable(db)
+	if err != nil {
+		return err
+	}
 
 	d.Database = shared.Database{
 		DB: db,
@@ -227,18 +276,23 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 			RedactionsTable:     redactions,
 			ReportedEventsTable: reportedEvents,
 		},
-		Cache:              cache,
-		Writer:             writer,
-		RoomsTable:         rooms,
-		StateBlockTable:    stateBlock,
-		StateSnapshotTable: stateSnapshot,
-		RoomAliasesTable:   roomAliases,
-		InvitesTable:       invites,
-		MembershipTable:    membership,
-		PublishedTable:     published,
-		GetRoomUpdaterFn:   d.GetRoomUpdater,
-		Purge:              purge,
-		UserRoomKeyTable:   userRoomKeys,
+		Cache:                    cache,
+		Writer:                   writer,
+		RoomsTable:               rooms,
+		StateBlockTable:          stateBlock,
+		StateSnapshotTable:       stateSnapshot,
+		RoomAliasesTable:         roomAliases,
+		InvitesTable:             invites,
+		MembershipTable:          membership,
+		PublishedTable:           published,
+		GetRoomUpdaterFn:         d.GetRoomUpdater,
+		Purge:                    purge,
+		UserRoomKeyTable:         userRoomKeys,
+		BackwardExtremitiesTable: backwardExtremities,
+		EventVirtualHostsTable:   eventVirtualHosts,
+		BackfillCheckpointsTable: backfillCheckpoints,
+		PurgeHorizonsTable:       purgeHorizons,
+		BackfillQuarantineTable:  backfillQuarantine,
 	}
 	return nil
 }
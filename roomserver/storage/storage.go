@@ -39,3 +39,14 @@ func Open(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config
 		return nil, fmt.Errorf("unexpected database type")
 	}
 }
+
+// OpenReadReplica opens a connection to a read replica of the database, which must only be read from.
+// Only PostgreSQL supports read replicas.
+func OpenReadReplica(ctx context.Context, conMan *sqlutil.Connections, dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (Database, error) {
+	switch {
+	case dbProperties.ConnectionString.IsPostgres():
+		return postgres.OpenReadReplica(ctx, conMan, dbProperties, cache)
+	default:
+		return nil, fmt.Errorf("read replicas are only supported with PostgreSQL")
+	}
+}
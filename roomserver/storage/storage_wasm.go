@@ -35,3 +35,8 @@ func Open(ctx context.Context, conMan sqlutil.Connections, dbProperties *config.
 		return nil, fmt.Errorf("unexpected database type")
 	}
 }
+
+// OpenReadReplica opens a connection to a read replica of the database, which isn't supported here.
+func OpenReadReplica(ctx context.Context, conMan sqlutil.Connections, dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (Database, error) {
+	return nil, fmt.Errorf("read replicas are only supported with PostgreSQL")
+}
@@ -0,0 +1,61 @@
+package tables_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreateBackfillCheckpointsTable(t *testing.T, dbType test.DBType) (tab tables.BackfillCheckpoints, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateBackfillCheckpointsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareBackfillCheckpointsTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreateBackfillCheckpointsTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PrepareBackfillCheckpointsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestBackfillCheckpointsTable(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateBackfillCheckpointsTable(t, dbType)
+		defer close()
+
+		assert.NoError(t, tab.UpsertBackfillCheckpoint(ctx, nil, 1, "$a"))
+		assert.NoError(t, tab.UpsertBackfillCheckpoint(ctx, nil, 2, "$b"))
+		// a later checkpoint replaces the earlier one
+		assert.NoError(t, tab.UpsertBackfillCheckpoint(ctx, nil, 1, "$c"))
+
+		eventID, err := tab.SelectBackfillCheckpoint(ctx, nil, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "$c", eventID)
+		eventID, err = tab.SelectBackfillCheckpoint(ctx, nil, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, "$b", eventID)
+
+		_, err = tab.SelectBackfillCheckpoint(ctx, nil, 3)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
@@ -0,0 +1,79 @@
+package tables_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreateBackfillQuarantineTable(t *testing.T, dbType test.DBType) (tab tables.BackfillQuarantine, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateBackfillQuarantineTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareBackfillQuarantineTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreateBackfillQuarantineTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PrepareBackfillQuarantineTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestBackfillQuarantineTable(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateBackfillQuarantineTable(t, dbType)
+		defer close()
+
+		first := &types.QuarantinedEvent{
+			EventID: "$a", RoomID: "!room:test", Origin: "a.test", Reason: "bad auth",
+			EventJSON: json.RawMessage(`{"type":"m.room.message"}`), QuarantinedAt: 1,
+		}
+		second := &types.QuarantinedEvent{
+			EventID: "$b", RoomID: "!room:test", Origin: "b.test", Reason: "bad auth chain",
+			EventJSON: json.RawMessage(`{"type":"m.room.member"}`), QuarantinedAt: 2,
+		}
+		other := &types.QuarantinedEvent{
+			EventID: "$c", RoomID: "!other:test", Origin: "a.test", Reason: "bad auth",
+			EventJSON: json.RawMessage(`{}`), QuarantinedAt: 3,
+		}
+		for _, ev := range []*types.QuarantinedEvent{second, first, other} {
+			assert.NoError(t, tab.InsertQuarantinedEvent(ctx, nil, ev))
+		}
+
+		events, err := tab.SelectQuarantinedEvents(ctx, nil, "!room:test")
+		assert.NoError(t, err)
+		assert.Equal(t, []types.QuarantinedEvent{*first, *second}, events)
+
+		// quarantining an event again replaces where it came from and why
+		again := *first
+		again.Origin, again.Reason, again.QuarantinedAt = "c.test", "still bad", 4
+		assert.NoError(t, tab.InsertQuarantinedEvent(ctx, nil, &again))
+		event, err := tab.SelectQuarantinedEvent(ctx, nil, "$a")
+		assert.NoError(t, err)
+		assert.Equal(t, &again, event)
+
+		_, err = tab.SelectQuarantinedEvent(ctx, nil, "$unknown")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
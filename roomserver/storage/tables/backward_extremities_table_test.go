@@ -0,0 +1,69 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreateBackwardExtremitiesTable(t *testing.T, dbType test.DBType) (tab tables.BackwardExtremities, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateBackwardExtremitiesTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareBackwardExtremitiesTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreateBackwardExtremitiesTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PrepareBackwardExtremitiesTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestBackwardExtremitiesTable(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateBackwardExtremitiesTable(t, dbType)
+		defer close()
+
+		assert.NoError(t, tab.InsertBackwardExtremity(ctx, nil, 1, "$a", "$prev1"))
+		assert.NoError(t, tab.InsertBackwardExtremity(ctx, nil, 1, "$a", "$prev2"))
+		assert.NoError(t, tab.InsertBackwardExtremity(ctx, nil, 1, "$b", "$prev2"))
+		assert.NoError(t, tab.InsertBackwardExtremity(ctx, nil, 2, "$c", "$prev3"))
+		// inserting the same extremity twice is a no-op
+		assert.NoError(t, tab.InsertBackwardExtremity(ctx, nil, 1, "$a", "$prev1"))
+
+		bwExtrems, err := tab.SelectBackwardExtremitiesForRoom(ctx, nil, 1)
+		assert.NoError(t, err)
+		assert.Len(t, bwExtrems, 2)
+		assert.ElementsMatch(t, []string{"$prev1", "$prev2"}, bwExtrems["$a"])
+		assert.Equal(t, []string{"$prev2"}, bwExtrems["$b"])
+
+		// once we have $prev2, it is no longer missing for any event
+		assert.NoError(t, tab.DeleteBackwardExtremity(ctx, nil, 1, "$prev2"))
+		bwExtrems, err = tab.SelectBackwardExtremitiesForRoom(ctx, nil, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{"$a": {"$prev1"}}, bwExtrems)
+
+		// other rooms are unaffected
+		bwExtrems, err = tab.SelectBackwardExtremitiesForRoom(ctx, nil, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{"$c": {"$prev3"}}, bwExtrems)
+	})
+}
@@ -0,0 +1,62 @@
+package tables_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreateEventVirtualHostsTable(t *testing.T, dbType test.DBType) (tab tables.EventVirtualHosts, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateEventVirtualHostsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareEventVirtualHostsTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreateEventVirtualHostsTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PrepareEventVirtualHostsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestEventVirtualHostsTable(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateEventVirtualHostsTable(t, dbType)
+		defer close()
+
+		assert.NoError(t, tab.InsertEventVirtualHost(ctx, nil, 1, "a.test"))
+		assert.NoError(t, tab.InsertEventVirtualHost(ctx, nil, 2, "b.test"))
+		// the first virtual host to backfill an event is kept
+		assert.NoError(t, tab.InsertEventVirtualHost(ctx, nil, 1, "b.test"))
+
+		virtualHost, err := tab.SelectEventVirtualHost(ctx, nil, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, spec.ServerName("a.test"), virtualHost)
+		virtualHost, err = tab.SelectEventVirtualHost(ctx, nil, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, spec.ServerName("b.test"), virtualHost)
+
+		_, err = tab.SelectEventVirtualHost(ctx, nil, 3)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
@@ -138,6 +138,10 @@ func Test_EventsTable(t *testing.T) {
 			assert.True(t, ok)
 		}
 
+		existing, err := tab.BulkSelectExistingEventID(ctx, nil, append([]string{"$unknown:test"}, eventIDs...))
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, eventIDs, existing)
+
 		stateAndRefs, err := tab.BulkSelectStateAtEventAndReference(ctx, nil, nids)
 		assert.NoError(t, err)
 		assert.Equal(t, wantStateAtEventAndRefs, stateAndRefs)
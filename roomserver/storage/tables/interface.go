@@ -67,6 +67,8 @@ type Events interface {
 	// If an event ID is not in the database then it is omitted from the map.
 	BulkSelectEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventMetadata, error)
 	BulkSelectUnsentEventNID(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[string]types.EventMetadata, error)
+	// BulkSelectExistingEventID returns which of the given event IDs are in the database.
+	BulkSelectExistingEventID(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]string, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
 	SelectEventRejected(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string) (rejected bool, err error)
@@ -178,6 +180,8 @@ type Membership interface {
 	UpdateForgetMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, forget bool) error
 	SelectLocalServerInRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (bool, error)
 	SelectServerInRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, serverName spec.ServerName) (bool, error)
+	// SelectJoinedServerNamesInRoom returns the distinct server names of the users joined to the room.
+	SelectJoinedServerNamesInRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) ([]spec.ServerName, error)
 	DeleteMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) error
 	SelectJoinedUsers(ctx context.Context, txn *sql.Tx, targetUserNIDs []types.EventStateKeyNID) ([]types.EventStateKeyNID, error)
 }
@@ -208,6 +212,41 @@ type Redactions interface {
 	MarkRedactionValidated(ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool) error
 }
 
+type BackwardExtremities interface {
+	InsertBackwardExtremity(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID, prevEventID string) error
+	// SelectBackwardExtremitiesForRoom returns the backward extremities of the room, as a map of event ID to the prev_event IDs we don't have.
+	SelectBackwardExtremitiesForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (map[string][]string, error)
+	// DeleteBackwardExtremity removes the given prev_event from the backward extremities of the room, as we now have it.
+	DeleteBackwardExtremity(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, prevEventID string) error
+}
+
+type EventVirtualHosts interface {
+	InsertEventVirtualHost(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, virtualHost spec.ServerName) error
+	// SelectEventVirtualHost returns the virtual host the event was backfilled for, or sql.ErrNoRows if it wasn't recorded.
+	SelectEventVirtualHost(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (spec.ServerName, error)
+}
+
+type BackfillCheckpoints interface {
+	UpsertBackfillCheckpoint(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string) error
+	// SelectBackfillCheckpoint returns the checkpoint of the last backfill of the room, or sql.ErrNoRows if there isn't one.
+	SelectBackfillCheckpoint(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (string, error)
+}
+
+type PurgeHorizons interface {
+	// UpsertPurgeHorizon sets the purge horizon of the room, replacing any earlier one.
+	UpsertPurgeHorizon(ctx context.Context, txn *sql.Tx, roomID string, horizon types.PurgeHorizon) error
+	// SelectPurgeHorizon returns the purge horizon of the room, or sql.ErrNoRows if it was never purged.
+	SelectPurgeHorizon(ctx context.Context, txn *sql.Tx, roomID string) (*types.PurgeHorizon, error)
+}
+
+type BackfillQuarantine interface {
+	InsertQuarantinedEvent(ctx context.Context, txn *sql.Tx, event *types.QuarantinedEvent) error
+	// SelectQuarantinedEvents returns the quarantined events of the room, oldest first.
+	SelectQuarantinedEvents(ctx context.Context, txn *sql.Tx, roomID string) ([]types.QuarantinedEvent, error)
+	// SelectQuarantinedEvent returns the quarantined event, or sql.ErrNoRows if it isn't quarantined.
+	SelectQuarantinedEvent(ctx context.Context, txn *sql.Tx, eventID string) (*types.QuarantinedEvent, error)
+}
+
 type Purge interface {
 	PurgeRoom(
 		ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
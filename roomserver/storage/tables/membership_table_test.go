@@ -12,6 +12,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -137,3 +138,40 @@ func TestMembershipTable(t *testing.T) {
 		assert.Equal(t, userNIDs[:1], joinedUsers)
 	})
 }
+
+func TestMembershipTableJoinedServerNames(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, stateKeyTab, close := mustCreateMembershipTable(t, dbType)
+		defer close()
+
+		memberships := []struct {
+			userID     string
+			membership tables.MembershipState
+		}{
+			{"@alice:localhost", tables.MembershipStateJoin},
+			{"@bob:localhost", tables.MembershipStateJoin},
+			{"@charlie:remote", tables.MembershipStateJoin},
+			{"@dave:remote:8448", tables.MembershipStateJoin},
+			{"@eve:left", tables.MembershipStateLeaveOrBan},
+			{"@frank:invited", tables.MembershipStateInvite},
+		}
+		for _, m := range memberships {
+			stateKeyNID, err := stateKeyTab.InsertEventStateKeyNID(ctx, nil, m.userID)
+			assert.NoError(t, err)
+			err = tab.InsertMembership(ctx, nil, 1, stateKeyNID, false)
+			assert.NoError(t, err)
+			_, err = tab.UpdateMembership(ctx, nil, 1, stateKeyNID, stateKeyNID, m.membership, 1, false)
+			assert.NoError(t, err)
+		}
+
+		// Only servers with joined users are returned, and each of them only once
+		servers, err := tab.SelectJoinedServerNamesInRoom(ctx, nil, 1)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []spec.ServerName{"localhost", "remote", "remote:8448"}, servers)
+
+		servers, err = tab.SelectJoinedServerNamesInRoom(ctx, nil, 2)
+		assert.NoError(t, err)
+		assert.Empty(t, servers)
+	})
+}
@@ -0,0 +1,62 @@
+package tables_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreatePurgeHorizonsTable(t *testing.T, dbType test.DBType) (tab tables.PurgeHorizons, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreatePurgeHorizonsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PreparePurgeHorizonsTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreatePurgeHorizonsTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PreparePurgeHorizonsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestPurgeHorizonsTable(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreatePurgeHorizonsTable(t, dbType)
+		defer close()
+
+		assert.NoError(t, tab.UpsertPurgeHorizon(ctx, nil, "!a:test", types.PurgeHorizon{Depth: 5, Timestamp: 1000}))
+		assert.NoError(t, tab.UpsertPurgeHorizon(ctx, nil, "!b:test", types.PurgeHorizon{Depth: 7, Timestamp: 2000}))
+		// purging again moves the horizon
+		assert.NoError(t, tab.UpsertPurgeHorizon(ctx, nil, "!a:test", types.PurgeHorizon{Depth: 9, Timestamp: 3000}))
+
+		horizon, err := tab.SelectPurgeHorizon(ctx, nil, "!a:test")
+		assert.NoError(t, err)
+		assert.Equal(t, &types.PurgeHorizon{Depth: 9, Timestamp: 3000}, horizon)
+		horizon, err = tab.SelectPurgeHorizon(ctx, nil, "!b:test")
+		assert.NoError(t, err)
+		assert.Equal(t, &types.PurgeHorizon{Depth: 7, Timestamp: 2000}, horizon)
+
+		_, err = tab.SelectPurgeHorizon(ctx, nil, "!c:test")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
@@ -291,6 +291,32 @@ type RejectedError string
 
 func (e RejectedError) Error() string { return string(e) }
 
+// QuarantinedEvent is an event which failed auth checks while it was being
+// fetched during backfill, and was kept so that it can be inspected.
+type QuarantinedEvent struct {
+	EventID       string          `json:"event_id"`
+	RoomID        string          `json:"room_id"`
+	Origin        spec.ServerName `json:"origin"`
+	Reason        string          `json:"reason"`
+	EventJSON     json.RawMessage `json:"event"`
+	QuarantinedAt spec.Timestamp  `json:"quarantined_at"`
+}
+
+// PurgeHorizon is how far back the history of a room was purged. Backfilled
+// events from before the horizon are dropped, so that backfill doesn't bring
+// back history which was purged.
+type PurgeHorizon struct {
+	// Events with a lower depth than this are before the horizon.
+	Depth int64
+	// Events sent before this time are before the horizon.
+	Timestamp spec.Timestamp
+}
+
+// Before returns whether the event is from before the horizon.
+func (h *PurgeHorizon) Before(event gomatrixserverlib.PDU) bool {
+	return event.Depth() < h.Depth || event.OriginServerTS() < h.Timestamp
+}
+
 // RoomInfo contains metadata about a room
 type RoomInfo struct {
 	mu               sync.RWMutex
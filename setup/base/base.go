@@ -256,6 +256,26 @@ func SetupAndServeHTTP(
 	logrus.Infof("Stopped HTTP listeners")
 }
 
+// ReloadOnSIGHUP calls reload each time the process receives SIGHUP from now on, until Dendrite shuts down.
+func ReloadOnSIGHUP(processCtx *process.ProcessContext, reload func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	processCtx.ComponentStarted()
+	go func() {
+		defer processCtx.ComponentFinished()
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-sigs:
+				logrus.Infof("Reload signal received")
+				reload()
+			case <-processCtx.WaitForShutdown():
+				return
+			}
+		}
+	}()
+}
+
 func WaitForShutdown(processCtx *process.ProcessContext) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
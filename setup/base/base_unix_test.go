@@ -0,0 +1,43 @@
+//go:build unix
+// +build unix
+
+package base_test
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	basepkg "github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	processCtx := process.NewProcessContext()
+	reloads := make(chan struct{}, 1)
+	basepkg.ReloadOnSIGHUP(processCtx, func() { reloads <- struct{}{} })
+
+	// each SIGHUP reloads once
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGHUP))
+		select {
+		case <-reloads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reload %d didn't happen", i)
+		}
+	}
+
+	// reloading stops once Dendrite shuts down
+	processCtx.ShutdownDendrite()
+	stopped := make(chan struct{})
+	go func() {
+		processCtx.WaitForComponentsToFinish()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still reloading on SIGHUP after shutting down")
+	}
+}
@@ -107,6 +107,15 @@ func (c *Proxy) Verify(configErrs *ConfigErrors) {
 // retrieving server keys.
 type KeyPerspectives []KeyPerspective
 
+// ServerNames returns the server names of the perspective key servers.
+func (k KeyPerspectives) ServerNames() []spec.ServerName {
+	var serverNames []spec.ServerName
+	for _, kp := range k {
+		serverNames = append(serverNames, kp.ServerName)
+	}
+	return serverNames
+}
+
 type KeyPerspective struct {
 	// The server name of the perspective key server
 	ServerName spec.ServerName `yaml:"server_name"`
@@ -2,8 +2,10 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,10 +15,14 @@ type RoomServer struct {
 	DefaultRoomVersion gomatrixserverlib.RoomVersion `yaml:"default_room_version,omitempty"`
 
 	Database DatabaseOptions `yaml:"database,omitempty"`
+
+	// Backfill controls how the roomserver fetches room history from other servers.
+	Backfill Backfill `yaml:"backfill,omitempty"`
 }
 
 func (c *RoomServer) Defaults(opts DefaultOpts) {
 	c.DefaultRoomVersion = gomatrixserverlib.RoomVersionV10
+	c.Backfill.Defaults()
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.Database.ConnectionString = "file:roomserver.db"
@@ -34,4 +40,168 @@ func (c *RoomServer) Verify(configErrs *ConfigErrors) {
 	} else if !gomatrixserverlib.StableRoomVersion(c.DefaultRoomVersion) {
 		log.Warnf("WARNING: Provided default room version %q is unstable", c.DefaultRoomVersion)
 	}
+	c.Backfill.Verify(configErrs)
+}
+
+type Backfill struct {
+	// The maximum number of outbound federation requests (/backfill, /state_ids,
+	// /state and /event) a single backfill may make before returning what it has
+	// gathered so far. 0 means there is no limit.
+	MaxFederationRequests int `yaml:"max_federation_requests"`
+	// The maximum number of backfilled events to store in the database at the
+	// same time. Events which depend on each other are still stored in order.
+	// Only raise this above 1 if the database copes well with parallel writes,
+	// which is usually not the case for SQLite.
+	PersistConcurrency int `yaml:"persist_concurrency"`
+	// If enabled, missing events are fetched from whichever servers have
+	// responded fastest so far during the backfill, rather than in the order
+	// the servers were selected in.
+	PreferFastServers bool `yaml:"prefer_fast_servers"`
+	// How long the response to a backfill is reused for identical backfills,
+	// so that clients retrying a failed pagination don't cause the same events
+	// to be backfilled again. This should be at least min_interval, so that
+	// identical backfills within the interval get the cached result rather
+	// than failing. Defaults to 5 seconds. 0 disables caching.
+	ResultCacheTTL time.Duration `yaml:"result_cache_ttl"`
+	// The maximum number of backfill responses to cache.
+	ResultCacheSize int `yaml:"result_cache_size"`
+	// If enabled, the roomserver records which virtual host each backfilled
+	// event was fetched for, which helps to audit multi-tenant deployments.
+	RecordVirtualHost bool `yaml:"record_virtual_host"`
+	// If set, backfilled events are persisted this many at a time, newest
+	// first, recording a checkpoint after each batch so that an interrupted
+	// backfill can be resumed. 0 persists all backfilled events at once.
+	CheckpointInterval int `yaml:"checkpoint_interval"`
+	// If true, missing events which fail auth checks during backfill are kept
+	// for inspection with the admin API instead of being dropped.
+	QuarantineRejectedEvents bool `yaml:"quarantine_rejected_events"`
+	// If true, the auth events sent along with the state of the room at
+	// backfilled events are kept for the rest of the backfill, using more
+	// memory but making fewer federation requests in rooms with lots of state.
+	RememberAuthEvents bool `yaml:"remember_auth_events"`
+	// The maximum number of backfill federation requests which may be in
+	// flight to any one server at once, across all rooms. Further requests
+	// wait for an earlier one to finish. 0 means there is no limit.
+	MaxConcurrentRequestsPerServer int `yaml:"max_concurrent_requests_per_server"`
+	// Servers to prefer when backfilling, with their weights. Servers with
+	// higher weights are tried first, and all of them are tried before the
+	// other servers in the room. Weights must not be negative.
+	PreferServerWeights map[spec.ServerName]int `yaml:"prefer_server_weights,omitempty"`
+	// Whether to refuse to store backfilled events whose state before them
+	// would obviously reset critical room state, such as the create or
+	// power levels event. Otherwise state resets are only logged and
+	// counted in the backfill_state_resets metric.
+	RejectStateResets bool `yaml:"reject_state_resets"`
+	// How often the same kind of backfill failure involving the same server
+	// is logged at most, so that the logs stay readable when federation is
+	// broadly down. 0 logs every failure.
+	FailureLogInterval time.Duration `yaml:"failure_log_interval"`
+	// Whether to backfill from the server which most recently provided the
+	// history of a room first, ahead of the preferred servers, as it is
+	// likely to still have the history and be reachable.
+	PreferRecentServers bool `yaml:"prefer_recent_servers"`
+	// The directory which the admin API writes backfill exports to. Exports
+	// are disabled if this is empty.
+	ExportPath Path `yaml:"export_path"`
+	// The longest time a backfill may spend fetching events over federation,
+	// after which it returns the events fetched so far as a partial result.
+	// The events which were fetched are still persisted in full, which isn't
+	// covered by the timeout, including fetching any state or auth events
+	// they need which weren't fetched along with them. Those fetches are
+	// limited by max_federation_requests instead. 0 means there is no limit.
+	Timeout time.Duration `yaml:"timeout"`
+	// A server to send backfill federation requests to when the servers in
+	// the room can't be reached directly, which fetches the events on our
+	// behalf. This is useful if some servers are only reachable through a
+	// well-connected relay. The events are still checked against the
+	// signatures of the servers which sent them. If empty, backfill only uses
+	// federation directly.
+	RelayServer spec.ServerName `yaml:"relay_server"`
+	// Whether to also backfill from servers whose users have since left the
+	// room, or were banned, when history visibility allows us to backfill
+	// from the joined servers. They are likely to still hold the history
+	// from when they were in the room.
+	IncludeLeftServers bool `yaml:"include_left_servers"`
+	// Whether to backfill from the servers of everyone who has been in the
+	// room, including those who have left, when history visibility means we
+	// aren't allowed to see the history ourselves, e.g. because the history
+	// is only visible to joined members and we have since left. The history
+	// is still only served to those allowed to see it.
+	FallbackToMemberServers bool `yaml:"fallback_to_member_servers"`
+	// How many rounds of backfilling from federation a single backfill may
+	// take to get as many events as were requested. Each round carries on
+	// from the oldest events of the last one, until enough events have been
+	// fetched, no more are found or the timeout is reached. 0 or 1 means a
+	// single round.
+	MaxRounds int `yaml:"max_rounds"`
+	// How long the servers worked out to be in a room at the point a backfill
+	// starts from are reused for by later backfills from the same point, so
+	// that repeated backfills of large rooms don't load the memberships and
+	// history visibility from the database again. 0 disables this.
+	ServersCacheTTL time.Duration `yaml:"servers_cache_ttl"`
+	// Whether a backfill whose cached servers have expired in the last
+	// servers_cache_ttl should start backfilling from them straight away,
+	// while the servers are worked out again in the background for the next
+	// backfill, rather than waiting for them to be worked out first.
+	RefreshServersConcurrently bool `yaml:"refresh_servers_concurrently"`
+	// The most events, and the most sets of state before events, a single
+	// backfill keeps in memory while walking history, to work out the state
+	// before the events next to them without asking other servers. Once there
+	// are more, the least recently used are forgotten, so that backfilling a
+	// huge room doesn't use unbounded memory. The events still being
+	// backfilled are never forgotten. 0 means there is no limit.
+	MaxRememberedEvents int `yaml:"max_remembered_events"`
+	// A read replica of the room server database, which backfill reads the
+	// history of rooms from to take load off the primary database. Anything
+	// missing from the replica, for example because it is lagging behind, is
+	// read from the primary database instead, and everything is written to
+	// the primary database. Only PostgreSQL is supported. The replica has its
+	// own cache, a quarter of the size of the global cache. If not set, the
+	// room server database is used for everything.
+	ReadReplicaDatabase DatabaseOptions `yaml:"read_replica_database,omitempty"`
+	// The shortest time between backfills of the same room from federation,
+	// so that clients paginating rapidly don't overwhelm federation and the
+	// database. Backfills within the interval which are identical to the
+	// last get its cached result as long as result_cache_ttl is at least the
+	// interval, otherwise they fail and should be retried later, so disabling
+	// result_cache_ttl or setting it lower than this makes clients retrying a
+	// pagination fail more often. Backfills served from the database, dry runs
+	// such as exports and backfills which fail aren't limited. Defaults to 1
+	// second. 0 means there is no minimum.
+	MinInterval time.Duration `yaml:"min_interval"`
+}
+
+func (b *Backfill) Defaults() {
+	b.MaxFederationRequests = 0
+	b.PersistConcurrency = 1
+	b.ResultCacheTTL = 5 * time.Second
+	b.ResultCacheSize = 1000
+	b.MaxConcurrentRequestsPerServer = 4
+	b.FailureLogInterval = time.Minute
+	b.Timeout = 2 * time.Minute
+	b.MaxRounds = 1
+	b.MinInterval = time.Second
+}
+
+func (b *Backfill) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "room_server.backfill.max_federation_requests", int64(b.MaxFederationRequests))
+	if b.PersistConcurrency < 1 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.backfill.persist_concurrency': %d, must be at least 1", b.PersistConcurrency))
+	}
+	checkPositive(configErrs, "room_server.backfill.result_cache_ttl", int64(b.ResultCacheTTL))
+	checkPositive(configErrs, "room_server.backfill.result_cache_size", int64(b.ResultCacheSize))
+	checkPositive(configErrs, "room_server.backfill.checkpoint_interval", int64(b.CheckpointInterval))
+	checkPositive(configErrs, "room_server.backfill.max_concurrent_requests_per_server", int64(b.MaxConcurrentRequestsPerServer))
+	checkPositive(configErrs, "room_server.backfill.failure_log_interval", int64(b.FailureLogInterval))
+	checkPositive(configErrs, "room_server.backfill.timeout", int64(b.Timeout))
+	checkPositive(configErrs, "room_server.backfill.max_rounds", int64(b.MaxRounds))
+	checkPositive(configErrs, "room_server.backfill.servers_cache_ttl", int64(b.ServersCacheTTL))
+	checkPositive(configErrs, "room_server.backfill.max_remembered_events", int64(b.MaxRememberedEvents))
+	checkPositive(configErrs, "room_server.backfill.min_interval", int64(b.MinInterval))
+	if b.ReadReplicaDatabase.ConnectionString != "" && !b.ReadReplicaDatabase.ConnectionString.IsPostgres() {
+		configErrs.Add("invalid value for config key 'room_server.backfill.read_replica_database.connection_string': read replicas are only supported with PostgreSQL")
+	}
+	for server, weight := range b.PreferServerWeights {
+		checkPositive(configErrs, fmt.Sprintf("room_server.backfill.prefer_server_weights.%s", server), int64(weight))
+	}
 }
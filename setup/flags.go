@@ -43,15 +43,26 @@ func ParseFlags(monolith bool) *config.Dendrite {
 		logrus.Fatal("--config must be supplied")
 	}
 
-	cfg, err := config.Load(*configPath)
+	cfg, err := LoadConfig()
 
 	if err != nil {
 		logrus.Fatalf("Invalid config file: %s", err)
 	}
 
+	return cfg
+}
+
+// LoadConfig loads the config file given on the commandline, e.g. again once the
+// flags have been parsed to apply changes made to it while Dendrite is running.
+func LoadConfig() (*config.Dendrite, error) {
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return nil, err
+	}
+
 	if *enableRegistrationWithoutVerification {
 		cfg.ClientAPI.OpenRegistrationWithoutVerificationEnabled = true
 	}
 
-	return cfg
+	return cfg, nil
 }
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
@@ -55,6 +56,8 @@ type messagesReq struct {
 	backwardOrdering bool
 	filter           *synctypes.RoomEventFilter
 	didBackfill      bool
+	// servers to try first if we need to backfill, e.g. from the via parameters of a permalink
+	serverHints []spec.ServerName
 }
 
 type messagesResp struct {
@@ -261,9 +264,22 @@ func OnIncomingMessagesRequest(
 		backwardOrdering: backwardOrdering,
 		device:           device,
 		deviceUserID:     *deviceUserID,
+		serverHints:      parseServerHints(req),
 	}
 
 	clientEvents, start, end, err := mReq.retrieveEvents(req.Context(), rsAPI)
+	if unsupported := (api.ErrUnsupportedRoomVersion{}); errors.As(err, &unsupported) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.UnsupportedRoomVersion(unsupported.Error()),
+		}
+	}
+	if tooSoon := (api.ErrBackfillTooSoon{}); errors.As(err, &tooSoon) {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: spec.LimitExceeded(tooSoon.Error(), tooSoon.RetryAfter.Milliseconds()),
+		}
+	}
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("mreq.retrieveEvents failed")
 		return util.JSONResponse{
@@ -543,6 +559,18 @@ func (r *messagesReq) handleNonEmptyEventsSlice(streamEvents []types.StreamEvent
 	return
 }
 
+// parseServerHints returns the servers given by the via query parameters of the request, which clients can pass
+// on from a permalink. Invalid server names are ignored.
+func parseServerHints(req *http.Request) []spec.ServerName {
+	var serverHints []spec.ServerName
+	for _, via := range req.URL.Query()["via"] {
+		if _, _, ok := spec.ParseAndValidateServerName(spec.ServerName(via)); ok {
+			serverHints = append(serverHints, spec.ServerName(via))
+		}
+	}
+	return serverHints
+}
+
 type eventsByDepth []*rstypes.HeaderedEvent
 
 func (e eventsByDepth) Len() int {
@@ -572,6 +600,7 @@ func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]
 		Limit:                limit,
 		ServerName:           r.cfg.Matrix.ServerName,
 		VirtualHost:          r.device.UserDomain(),
+		ServerHints:          r.serverHints,
 	}, &res)
 	if err != nil {
 		return nil, fmt.Errorf("PerformBackfill failed: %w", err)
@@ -0,0 +1,43 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type backfillRoomserverAPI struct {
+	api.SyncRoomserverAPI
+	req *api.PerformBackfillRequest
+}
+
+func (b *backfillRoomserverAPI) PerformBackfill(ctx context.Context, req *api.PerformBackfillRequest, res *api.PerformBackfillResponse) error {
+	b.req = req
+	return nil
+}
+
+func TestMessagesBackfillServerHints(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://localhost:8800/_matrix/client/v3/rooms/!room:localhost/messages?dir=b&via=a.example.com&via=not%20a%20server&via=b.example.com:8448", nil)
+	rsAPI := &backfillRoomserverAPI{}
+	cfg := &config.SyncAPI{Matrix: &config.Global{}}
+	cfg.Matrix.ServerName = "localhost"
+	r := messagesReq{
+		ctx:         context.Background(),
+		rsAPI:       rsAPI,
+		cfg:         cfg,
+		device:      &userapi.Device{UserID: "@alice:localhost"},
+		serverHints: parseServerHints(req),
+	}
+
+	_, err := r.backfill("!room:localhost", map[string][]string{"$event": {"$missing"}}, 10)
+	assert.NoError(t, err)
+	// the via servers from the request are passed on to the roomserver, ignoring invalid ones
+	assert.Equal(t, []spec.ServerName{"a.example.com", "b.example.com:8448"}, rsAPI.req.ServerHints)
+}
@@ -33,6 +33,7 @@ type eventMods struct {
 	keyID          gomatrixserverlib.KeyID
 	privKey        ed25519.PrivateKey
 	authEvents     []string
+	redacts        string
 }
 
 type eventModifier func(e *eventMods)
@@ -79,6 +80,12 @@ func WithOrigin(origin spec.ServerName) eventModifier {
 	}
 }
 
+func WithRedacts(eventID string) eventModifier {
+	return func(e *eventMods) {
+		e.redacts = eventID
+	}
+}
+
 // Reverse a list of events
 func Reversed(in []*types.HeaderedEvent) []*types.HeaderedEvent {
 	out := make([]*types.HeaderedEvent, len(in))